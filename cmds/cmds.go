@@ -39,8 +39,36 @@ var start = &cobra.Command{
 	},
 }
 
+var reconcile = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Command to rebuild the metadata catalog from HDFS",
+	Long:  "Command to rebuild the metadata catalog from HDFS, the server must be stopped",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := server.Reconcile(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "reconcile catalog failed %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var rewrapKeys = &cobra.Command{
+	Use:   "rewrap-keys",
+	Short: "Command to wrap the keys of the encrypted files with the current master key",
+	Long:  "Command to wrap the keys of the encrypted files with the current master key after a key rotation, compaction must not run meanwhile",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := server.RewrapKeys(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "rewrap keys failed %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
 func Execute() {
 	root.AddCommand(start)
+	root.AddCommand(reconcile)
+	root.AddCommand(rewrapKeys)
 
 	if err := root.Execute(); err != nil {
 		os.Exit(1)
@@ -55,4 +83,12 @@ func init() {
 	start.Flags().StringVarP(
 		&config.FilePath, "config", "c", "", "path of config file",
 	)
+
+	reconcile.Flags().StringVarP(
+		&config.FilePath, "config", "c", "", "path of config file",
+	)
+
+	rewrapKeys.Flags().StringVarP(
+		&config.FilePath, "config", "c", "", "path of config file",
+	)
 }
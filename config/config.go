@@ -28,14 +28,245 @@ type HdfsConfig struct {
 	BufferSize int32  `json:"buffer_size"  yaml:"buffer_size"  env:"BUFFER_SIZE"   validate:"required"`
 }
 
-// Config is the configuration settings for logmanager
+type SearchIndexConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled" env:"ENABLED"`
+	// Local dir to store the full-text index segments
+	Dir string `json:"dir"     yaml:"dir"     env:"DIR"     validate:"required_if=Enabled true"`
+}
+
+type CatalogConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled" env:"ENABLED"`
+	// Local file of the metadata catalog of archived files
+	Path string `json:"path"    yaml:"path"    env:"PATH"    validate:"required_if=Enabled true"`
+}
+
+// RetentionPolicy limits how long archived instance logs are kept, zero values mean no limit.
+type RetentionPolicy struct {
+	MaxAge              time.Duration `json:"max_age"                yaml:"max_age"                env:"MAX_AGE"                validate:"gte=0"`
+	MaxInstancesPerFlow int           `json:"max_instances_per_flow" yaml:"max_instances_per_flow" env:"MAX_INSTANCES_PER_FLOW" validate:"gte=0"`
+	MaxBytesPerSpace    int64         `json:"max_bytes_per_space"    yaml:"max_bytes_per_space"    env:"MAX_BYTES_PER_SPACE"    validate:"gte=0"`
+}
+
+type RetentionConfig struct {
+	Enabled  bool          `json:"enabled"  yaml:"enabled"  env:"ENABLED"`
+	Interval time.Duration `json:"interval" yaml:"interval" env:"INTERVAL" validate:"required_if=Enabled true"`
+	// Only report the instances to remove without deleting them
+	DryRun bool             `json:"dry_run" yaml:"dry_run" env:"DRY_RUN"`
+	Policy *RetentionPolicy `json:"policy"  yaml:"policy"  env:"POLICY"  validate:"required"`
+	// Optional yaml file of per-space policies ({space_id: policy}), it's reloaded before each sweep
+	OverridesFile string `json:"overrides_file" yaml:"overrides_file" env:"OVERRIDES_FILE"`
+}
+
+// StorageQuota limits the bytes of archived logs, zero values mean no limit.
+type StorageQuota struct {
+	MaxBytesPerSpace int64 `json:"max_bytes_per_space" yaml:"max_bytes_per_space" env:"MAX_BYTES_PER_SPACE" validate:"gte=0"`
+	MaxBytesPerFlow  int64 `json:"max_bytes_per_flow"  yaml:"max_bytes_per_flow"  env:"MAX_BYTES_PER_FLOW"  validate:"gte=0"`
+}
+
+type QuotaConfig struct {
+	Enabled bool          `json:"enabled" yaml:"enabled" env:"ENABLED"`
+	Default *StorageQuota `json:"default" yaml:"default" env:"DEFAULT" validate:"required"`
+	// How long the usage read from HDFS is trusted before it is read again
+	UsageCacheTTL time.Duration `json:"usage_cache_ttl" yaml:"usage_cache_ttl" env:"USAGE_CACHE_TTL" validate:"required_if=Enabled true"`
+	// Optional yaml file of per-space quotas ({space_id: quota}), it's read at startup
+	OverridesFile string `json:"overrides_file" yaml:"overrides_file" env:"OVERRIDES_FILE"`
+}
+
+type UsageReportConfig struct {
+	// How long a storage usage report is served before it is computed again
+	RefreshInterval time.Duration `json:"refresh_interval" yaml:"refresh_interval" env:"REFRESH_INTERVAL" validate:"required"`
+}
+
+type CompactionConfig struct {
+	Enabled  bool          `json:"enabled"  yaml:"enabled"  env:"ENABLED"`
+	Interval time.Duration `json:"interval" yaml:"interval" env:"INTERVAL" validate:"required_if=Enabled true"`
+	// Instances whose newest log file is older than MinAge are packed into a single archive
+	MinAge time.Duration `json:"min_age" yaml:"min_age" env:"MIN_AGE" validate:"required_if=Enabled true"`
+}
+
+// FlinkClientConfig restricts the Flink servers UploadLogFile and GetUploadingTaskStat may send requests to.
+// The lists are comma separated.
+type FlinkClientConfig struct {
+	// e.g. "http,https"
+	AllowedSchemes string `json:"allowed_schemes" yaml:"allowed_schemes" env:"ALLOWED_SCHEMES" validate:"required"`
+	// Shell patterns of host names, e.g. "*.flink.svc.cluster.local", empty for any host
+	AllowedHosts string `json:"allowed_hosts" yaml:"allowed_hosts" env:"ALLOWED_HOSTS"`
+	// Addresses the hosts may resolve to, e.g. "10.0.0.0/8,172.16.0.0/12",
+	// empty for any address except loopback, link-local, multicast, unspecified and private ones
+	AllowedCIDRs string `json:"allowed_cidrs" yaml:"allowed_cidrs" env:"ALLOWED_CIDRS"`
+	// Max bytes of a Flink REST API response
+	MaxResponseSize int64 `json:"max_response_size" yaml:"max_response_size" env:"MAX_RESPONSE_SIZE" validate:"gt=0"`
+	// Max bytes of a downloaded log file, 0 means no limit
+	MaxLogFileSize int64 `json:"max_log_file_size" yaml:"max_log_file_size" env:"MAX_LOG_FILE_SIZE" validate:"gte=0"`
+	// TLS settings of the https urls
+	TLS *FlinkTLSConfig `json:"tls" yaml:"tls" env:"TLS" validate:"required"`
+}
+
+// FlinkTLSConfig is applied to the https requests sent to the Flink servers with rest.ssl enabled.
+type FlinkTLSConfig struct {
+	// PEM bundle of the CAs the server certificates are verified with, the system CAs if empty
+	CAFile string `json:"ca_file" yaml:"ca_file" env:"CA_FILE"`
+	// PEM client certificate and key, for the servers requiring client authentication
+	CertFile string `json:"cert_file" yaml:"cert_file" env:"CERT_FILE" validate:"required_with=KeyFile"`
+	KeyFile  string `json:"key_file"  yaml:"key_file"  env:"KEY_FILE"  validate:"required_with=CertFile"`
+	// Name the server certificates are verified against instead of the host of the url
+	ServerName string `json:"server_name" yaml:"server_name" env:"SERVER_NAME"`
+	// Do not verify the server certificates, only for test clusters
+	InsecureSkipVerify bool `json:"insecure_skip_verify" yaml:"insecure_skip_verify" env:"INSECURE_SKIP_VERIFY"`
+}
+
+type RedactionConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled" env:"ENABLED"`
+	// Only apply the rules of RulesFile
+	DisableBuiltinRules bool `json:"disable_builtin_rules" yaml:"disable_builtin_rules" env:"DISABLE_BUILTIN_RULES"`
+	// Optional yaml file of extra rules ([{name, pattern, replacement}]), it's read at startup
+	RulesFile string `json:"rules_file" yaml:"rules_file" env:"RULES_FILE"`
+}
+
+// RedactionRule replaces the matches of a regular expression in each line of the collected logs.
+type RedactionRule struct {
+	Name    string `json:"name"    yaml:"name"    validate:"required"`
+	Pattern string `json:"pattern" yaml:"pattern" validate:"required"`
+	// May refer to the submatches of Pattern, e.g. "${1}******", "******" if empty
+	Replacement string `json:"replacement" yaml:"replacement"`
+}
+
+type EncryptionConfig struct {
+	// Encrypt the log files collected from now on, the files encrypted before are decrypted as long as KeyFile is set.
+	// The search index must be disabled, its local segments are not encrypted.
+	Enabled bool `json:"enabled" yaml:"enabled" env:"ENABLED"`
+	// Local file of the master keys the data keys of the files are wrapped with, see MasterKeys
+	KeyFile string `json:"key_file" yaml:"key_file" env:"KEY_FILE" validate:"required_if=Enabled true"`
+}
+
+// MasterKeys are the keys of the key file, keys are rotated by adding a new key, making it the current one
+// and running "logmanager rewrap-keys", the previous key can be removed afterwards.
+type MasterKeys struct {
+	// Id of the key the data keys of new files are wrapped with
+	Current string `json:"current" yaml:"current" validate:"required"`
+	// Key id => base64 encoded 256 bits key
+	Keys map[string]string `json:"keys" yaml:"keys" validate:"required"`
+}
+
+// MetricsConfig is the labels of the metrics exposed by the metrics server.
+type MetricsConfig struct {
+	// Label the upload and download metrics by space, each space adds its own series
+	SpaceLabel bool `json:"space_label" yaml:"space_label" env:"SPACE_LABEL"`
+}
+
+// HealthConfig drives the serving status of the grpc health service and of the readiness endpoint.
+type HealthConfig struct {
+	// How often the NameNode is probed
+	ProbeInterval time.Duration `json:"probe_interval" yaml:"probe_interval" env:"PROBE_INTERVAL" validate:"required"`
+	// The service is not serving if the NameNode does not answer a probe within ProbeTimeout
+	ProbeTimeout time.Duration `json:"probe_timeout" yaml:"probe_timeout" env:"PROBE_TIMEOUT" validate:"required"`
+	// Path of the readiness endpoint served along with the metrics
+	ReadinessPath string `json:"readiness_path" yaml:"readiness_path" env:"READINESS_PATH" validate:"required"`
+}
+
+// AuditConfig is the sink of the audit events recorded for each call of the service.
+type AuditConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled" env:"ENABLED"`
+	// "file" or "hdfs"
+	Sink string `json:"sink" yaml:"sink" env:"SINK" validate:"required_if=Enabled true"`
+	// Local file of the file sink, or HDFS dir of the hdfs sink where a file is written per day
+	Path string `json:"path" yaml:"path" env:"PATH" validate:"required_if=Enabled true"`
+	// The local file is rotated once it reaches MaxFileSize bytes, 0 means no rotation
+	MaxFileSize int64 `json:"max_file_size" yaml:"max_file_size" env:"MAX_FILE_SIZE" validate:"gte=0"`
+	// Rotated local files kept, 0 means all
+	MaxBackups int `json:"max_backups" yaml:"max_backups" env:"MAX_BACKUPS" validate:"gte=0"`
+	// Events are buffered and written to the sink at this interval
+	FlushInterval time.Duration `json:"flush_interval" yaml:"flush_interval" env:"FLUSH_INTERVAL" validate:"required_if=Enabled true"`
+}
+
+type AuthConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled" env:"ENABLED"`
+	// yaml file of the identities allowed to call the service and the spaces they are members of
+	PolicyFile string `json:"policy_file" yaml:"policy_file" env:"POLICY_FILE" validate:"required_if=Enabled true"`
+}
+
+// AuthIdentity is a caller of the service, identified by a bearer token
+// or by the common name of its client certificate if Token is empty.
+type AuthIdentity struct {
+	Token string `json:"token" yaml:"token"`
+	// space ids, "*" for all spaces
+	Spaces []string `json:"spaces" yaml:"spaces" validate:"required"`
+}
+
+// Config is the configuration settings for logmanager,
+// the sections from Metrics on are optional, see setDefaults.
 type Config struct {
 	LogLevel      int8                   `json:"log_level"      yaml:"log_level"      env:"LOG_LEVEL"           validate:"gte=1,lte=5"`
 	GRPCServer    *grpcwrap.ServerConfig `json:"grpc_server"    yaml:"grpc_server"    env:"GRPC_SERVER"         validate:"required"`
 	GRPCLog       *grpcwrap.LogConfig    `json:"grpc_log"       yaml:"grpc_log"       env:"GRPC_LOG"            validate:"required"`
 	MetricsServer *metrics.Config        `json:"metrics_server" yaml:"metrics_server" env:"METRICS_SERVER"      validate:"required"`
+	Metrics       *MetricsConfig         `json:"metrics"        yaml:"metrics"        env:"METRICS"`
 	Tracer        *gtrace.Config         `json:"tracer"         yaml:"tracer"         env:"TRACER"              validate:"required"`
 	HdfsServer    *HdfsConfig            `json:"hdfs_server"    yaml:"hdfs_server"    env:"HDFS_SERVER"         validate:"required"`
+	Health        *HealthConfig          `json:"health"         yaml:"health"         env:"HEALTH"`
+	SearchIndex   *SearchIndexConfig     `json:"search_index"   yaml:"search_index"   env:"SEARCH_INDEX"`
+	Retention     *RetentionConfig       `json:"retention"      yaml:"retention"      env:"RETENTION"`
+	Quota         *QuotaConfig           `json:"quota"          yaml:"quota"          env:"QUOTA"`
+	UsageReport   *UsageReportConfig     `json:"usage_report"   yaml:"usage_report"   env:"USAGE_REPORT"`
+	Compaction    *CompactionConfig      `json:"compaction"     yaml:"compaction"     env:"COMPACTION"`
+	Catalog       *CatalogConfig         `json:"catalog"        yaml:"catalog"        env:"CATALOG"`
+	FlinkClient   *FlinkClientConfig     `json:"flink_client"   yaml:"flink_client"   env:"FLINK_CLIENT"`
+	Auth          *AuthConfig            `json:"auth"           yaml:"auth"           env:"AUTH"`
+	Audit         *AuditConfig           `json:"audit"          yaml:"audit"          env:"AUDIT"`
+	Redaction     *RedactionConfig       `json:"redaction"      yaml:"redaction"      env:"REDACTION"`
+	Encryption    *EncryptionConfig      `json:"encryption"     yaml:"encryption"     env:"ENCRYPTION"`
+}
+
+// setDefaults fills the sections missing from the config, the features they configure are disabled.
+func setDefaults(cfg *Config) {
+	if cfg.Metrics == nil {
+		cfg.Metrics = &MetricsConfig{}
+	}
+	if cfg.Health == nil {
+		cfg.Health = &HealthConfig{ProbeInterval: 10 * time.Second, ProbeTimeout: 5 * time.Second, ReadinessPath: "/readyz"}
+	}
+	if cfg.SearchIndex == nil {
+		cfg.SearchIndex = &SearchIndexConfig{}
+	}
+	if cfg.Retention == nil {
+		cfg.Retention = &RetentionConfig{}
+	}
+	if cfg.Retention.Policy == nil {
+		cfg.Retention.Policy = &RetentionPolicy{}
+	}
+	if cfg.Quota == nil {
+		cfg.Quota = &QuotaConfig{}
+	}
+	if cfg.Quota.Default == nil {
+		cfg.Quota.Default = &StorageQuota{}
+	}
+	if cfg.UsageReport == nil {
+		cfg.UsageReport = &UsageReportConfig{RefreshInterval: 10 * time.Minute}
+	}
+	if cfg.Compaction == nil {
+		cfg.Compaction = &CompactionConfig{}
+	}
+	if cfg.Catalog == nil {
+		cfg.Catalog = &CatalogConfig{}
+	}
+	if cfg.FlinkClient == nil {
+		cfg.FlinkClient = &FlinkClientConfig{AllowedSchemes: "http,https", MaxResponseSize: 4 << 20}
+	}
+	if cfg.FlinkClient.TLS == nil {
+		cfg.FlinkClient.TLS = &FlinkTLSConfig{}
+	}
+	if cfg.Auth == nil {
+		cfg.Auth = &AuthConfig{}
+	}
+	if cfg.Audit == nil {
+		cfg.Audit = &AuditConfig{}
+	}
+	if cfg.Redaction == nil {
+		cfg.Redaction = &RedactionConfig{}
+	}
+	if cfg.Encryption == nil {
+		cfg.Encryption = &EncryptionConfig{}
+	}
 }
 
 func loadFromFile(cfg *Config) (err error) {
@@ -73,6 +304,7 @@ func Load() (cfg *Config, err error) {
 	if err = l.Load(cfg); err != nil {
 		return
 	}
+	setDefaults(cfg)
 
 	// output the config content
 	fmt.Printf("%s pid=%d the latest configuration: \n", time.Now().Format(time.RFC3339Nano), os.Getpid())
@@ -85,5 +317,115 @@ func Load() (cfg *Config, err error) {
 		return
 	}
 
+	// the segments of the search index are local files holding the tokens of the logs in plain text
+	if cfg.Encryption.Enabled && cfg.SearchIndex.Enabled {
+		err = fmt.Errorf("search_index can not be enabled with encryption, it stores the tokens of the logs unencrypted in [%s]",
+			cfg.SearchIndex.Dir)
+		return
+	}
+
+	return
+}
+
+// LoadRetentionOverrides reads the per-space retention policies from a yaml file.
+func LoadRetentionOverrides(filePath string) (overrides map[string]*RetentionPolicy, err error) {
+	if err = loadOverrides(filePath, &overrides); err != nil {
+		return
+	}
+
+	validate := validator.New()
+	for spaceID, policy := range overrides {
+		if policy == nil {
+			return nil, fmt.Errorf("empty retention policy for space [%s]", spaceID)
+		}
+		if err = validate.Struct(policy); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// LoadQuotaOverrides reads the per-space storage quotas from a yaml file.
+func LoadQuotaOverrides(filePath string) (overrides map[string]*StorageQuota, err error) {
+	if err = loadOverrides(filePath, &overrides); err != nil {
+		return
+	}
+
+	validate := validator.New()
+	for spaceID, quota := range overrides {
+		if quota == nil {
+			return nil, fmt.Errorf("empty storage quota for space [%s]", spaceID)
+		}
+		if err = validate.Struct(quota); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// LoadAuthIdentities reads the identities of the callers from a yaml file ({identity: {token, spaces}}).
+func LoadAuthIdentities(filePath string) (identities map[string]*AuthIdentity, err error) {
+	if err = loadOverrides(filePath, &identities); err != nil {
+		return
+	}
+
+	validate := validator.New()
+	for name, identity := range identities {
+		if identity == nil {
+			return nil, fmt.Errorf("empty identity [%s]", name)
+		}
+		if err = validate.Struct(identity); err != nil {
+			return
+		}
+	}
 	return
 }
+
+// LoadRedactionRules reads the extra redaction rules from a yaml file.
+func LoadRedactionRules(filePath string) (rules []*RedactionRule, err error) {
+	if err = loadOverrides(filePath, &rules); err != nil {
+		return
+	}
+
+	validate := validator.New()
+	for i, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("empty redaction rule at [%d]", i)
+		}
+		if err = validate.Struct(rule); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// LoadMasterKeys reads the master keys of the encryption from a yaml file.
+func LoadMasterKeys(filePath string) (masterKeys *MasterKeys, err error) {
+	if filePath == "" {
+		return nil, fmt.Errorf("key file is required")
+	}
+	if err = loadOverrides(filePath, &masterKeys); err != nil {
+		return
+	}
+	if masterKeys == nil {
+		return nil, fmt.Errorf("empty key file [%s]", filePath)
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(masterKeys); err != nil {
+		return
+	}
+	return
+}
+
+func loadOverrides(filePath string, out interface{}) (err error) {
+	if filePath == "" {
+		return
+	}
+
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+	return yaml.Unmarshal(b, out)
+}
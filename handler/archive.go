@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// loadArchiveIndex reads the member index of an instance archive,
+// returns an os.ErrNotExist error if the instance has not been compacted.
+func loadArchiveIndex(client *hdfs.Client, spaceID, flowID, instID string) (*internal.ArchiveIndex, error) {
+	f, err := client.Open(internal.GetHdfsArchiveIndexPath(spaceID, flowID, instID))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return internal.DecodeArchiveIndex(f)
+}
+
+// archiveMemberReader reads a member from the archive file.
+type archiveMemberReader struct {
+	*io.SectionReader
+	f *internal.HdfsReader
+}
+
+func (r *archiveMemberReader) Close() error {
+	return r.f.Close()
+}
+
+func openArchiveMember(client *hdfs.Client, archivePath string, member *internal.ArchiveMember) (logFileReader, error) {
+	file, err := client.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	f := &internal.HdfsReader{FileReader: file}
+	return &archiveMemberReader{
+		SectionReader: io.NewSectionReader(f, member.Offset, member.Size),
+		f:             f,
+	}, nil
+}
+
+// archivedLogFile returns the log file of an archive member,
+// ok is false if the member is not a JobManager or TaskManager log file.
+func archivedLogFile(spaceID, flowID, instID string, archiveIndex *internal.ArchiveIndex, member *internal.ArchiveMember) (logFile *InstanceLogFile, ok bool) {
+	logFile = archivedFile(spaceID, flowID, instID, archiveIndex, member)
+
+	logFile.ManagerName, logFile.TaskManagerID, logFile.FileName, ok = parseRelPath(member.Path)
+	if !ok {
+		return nil, false
+	}
+	return logFile, true
+}
+
+// listArchivedLogFiles returns the log files packed into the archive of an instance,
+// an instance that has neither logs dir nor archive has no log files.
+func listArchivedLogFiles(client *hdfs.Client, spaceID, flowID, instID string) ([]*InstanceLogFile, error) {
+	archiveIndex, err := loadArchiveIndex(client, spaceID, flowID, instID)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*InstanceLogFile
+	for _, member := range archiveIndex.Members {
+		if internal.IsHiddenFile(path.Base(member.Path)) {
+			continue
+		}
+		if logFile, ok := archivedLogFile(spaceID, flowID, instID, archiveIndex, member); ok {
+			result = append(result, logFile)
+		}
+	}
+	return result, nil
+}
+
+// statLogFile returns the file at filePath, looked up in the archive of its instance
+// if it is not in the logs dir, e.g. /:space_id/:flow_id/:inst_id/logs/jobmanager/:log_file.
+func statLogFile(ctx context.Context, client *hdfs.Client, filePath string) (*InstanceLogFile, error) {
+	fileInfo, err := internal.StatFile(ctx, client, filePath)
+	if err == nil {
+		return &InstanceLogFile{
+			FileName: fileInfo.Name(),
+			FilePath: filePath,
+			Size:     fileInfo.Size(),
+			ModTime:  fileInfo.ModTime(),
+		}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	spaceID, flowID, instID, relPath, ok := internal.ParseHdfsLogFilePath(filePath)
+	if !ok {
+		return nil, err
+	}
+	archiveIndex, indexErr := loadArchiveIndex(client, spaceID, flowID, instID)
+	if indexErr != nil {
+		if !os.IsNotExist(indexErr) {
+			return nil, indexErr
+		}
+		return nil, err
+	}
+	member := archiveIndex.Find(relPath)
+	if member == nil {
+		return nil, err
+	}
+	return archivedFile(spaceID, flowID, instID, archiveIndex, member), nil
+}
+
+// archivedFile returns the file of an archive member.
+func archivedFile(spaceID, flowID, instID string, archiveIndex *internal.ArchiveIndex, member *internal.ArchiveMember) *InstanceLogFile {
+	return &InstanceLogFile{
+		FileName:     path.Base(member.Path),
+		FilePath:     fmt.Sprintf("%s/%s", internal.GetHdfsLogsDirPath(spaceID, flowID, instID), member.Path),
+		Size:         member.Size,
+		ModTime:      member.ModTime,
+		archivePath:  internal.GetHdfsArchiveFilePath(spaceID, flowID, instID, archiveIndex.Archive),
+		archiveIndex: archiveIndex,
+		member:       member,
+	}
+}
+
+// statSidecar returns the sidecar (line index or key) of a log file from the same place as the file:
+// the logs dir for a loose file, the archive for an archived one. A sidecar left in the archive is stale
+// once its file is uploaded again, and a loose sidecar does not belong to an archived file.
+func statSidecar(ctx context.Context, client *hdfs.Client, f *InstanceLogFile, sidecarPath string) (*InstanceLogFile, error) {
+	if f.member == nil {
+		fileInfo, err := internal.StatFile(ctx, client, sidecarPath)
+		if err != nil {
+			return nil, err
+		}
+		return &InstanceLogFile{
+			FileName: fileInfo.Name(),
+			FilePath: sidecarPath,
+			Size:     fileInfo.Size(),
+			ModTime:  fileInfo.ModTime(),
+		}, nil
+	}
+
+	spaceID, flowID, instID, relPath, ok := internal.ParseHdfsLogFilePath(sidecarPath)
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: sidecarPath, Err: os.ErrNotExist}
+	}
+	member := f.archiveIndex.Find(relPath)
+	if member == nil {
+		return nil, &os.PathError{Op: "stat", Path: sidecarPath, Err: os.ErrNotExist}
+	}
+	return archivedFile(spaceID, flowID, instID, f.archiveIndex, member), nil
+}
+
+// mergeLogFiles returns the loose files and the archived files that have not been uploaded again since
+// the instance was compacted, a loose file replaces the archived file with the same path.
+func mergeLogFiles(loose, archived []*InstanceLogFile) []*InstanceLogFile {
+	looseFiles := make(map[string]bool, len(loose))
+	for _, logFile := range loose {
+		looseFiles[logFile.RelPath()] = true
+	}
+	merged := loose
+	for _, logFile := range archived {
+		if !looseFiles[logFile.RelPath()] {
+			merged = append(merged, logFile)
+		}
+	}
+	return merged
+}
+
+// readArchivedDir lists a dir under the logs dir of a compacted instance, like StatFilesInDir does for a loose one.
+// It returns an os.ErrNotExist error if the instance has no archive or the archive has no such dir.
+func readArchivedDir(client *hdfs.Client, dirPath string) ([]os.FileInfo, error) {
+	spaceID, flowID, instID, relDir, ok := internal.ParseHdfsLogFilePath(strings.TrimSuffix(dirPath, "/"))
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Path: dirPath, Err: os.ErrNotExist}
+	}
+	archiveIndex, err := loadArchiveIndex(client, spaceID, flowID, instID)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*relFile, 0, len(archiveIndex.Members))
+	for _, member := range archiveIndex.Members {
+		files = append(files, &relFile{path: member.Path, size: member.Size, modTime: member.ModTime})
+	}
+	fileInfos := readRelDir(relDir, files)
+	if len(fileInfos) == 0 {
+		return nil, &os.PathError{Op: "readdir", Path: dirPath, Err: os.ErrNotExist}
+	}
+	return fileInfos, nil
+}
+
+// mergeDirInfos returns the loose entries of a dir and the archived ones not in it, a loose entry wins by name.
+func mergeDirInfos(loose, archived []os.FileInfo) []os.FileInfo {
+	names := make(map[string]bool, len(loose))
+	for _, fileInfo := range loose {
+		names[fileInfo.Name()] = true
+	}
+	merged := loose
+	for _, fileInfo := range archived {
+		if !names[fileInfo.Name()] {
+			merged = append(merged, fileInfo)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	auditBufferSize = 4096
+	auditBatchSize  = 512
+	// the events of failed writes are retried at each flush, the oldest ones are dropped beyond it
+	maxPendingAuditEvents = 100000
+)
+
+// AuditFilter selects the audit events returned by QueryAuditEvents, empty fields match all events.
+type AuditFilter struct {
+	Identity   string
+	Method     string
+	SpaceID    string
+	FlowID     string
+	InstanceID string
+	// unix milliseconds, 0 means no limit
+	StartTime int64
+	EndTime   int64
+}
+
+func (f *AuditFilter) match(event *internal.AuditEvent) bool {
+	if (f.Identity != "" && event.Identity != f.Identity) ||
+		(f.Method != "" && event.Method != f.Method) ||
+		(f.SpaceID != "" && event.SpaceID != f.SpaceID) ||
+		(f.FlowID != "" && event.FlowID != f.FlowID) ||
+		(f.InstanceID != "" && event.InstanceID != f.InstanceID) {
+		return false
+	}
+	eventTime := internal.UnixMilli(event.Time)
+	return f.EndTime == 0 || eventTime < f.EndTime
+}
+
+// auditCall is the audit event of a call in flight, it's recorded once the call and the work
+// it continues in the background are done.
+type auditCall struct {
+	mu      sync.Mutex
+	event   *internal.AuditEvent
+	pending int
+}
+
+type auditCallKey struct{}
+
+// WithAuditEvent returns a ctx carrying the event of a call, FinishAuditEvent must be called with it
+// once the call returns.
+func WithAuditEvent(ctx context.Context, event *internal.AuditEvent) context.Context {
+	return context.WithValue(ctx, auditCallKey{}, &auditCall{event: event, pending: 1})
+}
+
+// FinishAuditEvent records the event of the call of ctx, unless the call left work in the background,
+// the event is recorded once it's done then.
+func FinishAuditEvent(ctx context.Context) {
+	if c, ok := ctx.Value(auditCallKey{}).(*auditCall); ok {
+		c.done(0)
+	}
+}
+
+// holdAuditEvent delays the event of the call of ctx until the returned func is called
+// with the bytes of log data stored meanwhile.
+func holdAuditEvent(ctx context.Context) func(bytes int64) {
+	c, ok := ctx.Value(auditCallKey{}).(*auditCall)
+	if !ok {
+		return func(int64) {}
+	}
+	c.mu.Lock()
+	c.pending++
+	c.mu.Unlock()
+	return c.done
+}
+
+func (c *auditCall) done(bytes int64) {
+	c.mu.Lock()
+	c.event.Bytes += bytes
+	c.pending--
+	record := c.pending == 0
+	c.mu.Unlock()
+	if record {
+		RecordAuditEvent(c.event)
+	}
+}
+
+// RecordAuditEvent queues the event to be written by RunAuditWriter, it's a no-op if the audit is disabled.
+// The caller waits if the queue is full so that no event is lost.
+func RecordAuditEvent(event *internal.AuditEvent) {
+	if auditEvents == nil {
+		return
+	}
+	auditEvents <- event
+}
+
+// RunAuditWriter writes the queued audit events to the sink every flushInterval until ctx is done,
+// the events queued by then are written before it returns.
+func RunAuditWriter(ctx context.Context, flushInterval time.Duration) {
+	logger := glog.FromContext(ctx)
+	logger.Info().Msg(fmt.Sprintf("audit writer started, flush interval [%s]", flushInterval)).Fire()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var pending []*internal.AuditEvent
+	failing := false
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		// ctx is already done when the last events are written
+		if err := auditSink.Write(context.Background(), pending); err != nil {
+			failing = true
+			auditWriteErrors.Inc()
+			logger.Error().Msg(fmt.Sprintf("write [%d] audit events failed, %s", len(pending), err.Error())).Fire()
+			if dropped := len(pending) - maxPendingAuditEvents; dropped > 0 {
+				auditDroppedEvents.Add(float64(dropped))
+				logger.Error().Msg(fmt.Sprintf("[%d] audit events dropped", dropped)).Fire()
+				pending = pending[dropped:]
+			}
+			return
+		}
+		failing = false
+		auditWrittenEvents.Add(float64(len(pending)))
+		pending = nil
+	}
+
+	for {
+		select {
+		case event := <-auditEvents:
+			pending = append(pending, event)
+			// a failing sink is only retried at the flush interval
+			if len(pending) >= auditBatchSize && !failing {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for drained := false; !drained; {
+				select {
+				case event := <-auditEvents:
+					pending = append(pending, event)
+				default:
+					drained = true
+				}
+			}
+			flush()
+			logger.Info().Msg("audit writer stopped").Fire()
+			return
+		}
+	}
+}
+
+// QueryAuditEvents returns the most recent audit events matching the filter, the newest first.
+// The events still queued to be written are not returned.
+func QueryAuditEvents(ctx context.Context, filter *AuditFilter, limit int32) (*logpb.QueryAuditEventsReply, error) {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to query audit events of [%s] in [%s/%s/%s]",
+		filter.Identity, filter.SpaceID, filter.FlowID, filter.InstanceID)).Fire()
+	if auditSink == nil {
+		return nil, status.Error(codes.FailedPrecondition, "audit is disabled")
+	}
+	if filter.EndTime != 0 && filter.EndTime < filter.StartTime {
+		return nil, status.Error(codes.InvalidArgument, "end time is before start time")
+	}
+
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	} else if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	var since time.Time
+	if filter.StartTime > 0 {
+		since = time.Unix(0, filter.StartTime*int64(time.Millisecond))
+	}
+	var matched []*internal.AuditEvent
+	err := auditSink.Read(ctx, since, func(event *internal.AuditEvent) bool {
+		if !filter.match(event) {
+			return true
+		}
+		if len(matched) == int(limit) {
+			matched = matched[1:]
+		}
+		matched = append(matched, event)
+		return true
+	})
+	if err != nil {
+		logger.Error().Error("read audit events failed", err).Fire()
+		return nil, err
+	}
+
+	reply := &logpb.QueryAuditEventsReply{Events: make([]*logpb.AuditEvent, 0, len(matched))}
+	for i := len(matched) - 1; i >= 0; i-- {
+		event := matched[i]
+		reply.Events = append(reply.Events, &logpb.AuditEvent{
+			Time:          internal.UnixMilli(event.Time),
+			Identity:      event.Identity,
+			Peer:          event.Peer,
+			Method:        event.Method,
+			SpaceId:       event.SpaceID,
+			FlowId:        event.FlowID,
+			InstanceId:    event.InstanceID,
+			TaskManagerId: event.TaskManagerID,
+			FileName:      event.FileName,
+			Bytes:         event.Bytes,
+			Code:          event.Code,
+			Error:         event.Error,
+		})
+	}
+	return reply, nil
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// formats of the bulk download
+	bulkFormatZip   = "zip"
+	bulkFormatTarGz = "tar.gz"
+
+	// size of the chunks sent to the stream
+	bulkChunkSize = 64 * 1024
+)
+
+// streamWriter sends the data written to it as chunks of the bulk download stream.
+type streamWriter struct {
+	stream logpb.LogManager_DownloadInstanceLogsServer
+	// bytes sent
+	n int64
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&logpb.DownloadInstanceLogsReply{Data: p}); err != nil {
+		return 0, err
+	}
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// DownloadInstanceLogs streams the JobManager and TaskManager log files of an instance packaged as zip or tar.gz,
+// the files are stored as jobmanager/:log_file and taskmanager/:taskManager_id/:log_file.
+// The package is built on the fly, nothing is staged on local disk.
+func DownloadInstanceLogs(ctx context.Context, spaceID, flowID, instID, format string, stream logpb.LogManager_DownloadInstanceLogsServer) (err error) {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to download logs of instance [%s/%s/%s] as [%s]", spaceID, flowID, instID, format)).Fire()
+	if format == "" {
+		format = bulkFormatZip
+	}
+	if format != bulkFormatZip && format != bulkFormatTarGz {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("unsupported format [%s]", format))
+	}
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return
+	}
+
+	defer hdfsClient.Close()
+	logFiles, err := listInstanceLogFiles(ctx, hdfsClient, spaceID, flowID, instID)
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("list log files of instance [%s/%s/%s] failed, %s", spaceID, flowID, instID, err.Error())).Fire()
+		return
+	}
+	if len(logFiles) == 0 {
+		return status.Error(codes.NotFound, fmt.Sprintf("no log files found for instance [%s/%s/%s]", spaceID, flowID, instID))
+	}
+
+	sw := &streamWriter{stream: stream}
+	startTime := time.Now()
+	defer func() {
+		observeDownload(spaceID, downloadRPCInstance, sw.n, startTime, err)
+	}()
+
+	bufWriter := bufio.NewWriterSize(sw, bulkChunkSize)
+	if format == bulkFormatZip {
+		err = writeZip(ctx, hdfsClient, bufWriter, logFiles)
+	} else {
+		err = writeTarGz(ctx, hdfsClient, bufWriter, logFiles)
+	}
+	if err == nil {
+		err = bufWriter.Flush()
+	}
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("download logs of instance [%s/%s/%s] failed, %s", spaceID, flowID, instID, err.Error())).Fire()
+		return
+	}
+
+	logger.Info().Msg(fmt.Sprintf("download [%d] log files of instance [%s/%s/%s] completed", len(logFiles), spaceID, flowID, instID)).Fire()
+	return
+}
+
+func writeZip(ctx context.Context, client *hdfs.Client, w io.Writer, logFiles []*InstanceLogFile) error {
+	zw := zip.NewWriter(w)
+	for _, logFile := range logFiles {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     logFile.RelPath(),
+			Method:   zip.Deflate,
+			Modified: logFile.ModTime,
+		})
+		if err != nil {
+			return err
+		}
+		if err = copyLogFile(ctx, client, fw, logFile); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGz(ctx context.Context, client *hdfs.Client, w io.Writer, logFiles []*InstanceLogFile) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, logFile := range logFiles {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     logFile.RelPath(),
+			Size:     logFile.Size,
+			Mode:     0644,
+			ModTime:  logFile.ModTime,
+		})
+		if err != nil {
+			return err
+		}
+		if err = copyLogFile(ctx, client, tw, logFile); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyLogFile writes the first logFile.Size bytes of the file,
+// the size in the tar header must match even if the file grows meanwhile.
+func copyLogFile(ctx context.Context, client *hdfs.Client, w io.Writer, logFile *InstanceLogFile) error {
+	reader, err := openLogFile(ctx, client, logFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	_, err = io.CopyN(w, reader, logFile.Size)
+	return err
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// readCatalogDir lists a dir under the logs dir of an instance from the catalog,
+// ok is false if the catalog is disabled or can't list the instance, see catalogList.
+func readCatalogDir(ctx context.Context, client *hdfs.Client, dirPath string) (fileInfos []os.FileInfo, ok bool, err error) {
+	spaceID, flowID, instID, relDir, isLogPath := internal.ParseHdfsLogFilePath(strings.TrimSuffix(dirPath, "/"))
+	if !isLogPath {
+		return nil, false, nil
+	}
+	entries, ok := catalogList(ctx, client, spaceID, flowID, instID)
+	if !ok {
+		return nil, false, nil
+	}
+
+	files := make([]*relFile, 0, len(entries))
+	for _, e := range entries {
+		files = append(files, &relFile{path: e.Path, size: e.Size, modTime: e.ModTime})
+	}
+	fileInfos = readRelDir(relDir, files)
+	if len(fileInfos) == 0 {
+		return nil, true, &os.PathError{Op: "readdir", Path: dirPath, Err: os.ErrNotExist}
+	}
+	return fileInfos, true, nil
+}
+
+// catalogList returns the entries of an instance from the catalog, ok is false if the catalog is disabled
+// or the instance has no manifest. The entries are listed again from HDFS if the manifest changed since they
+// were listed, i.e. the instance was collected again, possibly by another replica. The manifest is checked
+// rather than the logs dir, whose mtime only changes with its direct children.
+func catalogList(ctx context.Context, client *hdfs.Client, spaceID, flowID, instID string) ([]*internal.CatalogEntry, bool) {
+	if catalog == nil {
+		return nil, false
+	}
+	logger := glog.FromContext(ctx)
+	// an instance deleted or swept by another replica has no manifest anymore
+	manifestInfo, err := internal.StatFile(ctx, client, internal.GetHdfsManifestPath(spaceID, flowID, instID))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn().Msg(fmt.Sprintf("stat manifest of [%s/%s/%s] failed, %s", spaceID, flowID, instID, err.Error())).Fire()
+		}
+		return nil, false
+	}
+	entries, manifestModTime, ok := catalog.List(spaceID, flowID, instID)
+	if ok && manifestModTime.Equal(manifestInfo.ModTime()) {
+		return entries, true
+	}
+
+	instDir := &instanceDir{SpaceID: spaceID, FlowID: flowID, InstanceID: instID}
+	entries, err = catalogEntriesOfInstance(ctx, client, instDir)
+	if err != nil {
+		logger.Warn().Msg(fmt.Sprintf("list files of [%s/%s/%s] failed, %s", spaceID, flowID, instID, err.Error())).Fire()
+		return nil, false
+	}
+	stamp := &internal.CatalogStamp{SpaceID: spaceID, FlowID: flowID, InstanceID: instID, ManifestModTime: manifestInfo.ModTime()}
+	if err = catalog.ReplaceInstance(stamp, entries); err != nil {
+		logger.Warn().Msg(fmt.Sprintf("update catalog of [%s/%s/%s] failed, %s", spaceID, flowID, instID, err.Error())).Fire()
+	}
+	return entries, true
+}
+
+// catalogPut records a file saved into HDFS.
+func catalogPut(ctx context.Context, destFullPath string, size int64, checksum string) {
+	if catalog == nil {
+		return
+	}
+	spaceID, flowID, instID, relPath, ok := internal.ParseHdfsLogFilePath(destFullPath)
+	if !ok {
+		return
+	}
+	err := catalog.Put(&internal.CatalogEntry{
+		SpaceID:    spaceID,
+		FlowID:     flowID,
+		InstanceID: instID,
+		Path:       relPath,
+		Size:       size,
+		ModTime:    time.Now(),
+		Checksum:   checksum,
+	})
+	if err != nil {
+		glog.FromContext(ctx).Warn().Msg(fmt.Sprintf("add [%s] to catalog failed, %s", destFullPath, err.Error())).Fire()
+	}
+}
+
+// catalogDelete removes the files of an instance, a flow or a space from the catalog.
+func catalogDelete(ctx context.Context, ids ...string) {
+	if catalog == nil {
+		return
+	}
+	if err := catalog.Delete(ids...); err != nil {
+		glog.FromContext(ctx).Warn().Msg(fmt.Sprintf("remove [%s] from catalog failed, %s", strings.Join(ids, "/"), err.Error())).Fire()
+	}
+}
+
+// ReconcileCatalog rebuilds the catalog from the files in HDFS, the checksums are taken from the instance manifests.
+func ReconcileCatalog(ctx context.Context) (fileCount int, err error) {
+	if catalog == nil {
+		return 0, fmt.Errorf("catalog is disabled")
+	}
+	logger := glog.FromContext(ctx)
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return
+	}
+
+	defer hdfsClient.Close()
+	spaceInfos, err := internal.StatFilesInDir(ctx, hdfsClient, "/")
+	if err != nil {
+		logger.Error().Error("failed to list spaces", err).Fire()
+		return
+	}
+
+	var entries []*internal.CatalogEntry
+	var stamps []*internal.CatalogStamp
+	for _, spaceInfo := range spaceInfos {
+		if !spaceInfo.IsDir() || internal.IsHiddenFile(spaceInfo.Name()) {
+			continue
+		}
+		instDirs, err := listInstanceDirs(ctx, hdfsClient, spaceInfo.Name(), "")
+		if err != nil {
+			logger.Error().Msg(fmt.Sprintf("list instances of space [%s] failed, %s", spaceInfo.Name(), err.Error())).Fire()
+			return 0, err
+		}
+		for _, instDir := range instDirs {
+			if err = ctx.Err(); err != nil {
+				return 0, err
+			}
+			// the manifest is stat before the listing, a collection finishing meanwhile is listed again on read
+			manifestInfo, err := internal.StatFile(ctx, hdfsClient,
+				internal.GetHdfsManifestPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID))
+			if err != nil && !os.IsNotExist(err) {
+				logger.Error().Msg(fmt.Sprintf("stat manifest of instance [%s/%s/%s] failed, %s",
+					instDir.SpaceID, instDir.FlowID, instDir.InstanceID, err.Error())).Fire()
+				return 0, err
+			}
+			instEntries, err := catalogEntriesOfInstance(ctx, hdfsClient, instDir)
+			if err != nil {
+				logger.Error().Msg(fmt.Sprintf("list files of instance [%s/%s/%s] failed, %s",
+					instDir.SpaceID, instDir.FlowID, instDir.InstanceID, err.Error())).Fire()
+				return 0, err
+			}
+			entries = append(entries, instEntries...)
+			if manifestInfo != nil {
+				stamps = append(stamps, &internal.CatalogStamp{SpaceID: instDir.SpaceID, FlowID: instDir.FlowID,
+					InstanceID: instDir.InstanceID, ManifestModTime: manifestInfo.ModTime()})
+			}
+		}
+	}
+
+	if err = catalog.Replace(entries, stamps); err != nil {
+		logger.Error().Error("failed to rewrite catalog", err).Fire()
+		return
+	}
+	logger.Info().Msg(fmt.Sprintf("catalog reconciled, [%d] files", len(entries))).Fire()
+	return len(entries), nil
+}
+
+func catalogEntriesOfInstance(ctx context.Context, client *hdfs.Client, instDir *instanceDir) ([]*internal.CatalogEntry, error) {
+	logFiles, err := listInstanceLogFiles(ctx, client, instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	// a checksum is only kept if the file has not changed since it was collected
+	checksums := make(map[string]string)
+	if m, err := readManifest(client, instDir.SpaceID, instDir.FlowID, instDir.InstanceID); err == nil {
+		for _, file := range m.Files {
+			checksums[fmt.Sprintf("%s:%d", file.Path, file.Size)] = file.Checksum
+		}
+	}
+
+	entries := make([]*internal.CatalogEntry, 0, len(logFiles))
+	for _, logFile := range logFiles {
+		entries = append(entries, &internal.CatalogEntry{
+			SpaceID:    instDir.SpaceID,
+			FlowID:     instDir.FlowID,
+			InstanceID: instDir.InstanceID,
+			Path:       logFile.RelPath(),
+			Size:       logFile.Size,
+			ModTime:    logFile.ModTime,
+			Checksum:   checksums[fmt.Sprintf("%s:%d", logFile.RelPath(), logFile.Size)],
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/logmanager/config"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// RunCompactor packs the logs dir of the instances older than cfg.MinAge into a single archive
+// every cfg.Interval until ctx is done, to reduce the number of files stored by the NameNode.
+func RunCompactor(ctx context.Context, cfg *config.CompactionConfig) {
+	logger := glog.FromContext(ctx)
+	logger.Info().Msg(fmt.Sprintf("compactor started, interval [%s] min age [%s]", cfg.Interval, cfg.MinAge)).Fire()
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		compactInstances(ctx, cfg)
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("compactor stopped").Fire()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func compactInstances(ctx context.Context, cfg *config.CompactionConfig) {
+	logger := glog.FromContext(ctx)
+	startTime := time.Now()
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		compactionErrors.Inc()
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return
+	}
+
+	defer hdfsClient.Close()
+	spaceInfos, err := internal.StatFilesInDir(ctx, hdfsClient, "/")
+	if err != nil {
+		compactionErrors.Inc()
+		logger.Error().Error("failed to list spaces", err).Fire()
+		return
+	}
+
+	var compactedCount int
+	for _, spaceInfo := range spaceInfos {
+		if !spaceInfo.IsDir() || internal.IsHiddenFile(spaceInfo.Name()) {
+			continue
+		}
+		instDirs, err := listInstanceDirs(ctx, hdfsClient, spaceInfo.Name(), "")
+		if err != nil {
+			compactionErrors.Inc()
+			logger.Error().Msg(fmt.Sprintf("list instances of space [%s] failed, %s", spaceInfo.Name(), err.Error())).Fire()
+			continue
+		}
+
+		for _, instDir := range instDirs {
+			if ctx.Err() != nil {
+				return
+			}
+			if startTime.Sub(instDir.ModTime) < cfg.MinAge {
+				continue
+			}
+			compacted, err := compactInstance(ctx, hdfsClient, instDir, startTime.Add(-cfg.MinAge))
+			if err != nil {
+				compactionErrors.Inc()
+				continue
+			}
+			if compacted {
+				compactedCount++
+			}
+		}
+	}
+
+	logger.Info().Msg(fmt.Sprintf("compaction finished in [%s], compacted [%d] instances",
+		time.Since(startTime), compactedCount)).Fire()
+}
+
+// compactInstance packs the logs dir of an instance into an archive and writes the index of its members,
+// the logs dir is removed once both are written unless it changed meanwhile. The instance is skipped if it has
+// no logs dir, if a file was modified after modifiedBefore or if an upload into it is in progress.
+func compactInstance(ctx context.Context, client *hdfs.Client, instDir *instanceDir, modifiedBefore time.Time) (compacted bool, err error) {
+	logger := glog.FromContext(ctx)
+	instDirPath := internal.GetHdfsInstanceDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	logsDirPath := internal.GetHdfsLogsDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	if uploads.busy(instDirPath) {
+		return false, nil
+	}
+	unlock := lockDir(instDirPath, true)
+	defer unlock()
+
+	walked, err := walkLogsDir(client, logsDirPath, modifiedBefore)
+	if os.IsNotExist(err) || err == errStopScan {
+		return false, nil
+	}
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("walk logs dir [%s] failed, %s", logsDirPath, err.Error())).Fire()
+		return false, err
+	}
+	sources := walked
+	if len(sources) == 0 {
+		return false, nil
+	}
+
+	// logs uploaded again into a compacted instance are merged with the existing archive
+	if sources, err = appendArchivedSources(client, instDir, sources); err != nil {
+		logger.Error().Msg(fmt.Sprintf("read archive index of [%s] failed, %s", instDirPath, err.Error())).Fire()
+		return false, err
+	}
+
+	// the logs dir is read until it's removed, so a failure at any step leaves the instance readable
+	archiveName, err := rewriteArchive(ctx, client, instDir, sources)
+	if err != nil {
+		return false, err
+	}
+
+	// the uploads of this process wait for the lock, but another replica may have written into the logs dir
+	// meanwhile. Keep it if anything changed, it's read instead of the archive and merged into the archive
+	// by the next compaction.
+	current, err := walkLogsDir(client, logsDirPath, modifiedBefore)
+	if err != nil && err != errStopScan {
+		logger.Error().Msg(fmt.Sprintf("walk logs dir [%s] again failed, %s", logsDirPath, err.Error())).Fire()
+		return false, err
+	}
+	if err == errStopScan || !sameArchiveSources(walked, current) {
+		logger.Info().Msg(fmt.Sprintf("logs dir [%s] changed during compaction, keep it", logsDirPath)).Fire()
+		return false, nil
+	}
+	if err = internal.RemoveDir(ctx, client, logsDirPath); err != nil {
+		logger.Error().Msg(fmt.Sprintf("remove logs dir [%s] failed, %s", logsDirPath, err.Error())).Fire()
+		return false, err
+	}
+
+	// creating the archive touched the instance dir, its mtime is the instance time used by listings and retention
+	if err = client.Chtimes(instDirPath, time.Now(), instDir.ModTime); err != nil {
+		logger.Warn().Msg(fmt.Sprintf("restore mtime of [%s] failed, %s", instDirPath, err.Error())).Fire()
+	}
+	usages.invalidate(instDirPath)
+
+	compactedInstances.Inc()
+	compactedFiles.Add(float64(len(sources)))
+	logger.Info().Msg(fmt.Sprintf("compacted [%d] files of [%s] into [%s]", len(sources), instDirPath,
+		internal.GetHdfsArchiveFilePath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID, archiveName))).Fire()
+	return true, nil
+}
+
+// walkLogsDir returns the files of the logs dir of an instance to archive,
+// errStopScan is returned if a file was modified after modifiedBefore.
+func walkLogsDir(client *hdfs.Client, logsDirPath string, modifiedBefore time.Time) ([]*internal.ArchiveSource, error) {
+	var sources []*internal.ArchiveSource
+	err := client.Walk(logsDirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if info.ModTime().After(modifiedBefore) {
+			return errStopScan
+		}
+		sources = append(sources, &internal.ArchiveSource{
+			Path:    strings.TrimPrefix(filePath, logsDirPath+"/"),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Open: func() (io.ReadCloser, error) {
+				return client.Open(filePath)
+			},
+		})
+		return nil
+	})
+	return sources, err
+}
+
+// sameArchiveSources reports whether two walks of a logs dir found the same files with the same size and mtime.
+func sameArchiveSources(a, b []*internal.ArchiveSource) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	files := make(map[string]*internal.ArchiveSource, len(a))
+	for _, src := range a {
+		files[src.Path] = src
+	}
+	for _, src := range b {
+		prev, ok := files[src.Path]
+		if !ok || prev.Size != src.Size || !prev.ModTime.Equal(src.ModTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendArchivedSources adds the members of the existing archive of an instance that are not in sources.
+func appendArchivedSources(client *hdfs.Client, instDir *instanceDir, sources []*internal.ArchiveSource) ([]*internal.ArchiveSource, error) {
+	archiveIndex, err := loadArchiveIndex(client, instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	if os.IsNotExist(err) {
+		return sources, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	archivePath := internal.GetHdfsArchiveFilePath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID, archiveIndex.Archive)
+	return internal.MergeArchiveSources(sources, archiveIndex, func(member *internal.ArchiveMember) (io.ReadCloser, error) {
+		return openArchiveMember(client, archivePath, member)
+	}), nil
+}
+
+// rewriteArchive writes the sources into a new archive of an instance and returns its name.
+// The index naming the new archive is written to a temporary file and renamed over the index last,
+// so readers see either the previous archive and index or the new ones, and the previous archive
+// is kept if a step fails. The previous archive is removed once the new index is in place.
+func rewriteArchive(ctx context.Context, client *hdfs.Client, instDir *instanceDir, sources []*internal.ArchiveSource) (string, error) {
+	logger := glog.FromContext(ctx)
+	instDirPath := internal.GetHdfsInstanceDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	indexPath := internal.GetHdfsArchiveIndexPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	tmpIndexPath := indexPath + ".tmp"
+
+	var prevArchiveName string
+	if prevIndex, err := loadArchiveIndex(client, instDir.SpaceID, instDir.FlowID, instDir.InstanceID); err == nil {
+		prevArchiveName = prevIndex.Archive
+	} else if !os.IsNotExist(err) {
+		logger.Error().Msg(fmt.Sprintf("read archive index of [%s] failed, %s", instDirPath, err.Error())).Fire()
+		return "", err
+	}
+
+	archiveName := internal.NewArchiveName(time.Now())
+	archivePath := internal.GetHdfsArchiveFilePath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID, archiveName)
+	archiveIndex, err := writeArchive(client, archivePath, sources)
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("write archive of [%s] failed, %s", instDirPath, err.Error())).Fire()
+		_ = internal.RemoveFile(ctx, client, archivePath)
+		return "", err
+	}
+	archiveIndex.Archive = archiveName
+	if err = writeArchiveIndex(client, tmpIndexPath, archiveIndex); err != nil {
+		logger.Error().Msg(fmt.Sprintf("write archive index of [%s] failed, %s", instDirPath, err.Error())).Fire()
+		_ = internal.RemoveFile(ctx, client, tmpIndexPath)
+		_ = internal.RemoveFile(ctx, client, archivePath)
+		return "", err
+	}
+	if err = internal.RenameFile(ctx, client, tmpIndexPath, indexPath); err != nil {
+		logger.Error().Msg(fmt.Sprintf("rename archive index of [%s] failed, %s", instDirPath, err.Error())).Fire()
+		_ = internal.RemoveFile(ctx, client, tmpIndexPath)
+		_ = internal.RemoveFile(ctx, client, archivePath)
+		return "", err
+	}
+
+	if prevArchiveName != "" && prevArchiveName != archiveName {
+		prevArchivePath := internal.GetHdfsArchiveFilePath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID, prevArchiveName)
+		if err = internal.RemoveFile(ctx, client, prevArchivePath); err != nil && !os.IsNotExist(err) {
+			logger.Warn().Msg(fmt.Sprintf("remove previous archive [%s] failed, %s", prevArchivePath, err.Error())).Fire()
+		}
+	}
+	return archiveName, nil
+}
+
+func writeArchive(client *hdfs.Client, archivePath string, sources []*internal.ArchiveSource) (*internal.ArchiveIndex, error) {
+	if err := client.Remove(archivePath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	writer, err := client.Create(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	archiveIndex, err := internal.WriteArchive(writer, sources)
+	if err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return archiveIndex, nil
+}
+
+func writeArchiveIndex(client *hdfs.Client, indexPath string, archiveIndex *internal.ArchiveIndex) error {
+	if err := client.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	writer, err := client.Create(indexPath)
+	if err != nil {
+		return err
+	}
+	if err = archiveIndex.Encode(writer); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DeleteInstanceLogs removes the logs of an instance.
+func DeleteInstanceLogs(ctx context.Context, spaceID, flowID, instID string) (*logpb.DeleteLogsReply, error) {
+	return deleteLogs(ctx, internal.GetHdfsInstanceDirPath(spaceID, flowID, instID), spaceID, flowID, instID)
+}
+
+// DeleteFlowLogs removes the logs of all instances of a flow.
+func DeleteFlowLogs(ctx context.Context, spaceID, flowID string) (*logpb.DeleteLogsReply, error) {
+	return deleteLogs(ctx, internal.GetHdfsFlowDirPath(spaceID, flowID), spaceID, flowID)
+}
+
+// DeleteSpaceLogs removes the logs of all flows of a space.
+func DeleteSpaceLogs(ctx context.Context, spaceID string) (*logpb.DeleteLogsReply, error) {
+	return deleteLogs(ctx, internal.GetHdfsSpaceDirPath(spaceID), spaceID)
+}
+
+// deleteLogs removes dirPath built from ids, the uploads in progress under it are canceled first
+// and the uploads started since wait until it's removed.
+func deleteLogs(ctx context.Context, dirPath string, ids ...string) (*logpb.DeleteLogsReply, error) {
+	// refuse anything that would resolve to a dir other than /:space_id[/:flow_id[/:inst_id]]
+	for _, id := range ids {
+		if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid id [%s]", id))
+		}
+	}
+	if path.Clean(dirPath) != dirPath || strings.Count(dirPath, "/") != len(ids) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid dir [%s]", dirPath))
+	}
+
+	logger := glog.FromContext(ctx)
+	logger.Info().Msg(fmt.Sprintf("try to delete logs in [%s]", dirPath)).Fire()
+	canceled, err := uploads.cancel(dirPath)
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("cancel uploads in [%s] failed, %s", dirPath, err.Error())).Fire()
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if canceled > 0 {
+		logger.Info().Msg(fmt.Sprintf("canceled [%d] uploads in [%s]", canceled, dirPath)).Fire()
+	}
+	unlock := lockDir(dirPath, true)
+	defer unlock()
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return nil, err
+	}
+
+	defer hdfsClient.Close()
+	reply := &logpb.DeleteLogsReply{CanceledUploads: int32(canceled)}
+
+	size, fileCount, err := internal.StatDirUsage(ctx, hdfsClient, dirPath)
+	if os.IsNotExist(err) {
+		logger.Info().Msg(fmt.Sprintf("[%s] not exists, nothing to delete", dirPath)).Fire()
+		return reply, nil
+	}
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("stat dir [%s] failed, %s", dirPath, err.Error())).Fire()
+		return nil, err
+	}
+
+	if err = internal.RemoveDir(ctx, hdfsClient, dirPath); err != nil {
+		logger.Error().Msg(fmt.Sprintf("remove dir [%s] failed, %s", dirPath, err.Error())).Fire()
+		return nil, err
+	}
+	usages.invalidate(dirPath)
+	catalogDelete(ctx, ids...)
+
+	if searchIndex != nil {
+		ids = append(ids, "", "")
+		if err = searchIndex.Remove(ids[0], ids[1], ids[2]); err != nil {
+			logger.Warn().Msg(fmt.Sprintf("remove index segments of [%s] failed, %s", dirPath, err.Error())).Fire()
+		}
+	}
+
+	reply.RemovedFiles = int64(fileCount)
+	reply.RemovedBytes = size
+	logger.Info().Msg(fmt.Sprintf("deleted [%d] files [%d] bytes in [%s]", fileCount, size, dirPath)).Fire()
+	return reply, nil
+}
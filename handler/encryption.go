@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// loadFileKey reads the key of an encrypted log file, from the archive of its instance if the file is archived.
+// It returns an os.ErrNotExist error if the file is not encrypted.
+func loadFileKey(ctx context.Context, client *hdfs.Client, f *InstanceLogFile) (*internal.FileKey, error) {
+	keyFile, err := statSidecar(ctx, client, f, internal.FileKeyPath(f.FilePath))
+	if err != nil {
+		return nil, err
+	}
+	reader, err := openStoredFile(ctx, client, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	return internal.DecodeFileKey(reader)
+}
+
+// saveFileKey writes the key as sidecar of the log file.
+func saveFileKey(client *hdfs.Client, filePath string, fileKey *internal.FileKey) error {
+	return writeFileKey(client, internal.FileKeyPath(filePath), fileKey)
+}
+
+// writeFileKey writes a key file, an existing key is only replaced once the new one is written.
+func writeFileKey(client *hdfs.Client, keyPath string, fileKey *internal.FileKey) (err error) {
+	var buf bytes.Buffer
+	if err = fileKey.Encode(&buf); err != nil {
+		return
+	}
+
+	tmpKeyPath := keyPath + ".tmp"
+	err = client.Remove(tmpKeyPath)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	writer, err := client.Create(tmpKeyPath)
+	if err != nil {
+		return
+	}
+	if _, err = writer.Write(buf.Bytes()); err != nil {
+		_ = writer.Close()
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	return client.Rename(tmpKeyPath, keyPath)
+}
+
+// removeFileKey removes the key of a log file saved again without encryption.
+func removeFileKey(client *hdfs.Client, filePath string) error {
+	err := client.Remove(internal.FileKeyPath(filePath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// encryptLogFile writes a new key for the log file and returns a writer encrypting its content into w,
+// the key is written first so that an encrypted file never exists without its key.
+// sealLogFile must be called once the content is written, the file can not be read until then.
+func encryptLogFile(client *hdfs.Client, filePath string, w io.Writer) (*internal.EncryptWriter, *internal.FileKey, error) {
+	fileKey, dataKey, err := internal.NewFileKey(keyProvider)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = saveFileKey(client, filePath, fileKey); err != nil {
+		return nil, nil, err
+	}
+	encryptWriter, err := internal.NewEncryptWriter(w, fileKey, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encryptWriter, fileKey, nil
+}
+
+// sealLogFile writes the key of an encrypted log file again with the MACs of its content.
+func sealLogFile(client *hdfs.Client, filePath string, encryptWriter *internal.EncryptWriter, fileKey *internal.FileKey) error {
+	encryptWriter.Seal(fileKey)
+	return saveFileKey(client, filePath, fileKey)
+}
+
+type decryptedLogFile struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+// decryptLogFile returns a reader of the plain content of an encrypted log file, reader is closed with it.
+func decryptLogFile(reader logFileReader, fileKey *internal.FileKey) (logFileReader, error) {
+	if keyProvider == nil {
+		return nil, fmt.Errorf("file is encrypted with master key [%s] but no key file is configured", fileKey.KeyID)
+	}
+	dataKey, err := fileKey.DataKey(keyProvider)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := internal.NewDecryptReader(reader, fileKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptedLogFile{ReadSeeker: decrypted, Closer: reader}, nil
+}
+
+// RewrapFileKeys wraps the data keys of all the encrypted files with the current master key,
+// so that the previous master keys can be removed from the key file. The encrypted files are unchanged.
+func RewrapFileKeys(ctx context.Context) (keyCount int, err error) {
+	if keyProvider == nil {
+		return 0, fmt.Errorf("no key file is configured")
+	}
+	logger := glog.FromContext(ctx)
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return
+	}
+
+	defer hdfsClient.Close()
+	spaceInfos, err := internal.StatFilesInDir(ctx, hdfsClient, "/")
+	if err != nil {
+		logger.Error().Error("failed to list spaces", err).Fire()
+		return
+	}
+
+	for _, spaceInfo := range spaceInfos {
+		if !spaceInfo.IsDir() || internal.IsHiddenFile(spaceInfo.Name()) {
+			continue
+		}
+		instDirs, err := listInstanceDirs(ctx, hdfsClient, spaceInfo.Name(), "")
+		if err != nil {
+			logger.Error().Msg(fmt.Sprintf("list instances of space [%s] failed, %s", spaceInfo.Name(), err.Error())).Fire()
+			return keyCount, err
+		}
+		for _, instDir := range instDirs {
+			if err = ctx.Err(); err != nil {
+				return keyCount, err
+			}
+			n, err := rewrapInstanceKeys(ctx, hdfsClient, instDir)
+			keyCount += n
+			if err != nil {
+				logger.Error().Msg(fmt.Sprintf("rewrap keys of instance [%s/%s/%s] failed, %s",
+					instDir.SpaceID, instDir.FlowID, instDir.InstanceID, err.Error())).Fire()
+				return keyCount, err
+			}
+		}
+	}
+	logger.Info().Msg(fmt.Sprintf("[%d] file keys rewrapped with master key [%s]", keyCount, keyProvider.CurrentKeyID())).Fire()
+	return keyCount, nil
+}
+
+// rewrapInstanceKeys rewraps the keys in the logs dir and in the archive of an instance.
+func rewrapInstanceKeys(ctx context.Context, client *hdfs.Client, instDir *instanceDir) (int, error) {
+	logsDirPath := internal.GetHdfsLogsDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	var keyCount int
+	err := client.Walk(logsDirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !internal.IsFileKeyPath(filePath) {
+			return nil
+		}
+		rewrapped, err := rewrapFileKey(client, filePath)
+		if rewrapped {
+			keyCount++
+		}
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return keyCount, err
+	}
+
+	n, err := rewrapArchivedKeys(ctx, client, instDir)
+	return keyCount + n, err
+}
+
+// rewrapFileKey rewraps a key in a logs dir, the key is read again under its lock
+// since the file may have been saved again, with a new key or without encryption, since it was listed.
+func rewrapFileKey(client *hdfs.Client, keyPath string) (bool, error) {
+	unlock := fileKeys.lock(keyPath)
+	defer unlock()
+
+	fileKey, err := readFileKey(client, keyPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if rewrapped, err := fileKey.Rewrap(keyProvider); err != nil || !rewrapped {
+		return false, err
+	}
+	if err = writeFileKey(client, keyPath, fileKey); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rewrapArchivedKeys rewraps the keys packed into the archive of an instance, the archive is rewritten if any key changed.
+func rewrapArchivedKeys(ctx context.Context, client *hdfs.Client, instDir *instanceDir) (int, error) {
+	unlock := lockDir(internal.GetHdfsInstanceDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID), true)
+	defer unlock()
+
+	archiveIndex, err := loadArchiveIndex(client, instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	archivePath := internal.GetHdfsArchiveFilePath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID, archiveIndex.Archive)
+	rewrapped := make(map[string][]byte)
+	for _, member := range archiveIndex.Members {
+		if !internal.IsFileKeyPath(member.Path) {
+			continue
+		}
+		reader, err := openArchiveMember(client, archivePath, member)
+		if err != nil {
+			return 0, err
+		}
+		fileKey, err := internal.DecodeFileKey(reader)
+		_ = reader.Close()
+		if err != nil {
+			return 0, err
+		}
+		ok, err := fileKey.Rewrap(keyProvider)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+
+		keyBuf := &bytes.Buffer{}
+		if err = fileKey.Encode(keyBuf); err != nil {
+			return 0, err
+		}
+		rewrapped[member.Path] = keyBuf.Bytes()
+	}
+	if len(rewrapped) == 0 {
+		return 0, nil
+	}
+
+	sources := make([]*internal.ArchiveSource, 0, len(archiveIndex.Members))
+	for _, member := range archiveIndex.Members {
+		member := member
+		src := &internal.ArchiveSource{
+			Path:    member.Path,
+			Size:    member.Size,
+			ModTime: member.ModTime,
+			Open: func() (io.ReadCloser, error) {
+				return openArchiveMember(client, archivePath, member)
+			},
+		}
+		if b, ok := rewrapped[member.Path]; ok {
+			src.Size = int64(len(b))
+			src.Open = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(b)), nil
+			}
+		}
+		sources = append(sources, src)
+	}
+	if _, err = rewriteArchive(ctx, client, instDir, sources); err != nil {
+		return 0, err
+	}
+
+	// rewriting the archive touched the instance dir, its mtime is the instance time used by listings and retention
+	instDirPath := internal.GetHdfsInstanceDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	if err = client.Chtimes(instDirPath, time.Now(), instDir.ModTime); err != nil {
+		glog.FromContext(ctx).Warn().Msg(fmt.Sprintf("restore mtime of [%s] failed, %s", instDirPath, err.Error())).Fire()
+	}
+	return len(rewrapped), nil
+}
+
+func readFileKey(client *hdfs.Client, keyPath string) (*internal.FileKey, error) {
+	f, err := client.Open(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return internal.DecodeFileKey(f)
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetErrorSummary scans all archived log files of an instance and groups
+// the java exceptions found by fingerprint.
+func GetErrorSummary(ctx context.Context, spaceID, flowID, instID string) (*logpb.ErrorSummaryReply, error) {
+	glog.FromContext(ctx).Debug().Msg(fmt.Sprintf("try to summarize errors of instance [%s/%s/%s]", spaceID, flowID, instID)).Fire()
+	summary, err := summarizeInstanceErrors(ctx, spaceID, flowID, instID)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &logpb.ErrorSummaryReply{}
+	for _, stat := range summary.Sorted() {
+		reply.Errors = append(reply.Errors, toErrorFingerprint(stat))
+		reply.Total += stat.Count
+	}
+	return reply, nil
+}
+
+func summarizeInstanceErrors(ctx context.Context, spaceID, flowID, instID string) (internal.ExceptionSummary, error) {
+	logger := glog.FromContext(ctx)
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return nil, err
+	}
+
+	defer hdfsClient.Close()
+	logFiles, err := listInstanceLogFiles(ctx, hdfsClient, spaceID, flowID, instID)
+	if err != nil {
+		logger.Error().Error("failed to list instance log files", err).Fire()
+		return nil, err
+	}
+	// an unknown instance would otherwise compare as one without any exception
+	if len(logFiles) == 0 {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("no log files found for instance [%s/%s/%s]", spaceID, flowID, instID))
+	}
+
+	summary := internal.ExceptionSummary{}
+	for _, logFile := range logFiles {
+		reader, err := openLogFile(ctx, hdfsClient, logFile)
+		if err != nil {
+			logger.Error().Msg(fmt.Sprintf("open file [%s] failed, %s", logFile.FilePath, err.Error())).Fire()
+			return nil, err
+		}
+
+		relPath := logFile.RelPath()
+		err = internal.ScanExceptions(reader, func(e *internal.ExceptionTrace) {
+			summary.Add(e, relPath)
+		})
+		_ = reader.Close()
+		if err != nil {
+			logger.Error().Msg(fmt.Sprintf("scan file [%s] failed, %s", logFile.FilePath, err.Error())).Fire()
+			return nil, err
+		}
+	}
+
+	return summary, nil
+}
+
+func toErrorFingerprint(stat *internal.ExceptionStat) *logpb.ErrorFingerprint {
+	return &logpb.ErrorFingerprint{
+		Fingerprint:    stat.Fingerprint,
+		ExceptionClass: stat.Class,
+		RootCause:      stat.RootCause,
+		Frames:         stat.Frames,
+		Count:          stat.Count,
+		FirstSeen:      internal.UnixMilli(stat.FirstSeen),
+		LastSeen:       internal.UnixMilli(stat.LastSeen),
+		Sample:         stat.Sample,
+		SampleFile:     stat.SampleFile,
+	}
+}
+
+// CompareErrorSummary compares the exceptions of two instances of the same flow.
+func CompareErrorSummary(ctx context.Context, spaceID, flowID, baseInstID, targetInstID string) (*logpb.CompareErrorSummaryReply, error) {
+	glog.FromContext(ctx).Debug().Msg(fmt.Sprintf("try to compare errors of instance [%s] and [%s] in [%s/%s]",
+		baseInstID, targetInstID, spaceID, flowID)).Fire()
+	if baseInstID == "" || targetInstID == "" || baseInstID == targetInstID {
+		return nil, status.Error(codes.InvalidArgument, "two different instance ids are required")
+	}
+
+	baseSummary, err := summarizeInstanceErrors(ctx, spaceID, flowID, baseInstID)
+	if err != nil {
+		return nil, err
+	}
+	targetSummary, err := summarizeInstanceErrors(ctx, spaceID, flowID, targetInstID)
+	if err != nil {
+		return nil, err
+	}
+
+	added, disappeared, changed := internal.CompareExceptionSummary(baseSummary, targetSummary)
+	reply := &logpb.CompareErrorSummaryReply{}
+	for _, stat := range added {
+		reply.New = append(reply.New, toErrorFingerprint(stat))
+	}
+	for _, stat := range disappeared {
+		reply.Disappeared = append(reply.Disappeared, toErrorFingerprint(stat))
+	}
+	for _, change := range changed {
+		reply.Changed = append(reply.Changed, &logpb.ErrorFingerprintChange{
+			Error:       toErrorFingerprint(change.Target),
+			BaseCount:   change.Base.Count,
+			TargetCount: change.Target.Count,
+		})
+	}
+	return reply, nil
+}
@@ -1,27 +1,94 @@
 package handler
 
 import (
-	"github.com/DataWorkbench/glog"
 	"github.com/DataWorkbench/logmanager/config"
+	"github.com/DataWorkbench/logmanager/internal"
 )
 
 // global options in this package.
 var (
-	logger           *glog.Logger
 	HdfsServerConfig *config.HdfsConfig
+	// nil if the full-text index is disabled
+	searchIndex *internal.SearchIndex
+	// nil if the metadata catalog is disabled
+	catalog *internal.Catalog
+	// empty if the redaction is disabled
+	redactionRules []*internal.RedactionRule
+	// nil if no key file is configured, files are only encrypted if encryptFiles is true
+	keyProvider  internal.KeyProvider
+	encryptFiles bool
+
+	// nil if the audit is disabled, events are queued into auditEvents
+	auditSink   internal.AuditSink
+	auditEvents chan *internal.AuditEvent
+
+	quotaConfig    *config.QuotaConfig
+	quotaOverrides map[string]*config.StorageQuota
+
+	usageReportConfig *config.UsageReportConfig
+
+	// the space label of the metrics is empty unless set
+	metricsSpaceLabel bool
 )
 
 type Option func()
 
-func WithLogger(lp *glog.Logger) Option {
+func WithHdfsConfig(hc *config.HdfsConfig) Option {
 	return func() {
-		logger = lp
+		HdfsServerConfig = hc
 	}
 }
 
-func WithHdfsConfig(hc *config.HdfsConfig) Option {
+func WithSearchIndex(si *internal.SearchIndex) Option {
 	return func() {
-		HdfsServerConfig = hc
+		searchIndex = si
+	}
+}
+
+func WithCatalog(c *internal.Catalog) Option {
+	return func() {
+		catalog = c
+	}
+}
+
+func WithRedactionRules(rules []*internal.RedactionRule) Option {
+	return func() {
+		redactionRules = rules
+	}
+}
+
+func WithKeyProvider(kp internal.KeyProvider, encrypt bool) Option {
+	return func() {
+		keyProvider = kp
+		encryptFiles = encrypt
+	}
+}
+
+func WithAuditSink(sink internal.AuditSink) Option {
+	return func() {
+		auditSink = sink
+		if sink != nil {
+			auditEvents = make(chan *internal.AuditEvent, auditBufferSize)
+		}
+	}
+}
+
+func WithQuotaConfig(qc *config.QuotaConfig, overrides map[string]*config.StorageQuota) Option {
+	return func() {
+		quotaConfig = qc
+		quotaOverrides = overrides
+	}
+}
+
+func WithUsageReportConfig(urc *config.UsageReportConfig) Option {
+	return func() {
+		usageReportConfig = urc
+	}
+}
+
+func WithMetricsConfig(mc *config.MetricsConfig) Option {
+	return func() {
+		metricsSpaceLabel = mc.SpaceLabel
 	}
 }
 
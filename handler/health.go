@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/DataWorkbench/logmanager/internal"
+)
+
+// CheckStorage returns an error if the NameNode does not answer within timeout.
+func CheckStorage(ctx context.Context, timeout time.Duration) error {
+	// the connections of the probe fail past the deadline, a NameNode that hangs does not leave the probe running
+	hdfsClient, err := internal.GetClientWithDeadline(ctx, HdfsServerConfig, time.Now().Add(timeout))
+	if err == nil {
+		defer hdfsClient.Close()
+		_, err = internal.StatFile(ctx, hdfsClient, "/")
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("no answer from the NameNode in %s, %w", timeout, err)
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// instanceLogStat is the total of the files of an instance.
+type instanceLogStat struct {
+	*instanceDir
+	Size         int64
+	FileCount    int64
+	LastModified time.Time
+}
+
+// statInstanceLogs sums the files of an instance from the content summary of its dir, the sidecars included.
+// The instance was last modified when its manifest was written, or when its dir was if it has none yet.
+func statInstanceLogs(ctx context.Context, client *hdfs.Client, instDir *instanceDir) (*instanceLogStat, error) {
+	size, fileCount, err := internal.StatDirUsage(ctx, client, internal.GetHdfsInstanceDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID))
+	if err != nil {
+		return nil, err
+	}
+	stat := &instanceLogStat{instanceDir: instDir, Size: size, FileCount: int64(fileCount), LastModified: instDir.ModTime}
+
+	info, err := internal.StatFile(ctx, client, internal.GetHdfsManifestPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID))
+	if err == nil {
+		stat.LastModified = info.ModTime()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return stat, nil
+}
+
+// ListFlowsWithLogs returns a page of the flows of a space that have archived logs, with the total of the files of their
+// instances. The flows are ordered by their newest instance dir, only the flows of the page are summed.
+func ListFlowsWithLogs(ctx context.Context, spaceID string, pageSize int32, pageToken string) (*logpb.ListFlowsWithLogsReply, error) {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to list flows with logs of space [%s]", spaceID)).Fire()
+	if spaceID == "" {
+		return nil, status.Error(codes.InvalidArgument, "space id is required")
+	}
+
+	fingerprint := pageFingerprint("flows", spaceID)
+	offset, err := decodePageToken(pageToken, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return nil, err
+	}
+
+	defer hdfsClient.Close()
+	instDirs, err := listInstanceDirs(ctx, hdfsClient, spaceID, "")
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("list instances of space [%s] failed, %s", spaceID, err.Error())).Fire()
+		return nil, err
+	}
+
+	var flows []*logpb.FlowWithLogs
+	byID := make(map[string]*logpb.FlowWithLogs)
+	// instDirs are ordered from the newest, so are the flows
+	for _, instDir := range instDirs {
+		flow, ok := byID[instDir.FlowID]
+		if !ok {
+			flow = &logpb.FlowWithLogs{
+				FlowId:       instDir.FlowID,
+				LastModified: internal.UnixMilli(instDir.ModTime),
+			}
+			byID[instDir.FlowID] = flow
+			flows = append(flows, flow)
+		}
+		flow.InstanceCount++
+	}
+
+	reply := &logpb.ListFlowsWithLogsReply{TotalCount: int32(len(flows))}
+	if offset >= len(flows) {
+		return reply, nil
+	}
+	end, nextPageToken := pageEnd(offset, normalizePageSize(pageSize), len(flows), fingerprint)
+	reply.NextPageToken = nextPageToken
+	for _, flow := range flows[offset:end] {
+		size, fileCount, err := internal.StatDirUsage(ctx, hdfsClient, internal.GetHdfsFlowDirPath(spaceID, flow.FlowId))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error().Msg(fmt.Sprintf("stat logs of flow [%s/%s] failed, %s", spaceID, flow.FlowId, err.Error())).Fire()
+			return nil, err
+		}
+		flow.TotalSize = size
+		flow.FileCount = int64(fileCount)
+		reply.Flows = append(reply.Flows, flow)
+	}
+	return reply, nil
+}
+
+// ListInstancesWithLogs returns a page of the instances of a flow that have archived logs, with the total of their files.
+// The instances are ordered from the newest dir, only the instances of the page are summed.
+func ListInstancesWithLogs(ctx context.Context, spaceID, flowID string, pageSize int32, pageToken string) (*logpb.ListInstancesWithLogsReply, error) {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to list instances with logs of flow [%s/%s]", spaceID, flowID)).Fire()
+	if spaceID == "" || flowID == "" {
+		return nil, status.Error(codes.InvalidArgument, "space id and flow id are required")
+	}
+
+	fingerprint := pageFingerprint("instances", spaceID, flowID)
+	offset, err := decodePageToken(pageToken, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return nil, err
+	}
+
+	defer hdfsClient.Close()
+	instDirs, err := listInstanceDirs(ctx, hdfsClient, spaceID, flowID)
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("list instances of [%s/%s] failed, %s", spaceID, flowID, err.Error())).Fire()
+		return nil, err
+	}
+
+	reply := &logpb.ListInstancesWithLogsReply{TotalCount: int32(len(instDirs))}
+	if offset >= len(instDirs) {
+		return reply, nil
+	}
+	end, nextPageToken := pageEnd(offset, normalizePageSize(pageSize), len(instDirs), fingerprint)
+	reply.NextPageToken = nextPageToken
+	for _, instDir := range instDirs[offset:end] {
+		stat, err := statInstanceLogs(ctx, hdfsClient, instDir)
+		if os.IsNotExist(err) {
+			// removed since it was listed
+			continue
+		}
+		if err != nil {
+			logger.Error().Msg(fmt.Sprintf("stat logs of instance [%s/%s/%s] failed, %s",
+				instDir.SpaceID, instDir.FlowID, instDir.InstanceID, err.Error())).Fire()
+			return nil, err
+		}
+		reply.Instances = append(reply.Instances, &logpb.InstanceWithLogs{
+			InstanceId:   stat.InstanceID,
+			InstanceTime: internal.UnixMilli(stat.ModTime),
+			TotalSize:    stat.Size,
+			FileCount:    stat.FileCount,
+			LastModified: internal.UnixMilli(stat.LastModified),
+		})
+	}
+	return reply, nil
+}
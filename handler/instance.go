@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/DataWorkbench/common/constants"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// InstanceLogFile describes a log file archived for a flow instance.
+type InstanceLogFile struct {
+	// ManagerName is constants.JobManagerName or constants.TaskManagerName.
+	ManagerName string
+	// TaskManagerID is empty for JobManager log files.
+	TaskManagerID string
+	FileName      string
+	FilePath      string
+	Size          int64
+	ModTime       time.Time
+
+	// archivePath, archiveIndex and member are set if the file is packed into the archive of the instance.
+	archivePath  string
+	archiveIndex *internal.ArchiveIndex
+	member       *internal.ArchiveMember
+}
+
+// RelPath returns the path of the file relative to the logs dir of the instance,
+// e.g. "jobmanager/:log_file" or "taskmanager/:taskManager_id/:log_file".
+func (f *InstanceLogFile) RelPath() string {
+	if f.TaskManagerID == "" {
+		return fmt.Sprintf("%s/%s", f.ManagerName, f.FileName)
+	}
+	return fmt.Sprintf("%s/%s/%s", f.ManagerName, f.TaskManagerID, f.FileName)
+}
+
+// parseRelPath splits a path relative to the logs dir of an instance,
+// ok is false if it is not the path of a JobManager or TaskManager log file.
+func parseRelPath(relPath string) (managerName, taskManagerID, fileName string, ok bool) {
+	parts := strings.Split(relPath, "/")
+	switch {
+	case len(parts) == 2 && parts[0] == constants.JobManagerName:
+		return parts[0], "", parts[1], true
+	case len(parts) == 3 && parts[0] == constants.TaskManagerName:
+		return parts[0], parts[1], parts[2], true
+	}
+	return "", "", "", false
+}
+
+// listInstanceLogFiles returns the JobManager and TaskManager log files of an instance,
+// from its logs dir and from its archive if it has been compacted. Files uploaded again
+// after the compaction replace the archived ones until the next compaction merges them.
+func listInstanceLogFiles(ctx context.Context, client *hdfs.Client, spaceID, flowID, instID string) ([]*InstanceLogFile, error) {
+	archived, err := listArchivedLogFiles(client, spaceID, flowID, instID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = internal.StatFile(ctx, client, internal.GetHdfsLogsDirPath(spaceID, flowID, instID))
+	if os.IsNotExist(err) {
+		return archived, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*InstanceLogFile
+
+	jmDirPath := internal.GetHdfsDirPath(spaceID, flowID, instID, constants.JobManagerName)
+	jmFileInfos, err := internal.StatFilesInDir(ctx, client, jmDirPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fileInfo := range jmFileInfos {
+		if fileInfo.IsDir() || internal.IsHiddenFile(fileInfo.Name()) {
+			continue
+		}
+		result = append(result, &InstanceLogFile{
+			ManagerName: constants.JobManagerName,
+			FileName:    fileInfo.Name(),
+			FilePath:    fmt.Sprintf("%s/%s", jmDirPath, fileInfo.Name()),
+			Size:        fileInfo.Size(),
+			ModTime:     fileInfo.ModTime(),
+		})
+	}
+
+	tmDirPath := internal.GetHdfsDirPath(spaceID, flowID, instID, constants.TaskManagerName)
+	tmDirInfos, err := internal.StatFilesInDir(ctx, client, tmDirPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, dirInfo := range tmDirInfos {
+		if !dirInfo.IsDir() {
+			continue
+		}
+		subDirPath := fmt.Sprintf("%s/%s", tmDirPath, dirInfo.Name())
+		fileInfos, err := internal.StatFilesInDir(ctx, client, subDirPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileInfo := range fileInfos {
+			if fileInfo.IsDir() || internal.IsHiddenFile(fileInfo.Name()) {
+				continue
+			}
+			result = append(result, &InstanceLogFile{
+				ManagerName:   constants.TaskManagerName,
+				TaskManagerID: dirInfo.Name(),
+				FileName:      fileInfo.Name(),
+				FilePath:      fmt.Sprintf("%s/%s", subDirPath, fileInfo.Name()),
+				Size:          fileInfo.Size(),
+				ModTime:       fileInfo.ModTime(),
+			})
+		}
+	}
+
+	return mergeLogFiles(result, archived), nil
+}
+
+type logFileReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// openLogFile opens an archived log file for reading, encrypted files are decrypted.
+func openLogFile(ctx context.Context, client *hdfs.Client, f *InstanceLogFile) (logFileReader, error) {
+	reader, err := openStoredFile(ctx, client, f)
+	if err != nil || internal.IsHiddenFile(path.Base(f.FilePath)) {
+		return reader, err
+	}
+
+	fileKey, err := loadFileKey(ctx, client, f)
+	if os.IsNotExist(err) {
+		return reader, nil
+	}
+	if err == nil {
+		var decrypted logFileReader
+		if decrypted, err = decryptLogFile(reader, fileKey); err == nil {
+			return decrypted, nil
+		}
+	}
+	_ = reader.Close()
+	return nil, err
+}
+
+// openStoredFile opens the content of a file as stored in HDFS.
+func openStoredFile(ctx context.Context, client *hdfs.Client, f *InstanceLogFile) (reader logFileReader, err error) {
+	finish := internal.StartHdfsOperation(ctx, "open")
+	if f.member != nil {
+		reader, err = openArchiveMember(client, f.archivePath, f.member)
+	} else {
+		var file *hdfs.FileReader
+		if file, err = client.Open(f.FilePath); err == nil {
+			reader = &internal.HdfsReader{FileReader: file}
+		}
+	}
+	finish(err)
+	return
+}
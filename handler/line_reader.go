@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+const (
+	defaultReadLineCount = 100
+	maxReadLineCount     = 10000
+)
+
+var errStopScan = errors.New("stop scan")
+
+// ReadLogLines reads lineCount lines of a log file starting from startLine,
+// or from the first log record at or after startTime (unix milliseconds) if it's set.
+// The line index of the file is used to skip to the nearest block instead of reading from the beginning.
+func ReadLogLines(ctx context.Context, filePath string, startLine int64, startTime int64, lineCount int32) (*logpb.ReadLogLinesReply, error) {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to read lines of file [%s]", filePath)).Fire()
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return nil, err
+	}
+
+	defer hdfsClient.Close()
+	logFile, err := statLogFile(ctx, hdfsClient, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	lineIndex, err := loadLineIndex(ctx, hdfsClient, logFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if lineCount <= 0 {
+		lineCount = defaultReadLineCount
+	} else if lineCount > maxReadLineCount {
+		lineCount = maxReadLineCount
+	}
+	if startLine < 1 {
+		startLine = 1
+	}
+
+	var entry internal.LineIndexEntry
+	if startTime > 0 {
+		entry = lineIndex.SeekTime(startTime)
+	} else {
+		entry = lineIndex.Seek(startLine)
+	}
+
+	reader, err := openLogFile(ctx, hdfsClient, logFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	if _, err = reader.Seek(entry.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reply := &logpb.ReadLogLinesReply{TotalLines: lineIndex.Lines}
+	err = internal.ScanLines(reader, func(line []byte, lineNo int64, _ int64) error {
+		lineNo += entry.Line - 1
+		if reply.StartLine == 0 {
+			if startTime > 0 {
+				t, ok := internal.ParseLogTime(line)
+				if !ok || internal.UnixMilli(t) < startTime {
+					return nil
+				}
+			} else if lineNo < startLine {
+				return nil
+			}
+			reply.StartLine = lineNo
+		}
+
+		reply.Lines = append(reply.Lines, string(line))
+		if len(reply.Lines) >= int(lineCount) {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil && err != errStopScan {
+		logger.Error().Msg(fmt.Sprintf("read lines of file [%s] failed, %s", filePath, err.Error())).Fire()
+		return nil, err
+	}
+	return reply, nil
+}
+
+// loadLineIndex reads the line index of a log file, the index is built and saved
+// if it does not exist yet or is stale, e.g. for files archived before line indexes were written.
+// The index of a file packed into an instance archive is read from the archive and never saved.
+func loadLineIndex(ctx context.Context, client *hdfs.Client, logFile *InstanceLogFile) (*internal.LineIndex, error) {
+	logger := glog.FromContext(ctx)
+	indexPath := internal.LineIndexPath(logFile.FilePath)
+	if lineIndex, err := readLineIndex(ctx, client, logFile); err == nil {
+		if lineIndex.Size == logFile.Size {
+			return lineIndex, nil
+		}
+		logger.Info().Msg(fmt.Sprintf("line index [%s] is stale, rebuild it", indexPath)).Fire()
+	} else if os.IsNotExist(err) {
+		logger.Debug().Msg(fmt.Sprintf("line index [%s] not exists, build it", indexPath)).Fire()
+	} else {
+		logger.Warn().Msg(fmt.Sprintf("read line index [%s] failed, %s", indexPath, err.Error())).Fire()
+	}
+
+	reader, err := openLogFile(ctx, client, logFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	builder := internal.NewLineIndexBuilder(internal.LineIndexInterval)
+	lineWriter := internal.NewLineWriter(builder.AddLine)
+	if _, err = io.Copy(lineWriter, reader); err != nil {
+		return nil, err
+	}
+	_ = lineWriter.Close()
+
+	lineIndex := builder.Index(lineWriter.Lines(), lineWriter.Written())
+	if logFile.member != nil {
+		return lineIndex, nil
+	}
+	if err := saveLineIndex(client, logFile.FilePath, lineIndex); err != nil {
+		logger.Warn().Msg(fmt.Sprintf("save line index of [%s] failed, %s", logFile.FilePath, err.Error())).Fire()
+	}
+	return lineIndex, nil
+}
+
+// readLineIndex reads the line index of a log file from the same place as the file, see statSidecar.
+func readLineIndex(ctx context.Context, client *hdfs.Client, logFile *InstanceLogFile) (*internal.LineIndex, error) {
+	indexFile, err := statSidecar(ctx, client, logFile, internal.LineIndexPath(logFile.FilePath))
+	if err != nil {
+		return nil, err
+	}
+	f, err := openLogFile(ctx, client, indexFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return internal.DecodeLineIndex(f)
+}
+
+// saveLineIndex writes the line index as sidecar of the log file, an existing index is replaced.
+func saveLineIndex(client *hdfs.Client, filePath string, lineIndex *internal.LineIndex) (err error) {
+	var buf bytes.Buffer
+	if err = lineIndex.Encode(&buf); err != nil {
+		return
+	}
+
+	indexPath := internal.LineIndexPath(filePath)
+	err = client.Remove(indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	writer, err := client.Create(indexPath)
+	if err != nil {
+		return
+	}
+	if _, err = writer.Write(buf.Bytes()); err != nil {
+		_ = writer.Close()
+		return
+	}
+	return writer.Close()
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DataWorkbench/common/constants"
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+
+	sortByName    = "name"
+	sortBySize    = "size"
+	sortByModTime = "mod_time"
+)
+
+// ListLogFilesOptions selects, orders and pages the log files of an instance.
+type ListLogFilesOptions struct {
+	// constants.JobManagerName, constants.TaskManagerName or empty for both
+	ManagerName         string
+	TaskManagerIDPrefix string
+	// shell file name pattern, e.g. "*.log"
+	FileNamePattern string
+	// sortByName, sortBySize or sortByModTime, sortByName if empty
+	SortBy     string
+	Descending bool
+	PageSize   int32
+	PageToken  string
+}
+
+// fingerprint identifies the options a page token was issued for.
+func (opts *ListLogFilesOptions) fingerprint(spaceID, flowID, instID string) string {
+	return pageFingerprint(spaceID, flowID, instID, opts.ManagerName, opts.TaskManagerIDPrefix,
+		opts.FileNamePattern, opts.SortBy, strconv.FormatBool(opts.Descending))
+}
+
+// pageFingerprint identifies the request a page token was issued for by the values selecting and ordering the items.
+func pageFingerprint(values ...string) string {
+	h := sha1.New()
+	for _, v := range values {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// normalizePageSize returns defaultPageSize if size is not set, at most maxPageSize.
+func normalizePageSize(size int32) int {
+	if size <= 0 {
+		return defaultPageSize
+	}
+	if size > maxPageSize {
+		return maxPageSize
+	}
+	return int(size)
+}
+
+// pageEnd returns the end of the page starting at offset among total items,
+// and the token of the next page, empty on the last page.
+func pageEnd(offset, pageSize, total int, fingerprint string) (end int, nextPageToken string) {
+	end = offset + pageSize
+	if end < total {
+		return end, encodePageToken(end, fingerprint)
+	}
+	return total, ""
+}
+
+// page tokens are "offset:fingerprint" encoded, so a token is rejected if the options change between pages
+func encodePageToken(offset int, fingerprint string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", offset, fingerprint)))
+}
+
+func decodePageToken(token, fingerprint string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, "invalid page token")
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || parts[1] != fingerprint {
+		return 0, status.Error(codes.InvalidArgument, "page token does not match the request")
+	}
+	offset, err := strconv.Atoi(parts[0])
+	if err != nil || offset < 0 {
+		return 0, status.Error(codes.InvalidArgument, "invalid page token")
+	}
+	return offset, nil
+}
+
+// ListLogFiles returns a page of the log files of an instance.
+func ListLogFiles(ctx context.Context, spaceID, flowID, instID string, opts *ListLogFilesOptions) (*logpb.ListLogFilesReply, error) {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to list log files of instance [%s/%s/%s]", spaceID, flowID, instID)).Fire()
+	if opts.ManagerName != "" && opts.ManagerName != constants.JobManagerName && opts.ManagerName != constants.TaskManagerName {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid manager name [%s]", opts.ManagerName))
+	}
+	if opts.SortBy == "" {
+		opts.SortBy = sortByName
+	}
+	if opts.SortBy != sortByName && opts.SortBy != sortBySize && opts.SortBy != sortByModTime {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid sort field [%s]", opts.SortBy))
+	}
+	if opts.FileNamePattern != "" {
+		if _, err := path.Match(opts.FileNamePattern, ""); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid file name pattern [%s]", opts.FileNamePattern))
+		}
+	}
+	pageSize := normalizePageSize(opts.PageSize)
+	fingerprint := opts.fingerprint(spaceID, flowID, instID)
+	offset, err := decodePageToken(opts.PageToken, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	logFiles, err := instanceLogFiles(ctx, spaceID, flowID, instID)
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("list log files of instance [%s/%s/%s] failed, %s", spaceID, flowID, instID, err.Error())).Fire()
+		return nil, err
+	}
+
+	var selected []*InstanceLogFile
+	for _, logFile := range logFiles {
+		if opts.ManagerName != "" && logFile.ManagerName != opts.ManagerName {
+			continue
+		}
+		if opts.TaskManagerIDPrefix != "" &&
+			(logFile.ManagerName != constants.TaskManagerName || !strings.HasPrefix(logFile.TaskManagerID, opts.TaskManagerIDPrefix)) {
+			continue
+		}
+		if opts.FileNamePattern != "" {
+			if matched, _ := path.Match(opts.FileNamePattern, logFile.FileName); !matched {
+				continue
+			}
+		}
+		selected = append(selected, logFile)
+	}
+	sortLogFiles(selected, opts.SortBy, opts.Descending)
+
+	reply := &logpb.ListLogFilesReply{TotalCount: int32(len(selected))}
+	if offset >= len(selected) {
+		return reply, nil
+	}
+	end, nextPageToken := pageEnd(offset, pageSize, len(selected), fingerprint)
+	reply.NextPageToken = nextPageToken
+	for _, logFile := range selected[offset:end] {
+		reply.Files = append(reply.Files, &logpb.LogFileEntry{
+			ManagerName:   logFile.ManagerName,
+			TaskManagerId: logFile.TaskManagerID,
+			FileName:      logFile.FileName,
+			FileSize:      logFile.Size,
+			ModTime:       internal.UnixMilli(logFile.ModTime),
+		})
+	}
+	return reply, nil
+}
+
+// sortLogFiles orders the files by the field, ties are ordered by path so that pages are stable.
+func sortLogFiles(logFiles []*InstanceLogFile, sortBy string, descending bool) {
+	sort.SliceStable(logFiles, func(i, j int) bool {
+		a, b := logFiles[i], logFiles[j]
+		if descending {
+			a, b = b, a
+		}
+		switch sortBy {
+		case sortBySize:
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case sortByModTime:
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		default:
+			if a.FileName != b.FileName {
+				return a.FileName < b.FileName
+			}
+		}
+		return a.RelPath() < b.RelPath()
+	})
+}
+
+// instanceLogFiles returns the log files of an instance from the catalog if it can list the instance, otherwise from HDFS.
+func instanceLogFiles(ctx context.Context, spaceID, flowID, instID string) ([]*InstanceLogFile, error) {
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		glog.FromContext(ctx).Error().Error("failed to create HDFS client", err).Fire()
+		return nil, err
+	}
+
+	defer hdfsClient.Close()
+	if entries, ok := catalogList(ctx, hdfsClient, spaceID, flowID, instID); ok {
+		logFiles := make([]*InstanceLogFile, 0, len(entries))
+		for _, e := range entries {
+			managerName, taskManagerID, fileName, ok := parseRelPath(e.Path)
+			if !ok || internal.IsHiddenFile(fileName) {
+				continue
+			}
+			logFiles = append(logFiles, &InstanceLogFile{
+				ManagerName:   managerName,
+				TaskManagerID: taskManagerID,
+				FileName:      fileName,
+				FilePath:      fmt.Sprintf("%s/%s", internal.GetHdfsLogsDirPath(spaceID, flowID, instID), e.Path),
+				Size:          e.Size,
+				ModTime:       e.ModTime,
+			})
+		}
+		return logFiles, nil
+	}
+	return listInstanceLogFiles(ctx, hdfsClient, spaceID, flowID, instID)
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/DataWorkbench/common/constants"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDecodePageToken(t *testing.T) {
+	fingerprint := pageFingerprint("space", "flow", "inst")
+	tests := []struct {
+		name   string
+		token  string
+		offset int
+		code   codes.Code
+	}{
+		{"first page", "", 0, codes.OK},
+		{"next page", encodePageToken(100, fingerprint), 100, codes.OK},
+		{"other request", encodePageToken(100, pageFingerprint("space", "flow", "other")), 0, codes.InvalidArgument},
+		{"not base64", "!!!", 0, codes.InvalidArgument},
+		{"no fingerprint", base64.RawURLEncoding.EncodeToString([]byte("100")), 0, codes.InvalidArgument},
+		{"negative offset", encodePageToken(-1, fingerprint), 0, codes.InvalidArgument},
+		{"tampered offset", base64.RawURLEncoding.EncodeToString([]byte("x:" + fingerprint)), 0, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, err := decodePageToken(tt.token, fingerprint)
+			require.Equal(t, tt.code, status.Code(err), "%v", err)
+			require.Equal(t, tt.offset, offset)
+		})
+	}
+}
+
+func TestListLogFilesFingerprint(t *testing.T) {
+	opts := &ListLogFilesOptions{SortBy: sortBySize}
+	require.Equal(t, opts.fingerprint("space", "flow", "inst"), opts.fingerprint("space", "flow", "inst"))
+	require.NotEqual(t, opts.fingerprint("space", "flow", "inst"), (&ListLogFilesOptions{SortBy: sortBySize, Descending: true}).fingerprint("space", "flow", "inst"))
+	// the values are separated, so they can not be shifted from one to the next
+	require.NotEqual(t, pageFingerprint("ab", "c"), pageFingerprint("a", "bc"))
+}
+
+func TestPageEnd(t *testing.T) {
+	tests := []struct {
+		name     string
+		offset   int
+		pageSize int
+		total    int
+		end      int
+		next     bool
+	}{
+		{"first page", 0, 10, 25, 10, true},
+		{"last page", 20, 10, 25, 25, false},
+		{"exact last page", 10, 10, 20, 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end, next := pageEnd(tt.offset, tt.pageSize, tt.total, "fingerprint")
+			require.Equal(t, tt.end, end)
+			require.Equal(t, tt.next, next != "")
+			if tt.next {
+				offset, err := decodePageToken(next, "fingerprint")
+				require.NoError(t, err)
+				require.Equal(t, tt.end, offset)
+			}
+		})
+	}
+}
+
+func TestSortLogFiles(t *testing.T) {
+	modTime := time.Date(2021, 10, 19, 10, 0, 0, 0, time.UTC)
+	files := func() []*InstanceLogFile {
+		return []*InstanceLogFile{
+			{ManagerName: constants.TaskManagerName, TaskManagerID: "tm-2", FileName: "taskmanager.log", Size: 10, ModTime: modTime},
+			{ManagerName: constants.JobManagerName, FileName: "jobmanager.log", Size: 20, ModTime: modTime.Add(time.Hour)},
+			{ManagerName: constants.TaskManagerName, TaskManagerID: "tm-1", FileName: "taskmanager.log", Size: 10, ModTime: modTime},
+		}
+	}
+	tests := []struct {
+		name       string
+		sortBy     string
+		descending bool
+		// task manager ids, "jm" for the job manager
+		files []string
+	}{
+		{"name, ties by path", sortByName, false, []string{"jm", "tm-1", "tm-2"}},
+		{"name descending", sortByName, true, []string{"tm-2", "tm-1", "jm"}},
+		{"size, ties by path", sortBySize, false, []string{"tm-1", "tm-2", "jm"}},
+		{"mod time descending", sortByModTime, true, []string{"jm", "tm-2", "tm-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logFiles := files()
+			sortLogFiles(logFiles, tt.sortBy, tt.descending)
+			var ids []string
+			for _, f := range logFiles {
+				if f.TaskManagerID == "" {
+					ids = append(ids, "jm")
+				} else {
+					ids = append(ids, f.TaskManagerID)
+				}
+			}
+			require.Equal(t, tt.files, ids)
+		})
+	}
+}
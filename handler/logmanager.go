@@ -3,61 +3,95 @@ package handler
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/DataWorkbench/glog"
 	"github.com/DataWorkbench/gproto/pkg/logpb"
 	"github.com/DataWorkbench/logmanager/internal"
 	"github.com/colinmarc/hdfs/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
 	"os"
 	"path"
+	"time"
 )
 
+var errNoValidLogFile = errors.New("no valid log file found")
+
 type FileDataBlock struct {
 	Data []byte
 	Err  error
 }
 
-func ListHistoryLogFiles(dirPath string) ([]os.FileInfo, error) {
+func ListHistoryLogFiles(ctx context.Context, dirPath string) ([]os.FileInfo, error) {
+	logger := glog.FromContext(ctx)
 	logger.Debug().Msg(fmt.Sprintf("try to list log files in Dir [%s]", dirPath))
-	hdfsClient, err := internal.GetClient(HdfsServerConfig)
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
 	if err != nil {
 		logger.Error().Error("failed to create HDFS client", err).Fire()
 		return nil, err
 	}
 
 	defer hdfsClient.Close()
-	fileInfos, err := internal.StatFilesInDir(hdfsClient, dirPath)
-	if err != nil {
+	// the dirs are only listed on the NameNode for instances the catalog can't list
+	if fileInfos, ok, err := readCatalogDir(ctx, hdfsClient, dirPath); ok {
+		return fileInfos, err
+	}
+	fileInfos, err := internal.StatFilesInDir(ctx, hdfsClient, dirPath)
+	if err != nil && !os.IsNotExist(err) {
 		logger.Error().Msg(fmt.Sprintf("failed to stat files in Dir [%s]", dirPath)).Fire()
 		return nil, err
 	}
+	looseErr := err
+
+	// the instance may have been compacted into an archive, files uploaded again since then replace the archived ones
+	archivedInfos, err := readArchivedDir(hdfsClient, dirPath)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error().Msg(fmt.Sprintf("failed to read archived Dir [%s]", dirPath)).Fire()
+		return nil, err
+	}
+	if looseErr != nil && err != nil {
+		logger.Error().Msg(fmt.Sprintf("failed to stat files in Dir [%s]", dirPath)).Fire()
+		return nil, looseErr
+	}
 
-	return fileInfos, nil
+	return mergeDirInfos(fileInfos, archivedInfos), nil
 }
 
-func DownloadLogFile(filePath string, stream logpb.LogManager_DownloadJobMgrLogFileServer) (err error) {
+func DownloadLogFile(ctx context.Context, filePath string, stream logpb.LogManager_DownloadJobMgrLogFileServer) (err error) {
+	logger := glog.FromContext(ctx)
 	logger.Debug().Msg(fmt.Sprintf("try to Download file [%s]", filePath)).Fire()
-	hdfsClient, err := internal.GetClient(HdfsServerConfig)
+	startTime := time.Now()
+	var sentBytes int64
+	defer func() {
+		spaceID, _, _, _, _ := internal.ParseHdfsLogFilePath(filePath)
+		observeDownload(spaceID, downloadRPCFile, sentBytes, startTime, err)
+	}()
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
 	if err != nil {
 		logger.Error().Error("failed to create HDFS client", err).Fire()
 		return
 	}
 
 	defer hdfsClient.Close()
-	fileInfo, err := internal.StatFile(hdfsClient, filePath)
+	logFile, err := statLogFile(ctx, hdfsClient, filePath)
 	if err != nil {
 		return
 	}
 
-	fSize := fileInfo.Size()
+	fSize := logFile.Size
 
 	blockCh := make(chan FileDataBlock)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	go func() {
 		logger.Debug().String("begin to upload file", filePath).Int("fileSize", int(fSize)).Fire()
-		downloadFileFromHdfs(ctx, hdfsClient, filePath, blockCh)
+		downloadFileFromHdfs(ctx, hdfsClient, logFile, blockCh)
 		logger.Debug().String("uploading over, file", filePath).Fire()
 	}()
 
@@ -82,12 +116,14 @@ func DownloadLogFile(filePath string, stream logpb.LogManager_DownloadJobMgrLogF
 			logger.Error().Error("stream Send data failed", err).Fire()
 			return
 		}
+		sentBytes += int64(len(blockData.Data))
 	}
 }
 
-func downloadFileFromHdfs(ctx context.Context, client *hdfs.Client, filePath string, blockCh chan<- FileDataBlock) {
+func downloadFileFromHdfs(ctx context.Context, client *hdfs.Client, logFile *InstanceLogFile, blockCh chan<- FileDataBlock) {
+	logger := glog.FromContext(ctx)
 	defer close(blockCh)
-	f, err := client.Open(filePath)
+	f, err := openLogFile(ctx, client, logFile)
 	if err != nil {
 		blockCh <- FileDataBlock{
 			Err: err,
@@ -142,11 +178,32 @@ func downloadFileFromHdfs(ctx context.Context, client *hdfs.Client, filePath str
 
 // try to download log file from baseServerURL (flink web restful)
 // and upload file to destPrePath in HDFS
-func UploadLogFile(baseServerURL, destPrePath string) (*logpb.UploadFileReply, error) {
+func UploadLogFile(ctx context.Context, baseServerURL, destPrePath string) (*logpb.UploadFileReply, error) {
+	logger := glog.FromContext(ctx)
 	logger.Debug().Msg(fmt.Sprintf("try to Download file to store in [%s]", destPrePath)).Fire()
+	if err := checkInstanceQuota(ctx, destPrePath); err != nil {
+		return nil, err
+	}
+
+	// nothing is collected from a server that is not allowed or not a Flink cluster
+	flinkVersion, err := internal.VerifyFlinkServer(ctx, baseServerURL)
+	if err != nil {
+		return nil, flinkServerError(ctx, baseServerURL, err)
+	}
+
+	recorder := newManifestRecorder(ctx, baseServerURL, destPrePath)
+	recorder.manifest.FlinkVersion = flinkVersion
+	if jobIDs, err := internal.GetJobIDs(ctx, baseServerURL); err != nil {
+		recorder.addFailure(internal.GetJobsURL(baseServerURL), err)
+	} else {
+		recorder.manifest.JobIDs = jobIDs
+	}
+
 	// try to get log files from Flink web server
-	tErr := uploadTaskManagerLogFile(baseServerURL, destPrePath)
-	jErr := uploadJobManagerLogFile(baseServerURL, destPrePath)
+	tErr := uploadTaskManagerLogFile(ctx, baseServerURL, destPrePath, recorder)
+	jErr := uploadJobManagerLogFile(ctx, baseServerURL, destPrePath, recorder)
+	// the manifest is written after the call returns
+	go recorder.finish()
 	if tErr != nil {
 		return nil, tErr
 	}
@@ -161,67 +218,128 @@ func UploadLogFile(baseServerURL, destPrePath string) (*logpb.UploadFileReply, e
 
 }
 
-func uploadJobManagerLogFile(baseServerURL, destPrePath string) (err error) {
+// flinkServerError converts the error of checking a Flink server into a grpc status.
+func flinkServerError(ctx context.Context, baseServerURL string, err error) error {
+	glog.FromContext(ctx).Warn().Msg(fmt.Sprintf("refused flink server [%s], %s", baseServerURL, err.Error())).Fire()
+	switch {
+	case errors.Is(err, internal.ErrURLNotAllowed):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, internal.ErrNotFlinkServer), errors.Is(err, internal.ErrResponseTooLarge):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, internal.ErrInvalidServerURL):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+func uploadJobManagerLogFile(ctx context.Context, baseServerURL, destPrePath string, recorder *manifestRecorder) (err error) {
+	logger := glog.FromContext(ctx)
 	apiURL := internal.GetJobManagerLogsURL(baseServerURL)
-	fileToUpload, err := internal.SelectLogFileToUpload(logger, apiURL)
+	fileToUpload, err := internal.SelectLogFileToUpload(ctx, apiURL)
 	if err != nil {
 		logger.Error().Error("failed to select log file to Upload", err).Fire()
+		recorder.addFailure(apiURL, err)
 		return
 	}
 
 	fileName := fileToUpload.Name
 	if fileName == "" {
 		logger.Warn().Msg(fmt.Sprintf("no valid file found for [%s]", apiURL)).Fire()
+		recorder.addFailure(apiURL, errNoValidLogFile)
 		return
 	}
+	// the names come from the server the caller chose, one that could escape the log dir is not saved
+	if err = internal.CheckFlinkName(fileName, internal.FileNameRegexp); err != nil {
+		logger.Warn().Msg(fmt.Sprintf("skip file of [%s], %s", apiURL, err.Error())).Fire()
+		recorder.addFailure(apiURL, err)
+		return nil
+	}
 
 	finalFileURL := internal.GetJobManagerLogFileURL(baseServerURL, fileName)
 	finalDestPath := GetJobManagerFilePathInHDFS(destPrePath, fileName)
-	go func() {
-		_ = saveFile(finalFileURL, finalDestPath)
-	}()
+	recorder.saveFile(finalFileURL, finalDestPath, fileToUpload.Size)
 
 	return
 }
 
-func uploadTaskManagerLogFile(baseServerURL string, destPrePath string) (err error) {
-	taskManagerIDs, err := internal.GetTaskManagerIDs(logger, baseServerURL)
+func uploadTaskManagerLogFile(ctx context.Context, baseServerURL string, destPrePath string, recorder *manifestRecorder) (err error) {
+	logger := glog.FromContext(ctx)
+	taskManagerIDs, err := internal.GetTaskManagerIDs(ctx, baseServerURL)
 	if err != nil {
+		recorder.addFailure(internal.GetTaskManagersURL(baseServerURL), err)
 		return
 	}
+	validIDs := []string{}
+	for _, _taskManagerID := range taskManagerIDs {
+		if err := internal.CheckFlinkName(_taskManagerID, internal.TaskManagerIDRegexp); err != nil {
+			logger.Warn().Msg(fmt.Sprintf("skip TaskManager of [%s], %s", baseServerURL, err.Error())).Fire()
+			recorder.addFailure(internal.GetTaskManagersURL(baseServerURL), err)
+			continue
+		}
+		validIDs = append(validIDs, _taskManagerID)
+	}
+	recorder.setTaskManagerIDs(validIDs)
 
-	if taskManagerIDs == nil || len(taskManagerIDs) == 0 {
+	if len(validIDs) == 0 {
 		logger.Warn().String("No valid TaskManagers found", baseServerURL).Fire()
 		return
 	}
 
-	for _, _taskManagerID := range taskManagerIDs {
+	for _, _taskManagerID := range validIDs {
 		apiURL := internal.GetTaskManagerLogsURL(baseServerURL, _taskManagerID)
-		fileToUpload, err := internal.SelectLogFileToUpload(logger, apiURL)
+		fileToUpload, err := internal.SelectLogFileToUpload(ctx, apiURL)
 		if err != nil {
 			logger.Error().Error("failed to select log file to Upload", err).Fire()
+			recorder.addFailure(apiURL, err)
 			continue
 		}
 
 		fileName := fileToUpload.Name
 		if fileName == "" {
 			logger.Warn().Msg(fmt.Sprintf("no valid file found for [%s]", apiURL)).Fire()
+			recorder.addFailure(apiURL, errNoValidLogFile)
+			continue
+		}
+		if err := internal.CheckFlinkName(fileName, internal.FileNameRegexp); err != nil {
+			logger.Warn().Msg(fmt.Sprintf("skip file of [%s], %s", apiURL, err.Error())).Fire()
+			recorder.addFailure(apiURL, err)
 			continue
 		}
 
 		finalFileURL := internal.GetTaskManagerLogFileURL(baseServerURL, _taskManagerID, fileName)
 		finalDestPath := GetTaskManagerFilePathInHDFS(destPrePath, fileName, _taskManagerID)
-		go func() {
-			_ = saveFile(finalFileURL, finalDestPath)
-		}()
+		recorder.saveFile(finalFileURL, finalDestPath, fileToUpload.Size)
 	}
 
 	return
 }
 
-func saveFile(fileURL, destFullPath string) (err error) {
+// saveFile downloads fileURL into destFullPath, the size and checksum of the stored content are set in file.
+// It's run in the background, ctx is the context of the upload registered by uploadTracker.start.
+func saveFile(ctx context.Context, fileURL, destFullPath string, file *internal.ManifestFile) (err error) {
+	logger := glog.FromContext(ctx)
 	logger.Info().Msg(fmt.Sprintf("begin to save file from [%s] to [%s]", fileURL, destFullPath)).Fire()
-	hdfsClient, err := internal.GetClient(HdfsServerConfig)
+	span, ctx := internal.StartFollowsFromSpan(ctx, "upload file")
+	span.SetTag("flink.url", fileURL)
+	span.SetTag("hdfs.path", destFullPath)
+	startTime := time.Now()
+	defer func() {
+		observeUpload(destFullPath, file.Size, startTime, err)
+		internal.FinishSpan(span, err)
+	}()
+
+	// the instance dir is not compacted or removed while the file is written
+	if spaceID, flowID, instID, _, ok := internal.ParseHdfsLogFilePath(destFullPath); ok {
+		unlockDir := lockDir(internal.GetHdfsInstanceDirPath(spaceID, flowID, instID), false)
+		defer unlockDir()
+	}
+	// the upload is canceled while waiting for the lock if its logs are deleted
+	if err = ctx.Err(); err != nil {
+		logger.Info().Msg(fmt.Sprintf("upload to [%s] canceled", destFullPath)).Fire()
+		return
+	}
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
 	if err != nil {
 		logger.Error().Error("failed to create HDFS client", err).Fire()
 		return
@@ -236,17 +354,17 @@ func saveFile(fileURL, destFullPath string) (err error) {
 		return
 	}
 
-	hdfsWriter, err := hdfsClient.Create(destFullPath)
+	hdfsWriter, err := internal.CreateFile(ctx, hdfsClient, destFullPath)
 	if err != nil {
 		if os.IsExist(err) {
 			logger.Info().Msg(fmt.Sprintf("[%s] exist, try to remove and recreate it..", destFullPath)).Fire()
-			err = hdfsClient.Remove(destFullPath)
+			err = internal.RemoveFile(ctx, hdfsClient, destFullPath)
 			if err != nil {
 				logger.Error().Msg(fmt.Sprintf("remove file [%s] failed", destFullPath)).Fire()
 				return
 			}
 
-			hdfsWriter, err = hdfsClient.Create(destFullPath)
+			hdfsWriter, err = internal.CreateFile(ctx, hdfsClient, destFullPath)
 			if err != nil {
 				logger.Error().Msg(fmt.Sprintf("recreate [%s] failed", destFullPath)).Fire()
 				return
@@ -259,20 +377,147 @@ func saveFile(fileURL, destFullPath string) (err error) {
 	}
 
 	defer hdfsWriter.Close()
-	err = internal.DownloadSelectedFile(logger, fileURL, hdfsWriter)
-	if err != nil {
+
+	// the key is replaced or removed with the file, not while the keys are rewrapped
+	unlockKey := fileKeys.lock(internal.FileKeyPath(destFullPath))
+	defer unlockKey()
+
+	var contentWriter io.Writer = hdfsWriter
+	var encryptWriter *internal.EncryptWriter
+	var fileKey *internal.FileKey
+	if encryptFiles {
+		if encryptWriter, fileKey, err = encryptLogFile(hdfsClient, destFullPath, hdfsWriter); err != nil {
+			logger.Error().Msg(fmt.Sprintf("save key of [%s] failed, %s", destFullPath, err.Error())).Fire()
+			discardLogFile(ctx, hdfsClient, hdfsWriter, destFullPath)
+			return
+		}
+		contentWriter = encryptWriter
+	} else if err = removeFileKey(hdfsClient, destFullPath); err != nil {
+		logger.Error().Msg(fmt.Sprintf("remove key of [%s] failed, %s", destFullPath, err.Error())).Fire()
+		return
+	}
+
+	// build the line index and the full-text index while the file is being written
+	lineIndexBuilder := internal.NewLineIndexBuilder(internal.LineIndexInterval)
+	var fileIndexBuilder *internal.FileIndexBuilder
+	if searchIndex != nil {
+		fileIndexBuilder = internal.NewFileIndexBuilder(internal.MaxFilePositions)
+	}
+	lineWriter := internal.NewLineWriter(func(line []byte, lineNo int64, offset int64) error {
+		_ = lineIndexBuilder.AddLine(line, lineNo, offset)
+		if fileIndexBuilder != nil {
+			_ = fileIndexBuilder.AddLine(line, lineNo, offset)
+		}
+		return nil
+	})
+	hasher := sha256.New()
+	stored := &internal.CountingWriter{W: io.MultiWriter(contentWriter, hasher)}
+	var redactor *internal.Redactor
+	defer func() {
+		file.Size = stored.N
+		file.Checksum = hex.EncodeToString(hasher.Sum(nil))
+		if redactor != nil {
+			file.Redactions = redactor.Count()
+		}
+	}()
+
+	// the quota applies to what is indexed too, so the indexes match the truncated file
+	dest := io.MultiWriter(stored, lineWriter)
+	var quota *quotaWriter
+	if spaceID, flowID, _, _, ok := internal.ParseHdfsLogFilePath(destFullPath); ok {
+		if quota = newQuotaWriter(ctx, hdfsClient, dest, spaceID, flowID); quota != nil {
+			dest = quota
+		}
+	}
+	// secrets are redacted before anything is stored or indexed
+	if len(redactionRules) != 0 {
+		redactor = internal.NewRedactor(dest, redactionRules)
+		dest = redactor
+	}
+	// a file truncated by the quota is kept, indexed and recorded as truncated in the manifest
+	err = internal.DownloadSelectedFile(ctx, fileURL, dest)
+	truncated := quota != nil && quota.truncated
+	if err != nil && !truncated {
 		logger.Error().Msg(fmt.Sprintf("download file [%s] failed, %s", fileURL, err.Error())).Fire()
+		// a partial file, e.g. cut at the max log file size, is not kept
+		discardLogFile(ctx, hdfsClient, hdfsWriter, destFullPath)
 		return
 	}
+	quotaErr := err
+	if redactor != nil {
+		if err = redactor.Close(); err != nil && !truncated {
+			logger.Error().Msg(fmt.Sprintf("write the last line of [%s] failed, %s", destFullPath, err.Error())).Fire()
+			discardLogFile(ctx, hdfsClient, hdfsWriter, destFullPath)
+			return
+		}
+		if redactor.Count() != 0 {
+			logger.Info().Msg(fmt.Sprintf("[%d] secrets redacted from [%s]", redactor.Count(), destFullPath)).Fire()
+		}
+	}
+
+	if truncated {
+		file.Truncated = true
+		logger.Warn().Msg(fmt.Sprintf("file [%s] truncated by the quota, %s", destFullPath, quotaErr.Error())).Fire()
+	}
 
 	_ = hdfsWriter.Flush()
+	_ = lineWriter.Close()
+	if encryptWriter != nil {
+		if err = sealLogFile(hdfsClient, destFullPath, encryptWriter, fileKey); err != nil {
+			logger.Error().Msg(fmt.Sprintf("seal key of [%s] failed, %s", destFullPath, err.Error())).Fire()
+			// the file could never be read back with an unsealed key
+			discardLogFile(ctx, hdfsClient, hdfsWriter, destFullPath)
+			return
+		}
+	}
 	logger.Info().Msg(fmt.Sprintf("save file from [%s] to [%s] successfully!", fileURL, destFullPath)).Fire()
-	return
+	// a file that failed to save is not listed, it's replaced by the next upload
+	catalogPut(ctx, destFullPath, stored.N, hex.EncodeToString(hasher.Sum(nil)))
+
+	lineIndex := lineIndexBuilder.Index(lineWriter.Lines(), lineWriter.Written())
+	if err := saveLineIndex(hdfsClient, destFullPath, lineIndex); err != nil {
+		logger.Warn().Msg(fmt.Sprintf("save line index of [%s] failed, %s", destFullPath, err.Error())).Fire()
+	}
+	if fileIndexBuilder != nil {
+		indexLogFile(ctx, destFullPath, fileIndexBuilder)
+	}
+	return quotaErr
+}
+
+// discardLogFile removes a file that could not be saved whole, with its key.
+func discardLogFile(ctx context.Context, client *hdfs.Client, writer *internal.HdfsWriter, filePath string) {
+	logger := glog.FromContext(ctx)
+	_ = writer.Close()
+	if err := internal.RemoveFile(ctx, client, filePath); err != nil && !os.IsNotExist(err) {
+		logger.Warn().Msg(fmt.Sprintf("remove partial file [%s] failed, %s", filePath, err.Error())).Fire()
+	}
+	if err := removeFileKey(client, filePath); err != nil {
+		logger.Warn().Msg(fmt.Sprintf("remove key of partial file [%s] failed, %s", filePath, err.Error())).Fire()
+	}
+	// the bytes reserved for the file are freed
+	usages.invalidate(filePath)
 }
 
-func CheckUploadingTask(baseServerURL, destPrePath string) (*logpb.TaskStatReply, error) {
+func CheckUploadingTask(ctx context.Context, baseServerURL, destPrePath string) (reply *logpb.TaskStatReply, err error) {
+	logger := glog.FromContext(ctx)
+	defer func() {
+		switch {
+		case err != nil:
+			taskStatChecks.WithLabelValues("error").Inc()
+		case reply.Completed:
+			taskStatChecks.WithLabelValues("completed").Inc()
+		default:
+			taskStatChecks.WithLabelValues("in_progress").Inc()
+		}
+	}()
+
 	logger.Debug().Msg(fmt.Sprintf("begin to check file [%s] Size", destPrePath)).Fire()
-	jobManagerCompleted, err := CheckJobManagerLogFile(baseServerURL, destPrePath)
+
+	if err := internal.CheckServerURL(baseServerURL); err != nil {
+		return nil, flinkServerError(ctx, baseServerURL, err)
+	}
+
+	jobManagerCompleted, err := CheckJobManagerLogFile(ctx, baseServerURL, destPrePath)
 	if err != nil {
 		return nil, err
 	}
@@ -281,7 +526,7 @@ func CheckUploadingTask(baseServerURL, destPrePath string) (*logpb.TaskStatReply
 		return &logpb.TaskStatReply{Completed: false}, nil
 	}
 
-	taskManagerCompleted, err := CheckTaskManagerLogFiles(baseServerURL, destPrePath)
+	taskManagerCompleted, err := CheckTaskManagerLogFiles(ctx, baseServerURL, destPrePath)
 	if err != nil {
 		return nil, err
 	}
@@ -290,12 +535,66 @@ func CheckUploadingTask(baseServerURL, destPrePath string) (*logpb.TaskStatReply
 		return &logpb.TaskStatReply{Completed: false}, nil
 	}
 
-	return &logpb.TaskStatReply{Completed: true}, nil
+	return completedTaskStat(ctx, destPrePath), nil
 }
 
-func CheckJobManagerLogFile(baseServerURL, destPrePath string) (isCompleted bool, err error) {
+// completedTaskStat returns the stat of a completed collection with the secrets redacted
+// and the files truncated by the quota recorded in the manifest of the instance dir.
+func completedTaskStat(ctx context.Context, instDirPath string) *logpb.TaskStatReply {
+	logger := glog.FromContext(ctx)
+	reply := &logpb.TaskStatReply{Completed: true}
+	spaceID, flowID, instID, ok := internal.ParseHdfsInstanceDirPath(instDirPath)
+	if !ok {
+		return reply
+	}
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return reply
+	}
+
+	defer hdfsClient.Close()
+	m, err := readManifest(hdfsClient, spaceID, flowID, instID)
+	if err != nil {
+		logger.Warn().Msg(fmt.Sprintf("read manifest of [%s] failed, %s", instDirPath, err.Error())).Fire()
+		return reply
+	}
+	reply.Redactions = m.Redactions()
+	reply.TruncatedFiles = m.TruncatedFiles()
+	return reply
+}
+
+// checkInstanceQuota checks the quota of the space and flow of an instance dir /:space_id/:flow_id/:inst_id
+func checkInstanceQuota(ctx context.Context, instDirPath string) error {
+	if !quotaEnabled() {
+		return nil
+	}
+	logger := glog.FromContext(ctx)
+
+	spaceID, flowID, _, ok := internal.ParseHdfsInstanceDirPath(instDirPath)
+	if !ok {
+		return nil
+	}
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return err
+	}
+
+	defer hdfsClient.Close()
+	if err = checkQuota(ctx, hdfsClient, spaceID, flowID); err != nil {
+		logger.Warn().Error("check quota failed", err).Fire()
+		return err
+	}
+	return nil
+}
+
+func CheckJobManagerLogFile(ctx context.Context, baseServerURL, destPrePath string) (isCompleted bool, err error) {
+	logger := glog.FromContext(ctx)
 	apiURL := internal.GetJobManagerLogsURL(baseServerURL)
-	fileToUpload, err := internal.SelectLogFileToUpload(logger, apiURL)
+	fileToUpload, err := internal.SelectLogFileToUpload(ctx, apiURL)
 	if err != nil {
 		logger.Error().Error("failed to select log file to Upload", err).Fire()
 		return
@@ -306,21 +605,30 @@ func CheckJobManagerLogFile(baseServerURL, destPrePath string) (isCompleted bool
 		logger.Warn().Msg(fmt.Sprintf("no valid file found for [%s]", apiURL)).Fire()
 		return
 	}
+	// a file with an invalid name is never saved, there is nothing to wait for
+	if internal.CheckFlinkName(fileName, internal.FileNameRegexp) != nil {
+		return true, nil
+	}
 
 	finalDestPath := GetJobManagerFilePathInHDFS(destPrePath, fileName)
-	isCompleted, err = compareFileSize(fileToUpload.Size, finalDestPath)
+	isCompleted, err = compareFileSize(ctx, fileToUpload.Size, finalDestPath)
 	return
 }
 
-func CheckTaskManagerLogFiles(baseServerURL, destPrePath string) (bool, error) {
-	taskManagerIDs, err := internal.GetTaskManagerIDs(logger, baseServerURL)
+func CheckTaskManagerLogFiles(ctx context.Context, baseServerURL, destPrePath string) (bool, error) {
+	logger := glog.FromContext(ctx)
+	taskManagerIDs, err := internal.GetTaskManagerIDs(ctx, baseServerURL)
 	if err != nil {
 		return false, err
 	}
 
 	for _, _taskManagerID := range taskManagerIDs {
+		// the TaskManagers with an invalid id and the files with an invalid name are skipped by the upload
+		if internal.CheckFlinkName(_taskManagerID, internal.TaskManagerIDRegexp) != nil {
+			continue
+		}
 		apiURL := internal.GetTaskManagerLogsURL(baseServerURL, _taskManagerID)
-		fileToUpload, err := internal.SelectLogFileToUpload(logger, apiURL)
+		fileToUpload, err := internal.SelectLogFileToUpload(ctx, apiURL)
 		if err != nil {
 			logger.Error().Error("failed to select log file to Upload", err).Fire()
 			return false, err
@@ -331,9 +639,12 @@ func CheckTaskManagerLogFiles(baseServerURL, destPrePath string) (bool, error) {
 			logger.Warn().Msg(fmt.Sprintf("no valid file found for [%s]", apiURL)).Fire()
 			return false, nil
 		}
+		if internal.CheckFlinkName(fileName, internal.FileNameRegexp) != nil {
+			continue
+		}
 
 		finalDestPath := GetTaskManagerFilePathInHDFS(destPrePath, fileName, _taskManagerID)
-		isCompleted, err := compareFileSize(fileToUpload.Size, finalDestPath)
+		isCompleted, err := compareFileSize(ctx, fileToUpload.Size, finalDestPath)
 		if err != nil || !isCompleted {
 			return false, err
 		}
@@ -350,9 +661,10 @@ func GetTaskManagerFilePathInHDFS(destPreDirPath, fileName, taskManagerID string
 	return fmt.Sprintf("%s/logs/taskmanager/%s/%s", destPreDirPath, taskManagerID, fileName)
 }
 
-func compareFileSize(srcFileSize int64, destFullPath string) (bool, error) {
+func compareFileSize(ctx context.Context, srcFileSize int64, destFullPath string) (bool, error) {
+	logger := glog.FromContext(ctx)
 	logger.Debug().Msg(fmt.Sprintf("try to get file size of [%s]", destFullPath)).Fire()
-	hdfsClient, err := internal.GetClient(HdfsServerConfig)
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
 	if err != nil {
 		logger.Error().Error("failed to create HDFS client", err).Fire()
 		return false, err
@@ -360,7 +672,7 @@ func compareFileSize(srcFileSize int64, destFullPath string) (bool, error) {
 
 	defer hdfsClient.Close()
 
-	hdfsFileInfo, err := hdfsClient.Stat(destFullPath)
+	destFile, err := statLogFile(ctx, hdfsClient, destFullPath)
 	if os.IsNotExist(err) {
 		logger.Info().Msg(fmt.Sprintf("file [%s] not exits", destFullPath)).Fire()
 		return false, nil
@@ -371,9 +683,29 @@ func compareFileSize(srcFileSize int64, destFullPath string) (bool, error) {
 		return false, err
 	}
 
-	logger.Info().Msg(fmt.Sprintf("src file size [%d] destFile size [%d]", srcFileSize, hdfsFileInfo.Size()))
-	if hdfsFileInfo.Size() == srcFileSize {
+	logger.Info().Msg(fmt.Sprintf("src file size [%d] destFile size [%d]", srcFileSize, destFile.Size))
+	if destFile.Size == srcFileSize {
 		return true, nil
 	}
-	return false, nil
+	return recordedFileCompleted(hdfsClient, destFullPath, srcFileSize, destFile.Size), nil
+}
+
+// recordedFileCompleted reports whether the manifest recorded a file whose size differs from the source,
+// because secrets were redacted or because it was truncated by the quota, as saved from a source of srcFileSize.
+func recordedFileCompleted(client *hdfs.Client, destFullPath string, srcFileSize, destFileSize int64) bool {
+	spaceID, flowID, instID, relPath, ok := internal.ParseHdfsLogFilePath(destFullPath)
+	if !ok {
+		return false
+	}
+	m, err := readManifest(client, spaceID, flowID, instID)
+	if err != nil {
+		// the manifest is written once all the files of the instance are saved
+		return false
+	}
+	file := m.FindFile(relPath)
+	if file == nil || file.SourceSize != srcFileSize || file.Size != destFileSize {
+		return false
+	}
+	// a truncated file is recorded with the error of the quota
+	return file.Truncated || (file.Error == "" && file.Redactions != 0)
 }
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// manifestRecorder collects what is collected for an instance by UploadLogFile,
+// the manifest is written once all the files are saved.
+type manifestRecorder struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	manifest *internal.InstanceManifest
+	// the manifest is tracked as an upload from the start of the collection, so deleting the instance
+	// meanwhile cancels ctx, and with it the files not saved yet and the manifest
+	ctx          context.Context
+	finishUpload func()
+	// records the audit event of the upload call with the bytes stored
+	finishAudit func(bytes int64)
+}
+
+// newManifestRecorder returns a recorder for the instance dir /:space_id/:flow_id/:inst_id,
+// finish must be called once all the files are passed to saveFile.
+func newManifestRecorder(ctx context.Context, baseServerURL, destPrePath string) *manifestRecorder {
+	spaceID, flowID, instID, _ := internal.ParseHdfsInstanceDirPath(destPrePath)
+	r := &manifestRecorder{
+		manifest: &internal.InstanceManifest{
+			Version:        internal.ManifestVersion,
+			SpaceID:        spaceID,
+			FlowID:         flowID,
+			InstanceID:     instID,
+			ServerURL:      baseServerURL,
+			JobIDs:         []string{},
+			TaskManagerIDs: []string{},
+			StartedAt:      time.Now(),
+		},
+	}
+	r.ctx, r.finishUpload = uploads.start(ctx, internal.GetHdfsManifestPath(spaceID, flowID, instID))
+	r.finishAudit = holdAuditEvent(ctx)
+	return r
+}
+
+func (r *manifestRecorder) addFailure(source string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifest.Failures = append(r.manifest.Failures, &internal.ManifestFailure{
+		Source: source,
+		Error:  err.Error(),
+		Time:   time.Now(),
+	})
+}
+
+func (r *manifestRecorder) setTaskManagerIDs(taskManagerIDs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifest.TaskManagerIDs = taskManagerIDs
+}
+
+// saveFile saves a file in the background and records it once saved. The upload is registered before
+// saveFile returns, so the logs deleted from then on can not be written again by it.
+func (r *manifestRecorder) saveFile(fileURL, destFullPath string, srcFileSize int64) {
+	// the upload of the file is not canceled with the recorder, check once it's registered
+	ctx, finish := uploads.start(r.ctx, destFullPath)
+	if r.ctx.Err() != nil {
+		finish()
+		glog.FromContext(r.ctx).Info().Msg(fmt.Sprintf("collection canceled, skip file [%s]", fileURL)).Fire()
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer finish()
+		file := &internal.ManifestFile{SourceURL: fileURL, SourceSize: srcFileSize}
+		if _, _, _, relPath, ok := internal.ParseHdfsLogFilePath(destFullPath); ok {
+			file.Path = relPath
+		}
+		if err := saveFile(ctx, fileURL, destFullPath, file); err != nil {
+			file.Error = err.Error()
+		}
+		file.CollectedAt = time.Now()
+
+		r.mu.Lock()
+		r.manifest.Files = append(r.manifest.Files, file)
+		r.mu.Unlock()
+	}()
+}
+
+// finish waits for the files to be saved and writes the manifest, unless the collection was canceled.
+func (r *manifestRecorder) finish() (err error) {
+	defer r.finishUpload()
+	r.wg.Wait()
+	r.manifest.FinishedAt = time.Now()
+	var stored int64
+	for _, file := range r.manifest.Files {
+		stored += file.Size
+	}
+	defer r.finishAudit(stored)
+	ctx := r.ctx
+	logger := glog.FromContext(ctx)
+	if ctx.Err() != nil {
+		logger.Info().Msg(fmt.Sprintf("collection of [%s/%s/%s] canceled, manifest not written",
+			r.manifest.SpaceID, r.manifest.FlowID, r.manifest.InstanceID)).Fire()
+		return ctx.Err()
+	}
+	span, ctx := internal.StartFollowsFromSpan(ctx, "write manifest")
+	defer func() {
+		internal.FinishSpan(span, err)
+	}()
+
+	m := r.manifest
+	manifestPath := internal.GetHdfsManifestPath(m.SpaceID, m.FlowID, m.InstanceID)
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return
+	}
+
+	defer hdfsClient.Close()
+	if err = writeManifest(hdfsClient, manifestPath, m); err != nil {
+		logger.Error().Msg(fmt.Sprintf("write manifest [%s] failed, %s", manifestPath, err.Error())).Fire()
+		return
+	}
+	logger.Info().Msg(fmt.Sprintf("manifest [%s] written, [%d] files [%d] failures", manifestPath, len(m.Files), len(m.Failures))).Fire()
+	return nil
+}
+
+// writeManifest writes the manifest of an instance, an existing manifest is replaced.
+func writeManifest(client *hdfs.Client, manifestPath string, m *internal.InstanceManifest) error {
+	instDirPath := internal.GetHdfsInstanceDirPath(m.SpaceID, m.FlowID, m.InstanceID)
+	if err := client.MkdirAll(instDirPath, 0755); err != nil {
+		return err
+	}
+	if err := client.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	writer, err := client.Create(manifestPath)
+	if err != nil {
+		return err
+	}
+	if err = m.Encode(writer); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// GetInstanceManifest returns the manifest of what was collected for an instance.
+func GetInstanceManifest(ctx context.Context, spaceID, flowID, instID string) (*logpb.InstanceManifestReply, error) {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to get manifest of instance [%s/%s/%s]", spaceID, flowID, instID)).Fire()
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return nil, err
+	}
+
+	defer hdfsClient.Close()
+	m, err := readManifest(hdfsClient, spaceID, flowID, instID)
+	if os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("no manifest found for instance [%s/%s/%s]", spaceID, flowID, instID))
+	}
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("read manifest of instance [%s/%s/%s] failed, %s", spaceID, flowID, instID, err.Error())).Fire()
+		return nil, err
+	}
+	return toInstanceManifestReply(m), nil
+}
+
+func readManifest(client *hdfs.Client, spaceID, flowID, instID string) (*internal.InstanceManifest, error) {
+	f, err := client.Open(internal.GetHdfsManifestPath(spaceID, flowID, instID))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return internal.DecodeInstanceManifest(f)
+}
+
+func toInstanceManifestReply(m *internal.InstanceManifest) *logpb.InstanceManifestReply {
+	reply := &logpb.InstanceManifestReply{
+		SpaceId:        m.SpaceID,
+		FlowId:         m.FlowID,
+		InstanceId:     m.InstanceID,
+		ServerUrl:      m.ServerURL,
+		FlinkVersion:   m.FlinkVersion,
+		JobIds:         m.JobIDs,
+		TaskManagerIds: m.TaskManagerIDs,
+		StartedAt:      internal.UnixMilli(m.StartedAt),
+		FinishedAt:     internal.UnixMilli(m.FinishedAt),
+	}
+	for _, file := range m.Files {
+		reply.Files = append(reply.Files, &logpb.ManifestFile{
+			Path:        file.Path,
+			SourceUrl:   file.SourceURL,
+			SourceSize:  file.SourceSize,
+			Size:        file.Size,
+			Checksum:    file.Checksum,
+			Redactions:  file.Redactions,
+			Truncated:   file.Truncated,
+			CollectedAt: internal.UnixMilli(file.CollectedAt),
+			Error:       file.Error,
+		})
+	}
+	for _, failure := range m.Failures {
+		reply.Failures = append(reply.Failures, &logpb.ManifestFailure{
+			Source: failure.Source,
+			Error:  failure.Error,
+			Time:   internal.UnixMilli(failure.Time),
+		})
+	}
+	return reply
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"strings"
+	"time"
+
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "logmanager"
+
+var (
+	retentionRemovedInstances = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "retention",
+		Name:      "removed_instances_total",
+		Help:      "Number of instance log dirs removed by the retention sweeper.",
+	}, []string{"reason", "dry_run"})
+
+	retentionRemovedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "retention",
+		Name:      "removed_bytes_total",
+		Help:      "Bytes of instance logs removed by the retention sweeper.",
+	}, []string{"reason", "dry_run"})
+
+	retentionSweepDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "retention",
+		Name:      "sweep_duration_seconds",
+		Help:      "Duration of retention sweeps.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	retentionSweepErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "retention",
+		Name:      "sweep_errors_total",
+		Help:      "Number of errors occurred during retention sweeps.",
+	})
+
+	compactedInstances = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "compaction",
+		Name:      "compacted_instances_total",
+		Help:      "Number of instance log dirs packed into an archive.",
+	})
+
+	compactedFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "compaction",
+		Name:      "compacted_files_total",
+		Help:      "Number of files packed into instance archives.",
+	})
+
+	compactionErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "compaction",
+		Name:      "errors_total",
+		Help:      "Number of errors occurred during compactions.",
+	})
+
+	auditWrittenEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "audit",
+		Name:      "written_events_total",
+		Help:      "Number of audit events written to the audit sink.",
+	})
+
+	auditDroppedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "audit",
+		Name:      "dropped_events_total",
+		Help:      "Number of audit events dropped because the audit sink kept failing.",
+	})
+
+	auditWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "audit",
+		Name:      "write_errors_total",
+		Help:      "Number of failed writes to the audit sink.",
+	})
+
+	uploadedFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "upload",
+		Name:      "files_total",
+		Help:      "Number of log files collected from Flink into HDFS, by space (if enabled), manager and result.",
+	}, []string{"space", "manager", "result"})
+
+	uploadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "upload",
+		Name:      "bytes_total",
+		Help:      "Bytes of log files collected from Flink into HDFS, by space (if enabled) and manager.",
+	}, []string{"space", "manager"})
+
+	uploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "upload",
+		Name:      "duration_seconds",
+		Help:      "Duration of the collection of a log file from Flink into HDFS.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"manager"})
+
+	uploadsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "upload",
+		Name:      "in_flight",
+		Help:      "Number of log files being collected from Flink into HDFS.",
+	})
+
+	taskStatChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "upload",
+		Name:      "task_stat_checks_total",
+		Help:      "Outcomes of GetUploadingTaskStat: completed, in_progress or error.",
+	}, []string{"outcome"})
+
+	downloadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "download",
+		Name:      "bytes_total",
+		Help:      "Bytes of log data streamed to the callers, by space (if enabled) and RPC.",
+	}, []string{"space", "rpc"})
+
+	downloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "download",
+		Name:      "duration_seconds",
+		Help:      "Duration of the downloads of log data.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"rpc", "result"})
+)
+
+// names of the rpc label of the download metrics
+const (
+	downloadRPCFile     = "file"
+	downloadRPCInstance = "instance"
+)
+
+// spaceLabel returns the value of the space label, empty unless enabled as each space adds its own series.
+func spaceLabel(spaceID string) string {
+	if metricsSpaceLabel {
+		return spaceID
+	}
+	return ""
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observeUpload records the collection of a log file into destFullPath.
+func observeUpload(destFullPath string, size int64, startTime time.Time, err error) {
+	spaceID, _, _, relPath, ok := internal.ParseHdfsLogFilePath(destFullPath)
+	if !ok {
+		return
+	}
+	manager := strings.SplitN(relPath, "/", 2)[0]
+	uploadedFiles.WithLabelValues(spaceLabel(spaceID), manager, resultLabel(err)).Inc()
+	uploadedBytes.WithLabelValues(spaceLabel(spaceID), manager).Add(float64(size))
+	uploadDuration.WithLabelValues(manager).Observe(time.Since(startTime).Seconds())
+}
+
+// observeDownload records a download of log data of a space.
+func observeDownload(spaceID, rpc string, size int64, startTime time.Time, err error) {
+	downloadedBytes.WithLabelValues(spaceLabel(spaceID), rpc).Add(float64(size))
+	downloadDuration.WithLabelValues(rpc, resultLabel(err)).Observe(time.Since(startTime).Seconds())
+}
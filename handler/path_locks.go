@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"strings"
+	"sync"
+)
+
+var (
+	// fileKeys serializes the writes of the key of a log file: a file saved again replaces or removes its key
+	// while the keys are rewrapped.
+	fileKeys = newPathLocks()
+	// dirs serializes the writes into the space, flow and instance dirs: uploads share the lock of
+	// the instance dir, the compactor and the key rewrap hold it to rewrite the archive of the instance,
+	// and deletes hold the lock of the dir they remove, see lockDir.
+	dirs = newPathLocks()
+)
+
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: make(map[string]*pathLock)}
+}
+
+// lock locks the path and returns the func unlocking it.
+func (l *pathLocks) lock(p string) (unlock func()) {
+	pl := l.acquire(p)
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.release(p, pl)
+	}
+}
+
+// rlock locks the path shared with other rlock calls and returns the func unlocking it.
+func (l *pathLocks) rlock(p string) (unlock func()) {
+	pl := l.acquire(p)
+	pl.RLock()
+	return func() {
+		pl.RUnlock()
+		l.release(p, pl)
+	}
+}
+
+func (l *pathLocks) acquire(p string) *pathLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pl, ok := l.locks[p]
+	if !ok {
+		pl = &pathLock{}
+		l.locks[p] = pl
+	}
+	pl.refs++
+	return pl
+}
+
+func (l *pathLocks) release(p string, pl *pathLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if pl.refs--; pl.refs == 0 {
+		delete(l.locks, p)
+	}
+}
+
+// lockDir locks the dir /:space_id[/:flow_id[/:inst_id]], exclusively or shared, after the shared locks of
+// its parent dirs. The locks are always taken from the top, so a dir is not written while a parent is removed.
+// The locks only serialize the writes of this process, e.g. the compactor checks the logs dir again
+// before removing it in case another replica wrote into it.
+func lockDir(dirPath string, exclusive bool) (unlock func()) {
+	dirPath = strings.TrimSuffix(dirPath, "/")
+	var unlocks []func()
+	for i := 1; i < len(dirPath); i++ {
+		if dirPath[i] == '/' {
+			unlocks = append(unlocks, dirs.rlock(dirPath[:i]))
+		}
+	}
+	if exclusive {
+		unlocks = append(unlocks, dirs.lock(dirPath))
+	} else {
+		unlocks = append(unlocks, dirs.rlock(dirPath))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/config"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// usages caches the bytes stored under the space and flow dirs, read from their content summaries,
+// the bytes written by uploads are added to the cached values until they are read again from HDFS.
+var usages = &usageCache{entries: make(map[string]*usageEntry)}
+
+type usageEntry struct {
+	bytes     int64
+	fetchedAt time.Time
+	// reserved is the total of the bytes reserved since the entry was created,
+	// the bytes reserved while the usage is read from HDFS are added to the value read
+	reserved int64
+}
+
+type usageCache struct {
+	mu      sync.Mutex
+	entries map[string]*usageEntry
+}
+
+// get returns the bytes stored under dirPath, read from HDFS if the cached value is older than ttl.
+func (c *usageCache) get(ctx context.Context, client *hdfs.Client, dirPath string, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[dirPath]
+	var reservedBefore int64
+	if ok {
+		if time.Since(entry.fetchedAt) < ttl {
+			bytes := entry.bytes
+			c.mu.Unlock()
+			return bytes, nil
+		}
+		reservedBefore = entry.reserved
+	}
+	c.mu.Unlock()
+
+	size, _, err := internal.StatDirUsage(ctx, client, dirPath)
+	if os.IsNotExist(err) {
+		size, err = 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, ok := c.entries[dirPath]
+	switch {
+	case !ok && entry == nil:
+		c.entries[dirPath] = &usageEntry{bytes: size, fetchedAt: time.Now()}
+	case ok && current == entry:
+		// the bytes written meanwhile may already be counted by HDFS, counting them twice errs on the safe side
+		current.bytes = size + current.reserved - reservedBefore
+		current.fetchedAt = time.Now()
+		return current.bytes, nil
+	case ok:
+		// another read completed meanwhile, its value includes the reservations made since
+		return current.bytes, nil
+	}
+	// the entry was invalidated during the read, which may predate the change, the next get reads it again
+	return size, nil
+}
+
+// reserve adds up to n bytes to the usage of the dirs without exceeding their limits (0 means no limit),
+// returns the bytes reserved. ok is false and nothing is reserved if the usage of a limited dir is not cached,
+// it must be read with get first.
+func (c *usageCache) reserve(n int64, dirs []string, limits []int64) (reserved int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	allowed := n
+	for i, dir := range dirs {
+		if limits[i] <= 0 {
+			continue
+		}
+		entry, ok := c.entries[dir]
+		if !ok {
+			return 0, false
+		}
+		if remaining := limits[i] - entry.bytes; remaining < allowed {
+			allowed = remaining
+		}
+	}
+	if allowed < 0 {
+		allowed = 0
+	}
+
+	for _, dir := range dirs {
+		entry, ok := c.entries[dir]
+		if !ok {
+			// a zero fetchedAt makes the next get read the usage from HDFS
+			entry = &usageEntry{}
+			c.entries[dir] = entry
+		}
+		entry.bytes += allowed
+		entry.reserved += allowed
+	}
+	return allowed, true
+}
+
+// invalidate drops the cached usage of dirPath, of the dirs under it and of its parents.
+func (c *usageCache) invalidate(dirPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key+"/", dirPath+"/") || strings.HasPrefix(dirPath+"/", key+"/") {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func quotaEnabled() bool {
+	return quotaConfig != nil && quotaConfig.Enabled
+}
+
+// spaceQuota returns the quota of a space, the default one if it has no override.
+func spaceQuota(spaceID string) *config.StorageQuota {
+	if quota, ok := quotaOverrides[spaceID]; ok {
+		return quota
+	}
+	return quotaConfig.Default
+}
+
+func usageCacheTTL() time.Duration {
+	if quotaEnabled() {
+		return quotaConfig.UsageCacheTTL
+	}
+	return 0
+}
+
+// checkQuota returns a ResourceExhausted error if the space or the flow has used up its quota.
+func checkQuota(ctx context.Context, client *hdfs.Client, spaceID, flowID string) error {
+	if !quotaEnabled() {
+		return nil
+	}
+
+	quota := spaceQuota(spaceID)
+	if quota.MaxBytesPerSpace > 0 {
+		used, err := usages.get(ctx, client, internal.GetHdfsSpaceDirPath(spaceID), quotaConfig.UsageCacheTTL)
+		if err != nil {
+			return err
+		}
+		if used >= quota.MaxBytesPerSpace {
+			return status.Error(codes.ResourceExhausted, fmt.Sprintf("space [%s] has used [%d] bytes of its quota [%d], log collection is stopped",
+				spaceID, used, quota.MaxBytesPerSpace))
+		}
+	}
+	if quota.MaxBytesPerFlow > 0 {
+		used, err := usages.get(ctx, client, internal.GetHdfsFlowDirPath(spaceID, flowID), quotaConfig.UsageCacheTTL)
+		if err != nil {
+			return err
+		}
+		if used >= quota.MaxBytesPerFlow {
+			return status.Error(codes.ResourceExhausted, fmt.Sprintf("flow [%s/%s] has used [%d] bytes of its quota [%d], log collection is stopped",
+				spaceID, flowID, used, quota.MaxBytesPerFlow))
+		}
+	}
+	return nil
+}
+
+// quotaWriter stops writing once the quota of the space or the flow is reached,
+// the data written until then is kept so the file is truncated at the quota.
+type quotaWriter struct {
+	w       io.Writer
+	ctx     context.Context
+	client  *hdfs.Client
+	spaceID string
+	flowID  string
+	dirs    []string
+	limits  []int64
+	// truncated is set once a write is refused
+	truncated bool
+}
+
+// newQuotaWriter returns nil if quotas are disabled.
+func newQuotaWriter(ctx context.Context, client *hdfs.Client, w io.Writer, spaceID, flowID string) *quotaWriter {
+	if !quotaEnabled() {
+		return nil
+	}
+	quota := spaceQuota(spaceID)
+	return &quotaWriter{
+		w:       w,
+		ctx:     ctx,
+		client:  client,
+		spaceID: spaceID,
+		flowID:  flowID,
+		dirs:    []string{internal.GetHdfsSpaceDirPath(spaceID), internal.GetHdfsFlowDirPath(spaceID, flowID)},
+		limits:  []int64{quota.MaxBytesPerSpace, quota.MaxBytesPerFlow},
+	}
+}
+
+// max number of times the usages are read again when they are invalidated before the bytes can be reserved
+const maxUsageReads = 3
+
+func (q *quotaWriter) Write(p []byte) (n int, err error) {
+	allowed, ok := usages.reserve(int64(len(p)), q.dirs, q.limits)
+	for i := 0; !ok && i < maxUsageReads; i++ {
+		for j, dir := range q.dirs {
+			if q.limits[j] <= 0 {
+				continue
+			}
+			if _, err = usages.get(q.ctx, q.client, dir, quotaConfig.UsageCacheTTL); err != nil {
+				return 0, fmt.Errorf("read usage of [%s] failed, %w", dir, err)
+			}
+		}
+		allowed, ok = usages.reserve(int64(len(p)), q.dirs, q.limits)
+	}
+	if !ok {
+		// a usage that can not be known does not let anything past the quota
+		return 0, status.Error(codes.Unavailable, fmt.Sprintf("usage of [%s/%s] is unknown", q.spaceID, q.flowID))
+	}
+
+	if allowed > 0 {
+		if n, err = q.w.Write(p[:allowed]); err != nil {
+			return
+		}
+	}
+	if int(allowed) < len(p) {
+		q.truncated = true
+		err = status.Error(codes.ResourceExhausted, fmt.Sprintf("quota of [%s/%s] exceeded, file truncated", q.spaceID, q.flowID))
+	}
+	return
+}
+
+// GetStorageUsage returns the bytes stored by a space, and by a flow if flowID is set, with their quotas.
+func GetStorageUsage(ctx context.Context, spaceID, flowID string) (*logpb.StorageUsageReply, error) {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to get storage usage of [%s/%s]", spaceID, flowID)).Fire()
+	if spaceID == "" {
+		return nil, status.Error(codes.InvalidArgument, "space id is required")
+	}
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return nil, err
+	}
+
+	defer hdfsClient.Close()
+	reply := &logpb.StorageUsageReply{SpaceId: spaceID, FlowId: flowID}
+	if quotaEnabled() {
+		quota := spaceQuota(spaceID)
+		reply.SpaceQuota = quota.MaxBytesPerSpace
+		reply.FlowQuota = quota.MaxBytesPerFlow
+	}
+
+	reply.SpaceBytes, err = usages.get(ctx, hdfsClient, internal.GetHdfsSpaceDirPath(spaceID), usageCacheTTL())
+	if err != nil {
+		logger.Error().Error("failed to get space usage", err).Fire()
+		return nil, err
+	}
+	if flowID != "" {
+		reply.FlowBytes, err = usages.get(ctx, hdfsClient, internal.GetHdfsFlowDirPath(spaceID, flowID), usageCacheTTL())
+		if err != nil {
+			logger.Error().Error("failed to get flow usage", err).Fire()
+			return nil, err
+		}
+	}
+	return reply, nil
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuotaWriter(t *testing.T) {
+	tests := []struct {
+		name       string
+		spaceUsed  int64
+		spaceLimit int64
+		flowUsed   int64
+		flowLimit  int64
+		writes     []string
+		written    string
+		truncated  bool
+	}{
+		{"below the limit", 0, 10, 0, 0, []string{"12345", "678"}, "12345678", false},
+		{"at the exact limit", 0, 10, 0, 0, []string{"12345", "67890"}, "1234567890", false},
+		{"past the limit", 0, 10, 0, 0, []string{"12345", "67890", "x"}, "1234567890", true},
+		{"within a write", 8, 10, 0, 0, []string{"abcd"}, "ab", true},
+		{"limit already reached", 10, 10, 0, 0, []string{"abcd"}, "", true},
+		{"flow limit", 0, 10, 2, 5, []string{"abcd"}, "abc", true},
+		{"no limit", 100, 0, 100, 0, []string{"abcd"}, "abcd", false},
+	}
+	defer func(prev *usageCache) { usages = prev }(usages)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spaceDir, flowDir := "/space", "/space/flow"
+			usages = &usageCache{entries: map[string]*usageEntry{
+				spaceDir: {bytes: tt.spaceUsed, fetchedAt: time.Now()},
+				flowDir:  {bytes: tt.flowUsed, fetchedAt: time.Now()},
+			}}
+			var buf bytes.Buffer
+			q := &quotaWriter{
+				w:       &buf,
+				ctx:     context.Background(),
+				spaceID: "space",
+				flowID:  "flow",
+				dirs:    []string{spaceDir, flowDir},
+				limits:  []int64{tt.spaceLimit, tt.flowLimit},
+			}
+
+			var err error
+			for _, w := range tt.writes {
+				if _, err = q.Write([]byte(w)); err != nil {
+					break
+				}
+			}
+			require.Equal(t, tt.written, buf.String())
+			require.Equal(t, tt.truncated, q.truncated)
+			if tt.truncated {
+				require.Equal(t, codes.ResourceExhausted, status.Code(err), "%v", err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.spaceUsed+int64(len(tt.written)), usages.entries[spaceDir].bytes)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// relFile is a file of the logs dir of an instance known without reading the dir from the NameNode,
+// e.g. a member of the instance archive, path is relative to the logs dir.
+type relFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// relFileInfo describes a file or a dir of the logs dir built from relFiles.
+type relFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi *relFileInfo) Name() string       { return fi.name }
+func (fi *relFileInfo) Size() int64        { return fi.size }
+func (fi *relFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *relFileInfo) IsDir() bool        { return fi.isDir }
+func (fi *relFileInfo) Sys() interface{}   { return nil }
+
+func (fi *relFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// readRelDir returns the files and dirs directly under relDir, e.g. "taskmanager",
+// the mtime of a dir is the newest mtime of the files under it.
+func readRelDir(relDir string, files []*relFile) []os.FileInfo {
+	var (
+		fileInfos []os.FileInfo
+		dirs      = make(map[string]*relFileInfo)
+		prefix    = relDir + "/"
+	)
+	for _, file := range files {
+		if !strings.HasPrefix(file.path, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(file.path, prefix)
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i]
+			dir, exists := dirs[name]
+			if !exists {
+				dir = &relFileInfo{name: name, isDir: true}
+				dirs[name] = dir
+				fileInfos = append(fileInfos, dir)
+			}
+			if file.modTime.After(dir.modTime) {
+				dir.modTime = file.modTime
+			}
+			continue
+		}
+		fileInfos = append(fileInfos, &relFileInfo{name: name, size: file.size, modTime: file.modTime})
+	}
+	return fileInfos
+}
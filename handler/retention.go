@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/logmanager/config"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+const (
+	retentionReasonMaxAge       = "max_age"
+	retentionReasonMaxInstances = "max_instances_per_flow"
+	retentionReasonMaxBytes     = "max_bytes_per_space"
+)
+
+type expiredInstance struct {
+	*instanceDir
+	Size   int64
+	Reason string
+}
+
+// RunRetentionSweeper removes the instance logs exceeding the retention policies
+// every cfg.Interval until ctx is done.
+func RunRetentionSweeper(ctx context.Context, cfg *config.RetentionConfig) {
+	logger := glog.FromContext(ctx)
+	logger.Info().Msg(fmt.Sprintf("retention sweeper started, interval [%s] dry run [%t]", cfg.Interval, cfg.DryRun)).Fire()
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		sweepRetention(ctx, cfg)
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("retention sweeper stopped").Fire()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sweepRetention(ctx context.Context, cfg *config.RetentionConfig) {
+	logger := glog.FromContext(ctx)
+	startTime := time.Now()
+	defer func() {
+		retentionSweepDuration.Observe(time.Since(startTime).Seconds())
+	}()
+
+	// a broken overrides file may protect some spaces, so skip the sweep instead of applying the default policy
+	overrides, err := config.LoadRetentionOverrides(cfg.OverridesFile)
+	if err != nil {
+		retentionSweepErrors.Inc()
+		logger.Error().Error("load retention overrides failed, skip the sweep", err).Fire()
+		return
+	}
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		retentionSweepErrors.Inc()
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return
+	}
+
+	defer hdfsClient.Close()
+	spaceInfos, err := internal.StatFilesInDir(ctx, hdfsClient, "/")
+	if err != nil {
+		retentionSweepErrors.Inc()
+		logger.Error().Error("failed to list spaces", err).Fire()
+		return
+	}
+
+	var removedCount, removedBytes int64
+	for _, spaceInfo := range spaceInfos {
+		if ctx.Err() != nil {
+			return
+		}
+		if !spaceInfo.IsDir() || internal.IsHiddenFile(spaceInfo.Name()) {
+			continue
+		}
+
+		spaceID := spaceInfo.Name()
+		policy := cfg.Policy
+		if override, ok := overrides[spaceID]; ok {
+			policy = override
+		}
+		if policy.MaxAge == 0 && policy.MaxInstancesPerFlow == 0 && policy.MaxBytesPerSpace == 0 {
+			continue
+		}
+
+		expired, err := selectExpiredInstances(ctx, hdfsClient, spaceID, policy, startTime)
+		if err != nil {
+			retentionSweepErrors.Inc()
+			logger.Error().Msg(fmt.Sprintf("select expired instances of space [%s] failed, %s", spaceID, err.Error())).Fire()
+			continue
+		}
+
+		for _, inst := range expired {
+			if ctx.Err() != nil {
+				return
+			}
+			removed, err := removeExpiredInstance(ctx, hdfsClient, inst, cfg.DryRun)
+			if err != nil {
+				retentionSweepErrors.Inc()
+				continue
+			}
+			if !removed {
+				continue
+			}
+			removedCount++
+			removedBytes += inst.Size
+		}
+	}
+
+	logger.Info().Msg(fmt.Sprintf("retention sweep finished in [%s], removed [%d] instances [%d] bytes, dry run [%t]",
+		time.Since(startTime), removedCount, removedBytes, cfg.DryRun)).Fire()
+}
+
+// selectExpiredInstances applies the policy to the instances of a space,
+// the oldest instances are removed first when a space exceeds MaxBytesPerSpace.
+func selectExpiredInstances(ctx context.Context, client *hdfs.Client, spaceID string, policy *config.RetentionPolicy, now time.Time) ([]*expiredInstance, error) {
+	instDirs, err := listInstanceDirs(ctx, client, spaceID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		expired   []*expiredInstance
+		kept      []*expiredInstance
+		keptBytes int64
+		perFlow   = make(map[string]int)
+	)
+	for _, instDir := range instDirs {
+		inst := &expiredInstance{instanceDir: instDir}
+		dirPath := internal.GetHdfsInstanceDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+		if inst.Size, _, err = internal.StatDirUsage(ctx, client, dirPath); err != nil {
+			return nil, err
+		}
+
+		// instDirs are ordered from the newest to the oldest
+		perFlow[instDir.FlowID]++
+		switch {
+		case policy.MaxAge > 0 && now.Sub(instDir.ModTime) > policy.MaxAge:
+			inst.Reason = retentionReasonMaxAge
+			expired = append(expired, inst)
+		case policy.MaxInstancesPerFlow > 0 && perFlow[instDir.FlowID] > policy.MaxInstancesPerFlow:
+			inst.Reason = retentionReasonMaxInstances
+			expired = append(expired, inst)
+		default:
+			kept = append(kept, inst)
+			keptBytes += inst.Size
+		}
+	}
+
+	if policy.MaxBytesPerSpace > 0 {
+		sort.SliceStable(kept, func(i, j int) bool {
+			return kept[i].ModTime.Before(kept[j].ModTime)
+		})
+		for _, inst := range kept {
+			if keptBytes <= policy.MaxBytesPerSpace {
+				break
+			}
+			inst.Reason = retentionReasonMaxBytes
+			expired = append(expired, inst)
+			keptBytes -= inst.Size
+		}
+	}
+	return expired, nil
+}
+
+// removeExpiredInstance removes the logs of an instance, removed is false if the dir was skipped.
+func removeExpiredInstance(ctx context.Context, client *hdfs.Client, inst *expiredInstance, dryRun bool) (removed bool, err error) {
+	logger := glog.FromContext(ctx)
+	dirPath := internal.GetHdfsInstanceDirPath(inst.SpaceID, inst.FlowID, inst.InstanceID)
+
+	// the archive shares the HDFS root with other applications,
+	// so only remove dirs that look like an instance of the archive layout
+	if !isInstanceLogDir(ctx, client, inst.SpaceID, inst.FlowID, inst.InstanceID) {
+		logger.Warn().Msg(fmt.Sprintf("[%s] is not an instance log dir, skip it", dirPath)).Fire()
+		return false, nil
+	}
+
+	dryRunLabel := strconv.FormatBool(dryRun)
+	if dryRun {
+		logger.Info().Msg(fmt.Sprintf("retention dry run: would remove [%s] reason [%s] size [%d]",
+			dirPath, inst.Reason, inst.Size)).Fire()
+	} else {
+		if err = internal.RemoveDir(ctx, client, dirPath); err != nil {
+			logger.Error().Msg(fmt.Sprintf("retention remove [%s] failed, %s", dirPath, err.Error())).Fire()
+			return false, err
+		}
+		usages.invalidate(dirPath)
+		catalogDelete(ctx, inst.SpaceID, inst.FlowID, inst.InstanceID)
+		if searchIndex != nil {
+			if err = searchIndex.Remove(inst.SpaceID, inst.FlowID, inst.InstanceID); err != nil {
+				logger.Warn().Msg(fmt.Sprintf("remove index segment of [%s] failed, %s", dirPath, err.Error())).Fire()
+			}
+		}
+		logger.Info().Msg(fmt.Sprintf("retention removed [%s] reason [%s] size [%d]", dirPath, inst.Reason, inst.Size)).Fire()
+	}
+
+	retentionRemovedInstances.WithLabelValues(inst.Reason, dryRunLabel).Inc()
+	retentionRemovedBytes.WithLabelValues(inst.Reason, dryRunLabel).Add(float64(inst.Size))
+	return true, nil
+}
+
+// isInstanceLogDir reports whether the instance dir has a logs dir or has been compacted into an archive.
+func isInstanceLogDir(ctx context.Context, client *hdfs.Client, spaceID, flowID, instID string) bool {
+	if logsInfo, err := internal.StatFile(ctx, client, internal.GetHdfsLogsDirPath(spaceID, flowID, instID)); err == nil {
+		return logsInfo.IsDir()
+	}
+	_, err := internal.StatFile(ctx, client, internal.GetHdfsArchiveIndexPath(spaceID, flowID, instID))
+	return err == nil
+}
@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// max number of instances searched at the same time
+	searchParallelism = 8
+	// max length of a matched line returned
+	maxHitTextLength = 4096
+)
+
+// instanceDir is an instance dir in the archive layout /:space_id/:flow_id/:inst_id
+type instanceDir struct {
+	SpaceID    string
+	FlowID     string
+	InstanceID string
+	ModTime    time.Time
+}
+
+// listInstanceDirs returns the instance dirs of a flow, or of all flows of the space if flowID is empty,
+// ordered from the newest to the oldest, then by flow and instance id.
+func listInstanceDirs(ctx context.Context, client *hdfs.Client, spaceID, flowID string) ([]*instanceDir, error) {
+	var flowIDs []string
+	if flowID != "" {
+		flowIDs = []string{flowID}
+	} else {
+		flowInfos, err := internal.StatFilesInDir(ctx, client, internal.GetHdfsSpaceDirPath(spaceID))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, flowInfo := range flowInfos {
+			if flowInfo.IsDir() && !internal.IsHiddenFile(flowInfo.Name()) {
+				flowIDs = append(flowIDs, flowInfo.Name())
+			}
+		}
+	}
+
+	var result []*instanceDir
+	for _, _flowID := range flowIDs {
+		instInfos, err := internal.StatFilesInDir(ctx, client, internal.GetHdfsFlowDirPath(spaceID, _flowID))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, instInfo := range instInfos {
+			if !instInfo.IsDir() || internal.IsHiddenFile(instInfo.Name()) {
+				continue
+			}
+			result = append(result, &instanceDir{
+				SpaceID:    spaceID,
+				FlowID:     _flowID,
+				InstanceID: instInfo.Name(),
+				ModTime:    instInfo.ModTime(),
+			})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if !a.ModTime.Equal(b.ModTime) {
+			return a.ModTime.After(b.ModTime)
+		}
+		if a.FlowID != b.FlowID {
+			return a.FlowID < b.FlowID
+		}
+		return a.InstanceID < b.InstanceID
+	})
+	return result, nil
+}
+
+// SearchLogs matches pattern against every line of all instances of a flow, or of all flows of a space
+// if flowID is empty, and streams the hits grouped by instance. At most limit hits are sent.
+func SearchLogs(ctx context.Context, spaceID, flowID, pattern string, limit int32, stream logpb.LogManager_SearchLogsServer) error {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to search [%s] in [%s/%s]", pattern, spaceID, flowID)).Fire()
+	if spaceID == "" || pattern == "" {
+		return status.Error(codes.InvalidArgument, "space id and pattern are required")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid pattern, %s", err.Error()))
+	}
+
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	} else if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return err
+	}
+
+	defer hdfsClient.Close()
+	instDirs, err := listInstanceDirs(ctx, hdfsClient, spaceID, flowID)
+	if err != nil {
+		logger.Error().Error("failed to list instance dirs", err).Fire()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		remaining = int(limit)
+	)
+	// take reserves a hit, false if the limit has been reached
+	take := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if remaining == 0 {
+			return false
+		}
+		remaining--
+		if remaining == 0 {
+			cancel()
+		}
+		return true
+	}
+
+	instCh := make(chan *instanceDir)
+	replyCh := make(chan *logpb.SearchLogsReply)
+	errCh := make(chan error, searchParallelism)
+
+	var wg sync.WaitGroup
+	for i := 0; i < searchParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for instDir := range instCh {
+				reply, err := searchInstance(ctx, hdfsClient, instDir, re, take)
+				if err != nil {
+					errCh <- err
+					cancel()
+					return
+				}
+				// replyCh is drained until closed, so the hits taken before
+				// reaching the limit are still sent after ctx is canceled
+				if len(reply.Hits) != 0 {
+					replyCh <- reply
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(instCh)
+		for _, instDir := range instDirs {
+			select {
+			case instCh <- instDir:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(replyCh)
+	}()
+
+	for reply := range replyCh {
+		if err == nil {
+			if err = stream.Send(reply); err != nil {
+				logger.Error().Error("stream Send data failed", err).Fire()
+				cancel()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err = <-errCh:
+		logger.Error().Error("search logs failed", err).Fire()
+		return err
+	default:
+	}
+	return stream.Context().Err()
+}
+
+func searchInstance(ctx context.Context, client *hdfs.Client, instDir *instanceDir, re *regexp.Regexp,
+	take func() bool) (*logpb.SearchLogsReply, error) {
+	reply := &logpb.SearchLogsReply{
+		SpaceId:      instDir.SpaceID,
+		FlowId:       instDir.FlowID,
+		InstanceId:   instDir.InstanceID,
+		InstanceTime: internal.UnixMilli(instDir.ModTime),
+	}
+
+	logFiles, err := listInstanceLogFiles(ctx, client, instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, logFile := range logFiles {
+		if ctx.Err() != nil {
+			return reply, nil
+		}
+
+		reader, err := openLogFile(ctx, client, logFile)
+		if err != nil {
+			return nil, err
+		}
+
+		relPath := logFile.RelPath()
+		err = internal.ScanLines(reader, func(line []byte, lineNo int64, _ int64) error {
+			if ctx.Err() != nil {
+				return errStopScan
+			}
+			if !re.Match(line) {
+				return nil
+			}
+			if !take() {
+				return errStopScan
+			}
+			if len(line) > maxHitTextLength {
+				line = line[:maxHitTextLength]
+			}
+			reply.Hits = append(reply.Hits, &logpb.SearchHit{
+				File: relPath,
+				Line: lineNo,
+				Text: string(line),
+			})
+			return nil
+		})
+		_ = reader.Close()
+		if err != nil && err != errStopScan {
+			return nil, err
+		}
+	}
+	return reply, nil
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// indexLogFile adds the postings of an uploaded log file into the full-text index.
+func indexLogFile(ctx context.Context, filePath string, builder *internal.FileIndexBuilder) {
+	logger := glog.FromContext(ctx)
+	spaceID, flowID, instID, relPath, ok := internal.ParseHdfsLogFilePath(filePath)
+	if !ok {
+		logger.Warn().Msg(fmt.Sprintf("unexpected log file path [%s], skip indexing", filePath)).Fire()
+		return
+	}
+
+	if err := searchIndex.AddFile(spaceID, flowID, instID, relPath, builder); err != nil {
+		logger.Error().Msg(fmt.Sprintf("index file [%s] failed, %s", filePath, err.Error())).Fire()
+		return
+	}
+	if builder.Truncated() {
+		logger.Warn().Msg(fmt.Sprintf("file [%s] has more than [%d] tokens, only its first lines are indexed",
+			filePath, internal.MaxFilePositions)).Fire()
+		return
+	}
+	logger.Info().Msg(fmt.Sprintf("file [%s] indexed", filePath)).Fire()
+}
+
+// QueryLogIndex searches the full-text index for lines matching the query in the scope.
+func QueryLogIndex(ctx context.Context, scope *internal.SearchScope, queryText string, limit int32) (*logpb.QueryLogIndexReply, error) {
+	logger := glog.FromContext(ctx)
+	logger.Debug().Msg(fmt.Sprintf("try to query [%s] in [%s/%s/%s]",
+		queryText, scope.SpaceID, scope.FlowID, scope.InstanceID)).Fire()
+	if searchIndex == nil {
+		return nil, status.Error(codes.FailedPrecondition, "full-text index is disabled")
+	}
+	if scope.SpaceID == "" || (scope.FlowID == "" && scope.InstanceID != "") {
+		return nil, status.Error(codes.InvalidArgument, "space id is required, and flow id is required if instance id is set")
+	}
+
+	query, err := internal.ParseSearchQuery(queryText)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	} else if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	hits, total, err := searchIndex.Search(query, scope, int(limit))
+	if errors.Is(err, internal.ErrInvalidQuery) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		logger.Error().Error("query full-text index failed", err).Fire()
+		return nil, err
+	}
+
+	reply := &logpb.QueryLogIndexReply{Total: total}
+	for _, hit := range hits {
+		reply.Hits = append(reply.Hits, &logpb.IndexHit{
+			SpaceId:    hit.SpaceID,
+			FlowId:     hit.FlowID,
+			InstanceId: hit.InstanceID,
+			File:       hit.File,
+			Line:       hit.Line,
+			Offset:     hit.Offset,
+		})
+	}
+	return reply, nil
+}
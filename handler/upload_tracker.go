@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// max time to wait for canceled uploads to stop
+const uploadCancelTimeout = 10 * time.Second
+
+// uploads tracks the files being saved into HDFS, so they can be canceled when their logs are deleted.
+var uploads = &uploadTracker{inflight: make(map[*inflightUpload]struct{})}
+
+type inflightUpload struct {
+	destPath string
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+type uploadTracker struct {
+	mu       sync.Mutex
+	inflight map[*inflightUpload]struct{}
+}
+
+// start registers an upload to destPath, finish must be called when the upload is over.
+// The upload outlives the request of parent, only its values are kept.
+func (t *uploadTracker) start(parent context.Context, destPath string) (ctx context.Context, finish func()) {
+	ctx, cancel := context.WithCancel(detachContext(parent))
+	upload := &inflightUpload{
+		destPath: destPath,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	t.inflight[upload] = struct{}{}
+	t.mu.Unlock()
+	uploadsInFlight.Inc()
+
+	finish = func() {
+		t.mu.Lock()
+		delete(t.inflight, upload)
+		t.mu.Unlock()
+		uploadsInFlight.Dec()
+		cancel()
+		close(upload.done)
+	}
+	return ctx, finish
+}
+
+// cancel stops the uploads to files under dirPath and waits until they are over, returns the number of uploads canceled.
+// It fails if the uploads are not over within uploadCancelTimeout.
+func (t *uploadTracker) cancel(dirPath string) (int, error) {
+	prefix := strings.TrimSuffix(dirPath, "/") + "/"
+
+	var canceled []*inflightUpload
+	t.mu.Lock()
+	for upload := range t.inflight {
+		if strings.HasPrefix(upload.destPath, prefix) {
+			upload.cancel()
+			canceled = append(canceled, upload)
+		}
+	}
+	t.mu.Unlock()
+
+	timeout := time.After(uploadCancelTimeout)
+	for _, upload := range canceled {
+		select {
+		case <-upload.done:
+		case <-timeout:
+			return len(canceled), fmt.Errorf("timeout waiting for [%d] canceled uploads in [%s]", len(canceled), dirPath)
+		}
+	}
+	return len(canceled), nil
+}
+
+// detachedContext keeps the values of a request context, e.g. its logger and span, but is never canceled.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+func (detachedContext) Done() <-chan struct{}                   { return nil }
+func (detachedContext) Err() error                              { return nil }
+
+// detachContext returns a context for a task started by a request that goes on after the request is over.
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{Context: ctx}
+}
+
+// busy reports whether files under dirPath are being uploaded.
+func (t *uploadTracker) busy(dirPath string) bool {
+	prefix := strings.TrimSuffix(dirPath, "/") + "/"
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for upload := range t.inflight {
+		if strings.HasPrefix(upload.destPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
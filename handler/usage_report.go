@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataWorkbench/common/constants"
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/DataWorkbench/logmanager/internal"
+	"github.com/colinmarc/hdfs/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// usageReports caches the reports by space id, "" for the report of all spaces,
+// so that the NameNode is queried at most once per refresh interval. The bytes and files are read from the content
+// summaries of the dirs, the sidecars of the log files are counted with them.
+var usageReports = &usageReportCache{entries: make(map[string]*usageReportEntry)}
+
+type usageReportEntry struct {
+	mu          sync.Mutex
+	reply       *logpb.StorageReportReply
+	generatedAt time.Time
+}
+
+type usageReportCache struct {
+	mu      sync.Mutex
+	entries map[string]*usageReportEntry
+}
+
+func (c *usageReportCache) entry(key string) *usageReportEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &usageReportEntry{}
+		c.entries[key] = entry
+	}
+	return entry
+}
+
+// remove drops the entry of key unless it was replaced meanwhile.
+func (c *usageReportCache) remove(key string, entry *usageReportEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+}
+
+// GetStorageReport returns the files and bytes stored per space, flow and instance,
+// of the given space or of all spaces if spaceID is empty.
+func GetStorageReport(ctx context.Context, spaceID string) (*logpb.StorageReportReply, error) {
+	glog.FromContext(ctx).Debug().Msg(fmt.Sprintf("try to get storage report of [%s]", spaceID)).Fire()
+	if spaceID == "." || spaceID == ".." {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid space id [%s]", spaceID))
+	}
+
+	// concurrent requests for the same report wait for a single computation
+	entry := usageReports.entry(spaceID)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.reply != nil && time.Since(entry.generatedAt) < usageReportConfig.RefreshInterval {
+		return entry.reply, nil
+	}
+
+	reply, err := buildStorageReport(ctx, spaceID)
+	// only the reports of spaces with logs are kept, the ids of the requests do not grow the cache
+	if spaceID != "" && (err != nil || len(reply.Spaces) == 0) {
+		usageReports.remove(spaceID, entry)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry.reply = reply
+	entry.generatedAt = time.Now()
+	return reply, nil
+}
+
+func buildStorageReport(ctx context.Context, spaceID string) (*logpb.StorageReportReply, error) {
+	logger := glog.FromContext(ctx)
+	hdfsClient, err := internal.GetClient(ctx, HdfsServerConfig)
+	if err != nil {
+		logger.Error().Error("failed to create HDFS client", err).Fire()
+		return nil, err
+	}
+
+	defer hdfsClient.Close()
+	var spaceIDs []string
+	if spaceID != "" {
+		spaceIDs = []string{spaceID}
+	} else {
+		spaceInfos, err := internal.StatFilesInDir(ctx, hdfsClient, "/")
+		if err != nil {
+			logger.Error().Error("failed to list spaces", err).Fire()
+			return nil, err
+		}
+		for _, spaceInfo := range spaceInfos {
+			if spaceInfo.IsDir() && !internal.IsHiddenFile(spaceInfo.Name()) {
+				spaceIDs = append(spaceIDs, spaceInfo.Name())
+			}
+		}
+	}
+
+	reply := &logpb.StorageReportReply{GeneratedAt: internal.UnixMilli(time.Now())}
+	for _, _spaceID := range spaceIDs {
+		spaceStorage, err := buildSpaceStorage(ctx, hdfsClient, _spaceID)
+		if err != nil {
+			logger.Error().Msg(fmt.Sprintf("build storage report of space [%s] failed, %s", _spaceID, err.Error())).Fire()
+			return nil, err
+		}
+		// the HDFS root is shared with other applications, skip dirs without instance logs
+		if len(spaceStorage.Flows) == 0 {
+			continue
+		}
+		reply.Spaces = append(reply.Spaces, spaceStorage)
+		reply.TotalFiles += spaceStorage.Files
+		reply.TotalBytes += spaceStorage.Bytes
+	}
+	return reply, nil
+}
+
+func buildSpaceStorage(ctx context.Context, client *hdfs.Client, spaceID string) (*logpb.SpaceStorage, error) {
+	instDirs, err := listInstanceDirs(ctx, client, spaceID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	spaceStorage := &logpb.SpaceStorage{SpaceId: spaceID}
+	flows := make(map[string]*logpb.FlowStorage)
+	for _, instDir := range instDirs {
+		instStorage, ok, err := buildInstanceStorage(ctx, client, instDir)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		flowStorage, exists := flows[instDir.FlowID]
+		if !exists {
+			flowStorage = &logpb.FlowStorage{FlowId: instDir.FlowID}
+			flows[instDir.FlowID] = flowStorage
+			spaceStorage.Flows = append(spaceStorage.Flows, flowStorage)
+		}
+		flowStorage.Instances = append(flowStorage.Instances, instStorage)
+		flowStorage.Files += instStorage.Files
+		flowStorage.Bytes += instStorage.Bytes
+		spaceStorage.Files += instStorage.Files
+		spaceStorage.Bytes += instStorage.Bytes
+	}
+	return spaceStorage, nil
+}
+
+// buildInstanceStorage returns the usage of the JobManager and TaskManager logs of an instance,
+// ok is false if the instance has neither logs dir nor archive.
+func buildInstanceStorage(ctx context.Context, client *hdfs.Client, instDir *instanceDir) (instStorage *logpb.InstanceStorage, ok bool, err error) {
+	instStorage = &logpb.InstanceStorage{
+		InstanceId:   instDir.InstanceID,
+		InstanceTime: internal.UnixMilli(instDir.ModTime),
+	}
+
+	jmDirPath := internal.GetHdfsDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID, constants.JobManagerName)
+	jmBytes, jmFiles, jmErr := internal.StatDirUsage(ctx, client, jmDirPath)
+	if jmErr != nil && !os.IsNotExist(jmErr) {
+		return nil, false, jmErr
+	}
+
+	tmDirPath := internal.GetHdfsDirPath(instDir.SpaceID, instDir.FlowID, instDir.InstanceID, constants.TaskManagerName)
+	tmBytes, tmFiles, tmErr := internal.StatDirUsage(ctx, client, tmDirPath)
+	if tmErr != nil && !os.IsNotExist(tmErr) {
+		return nil, false, tmErr
+	}
+
+	if os.IsNotExist(jmErr) && os.IsNotExist(tmErr) {
+		return buildArchivedInstanceStorage(client, instDir, instStorage)
+	}
+
+	instStorage.JobManagerFiles = int64(jmFiles)
+	instStorage.JobManagerBytes = jmBytes
+	instStorage.TaskManagerFiles = int64(tmFiles)
+	instStorage.TaskManagerBytes = tmBytes
+	instStorage.Files = instStorage.JobManagerFiles + instStorage.TaskManagerFiles
+	instStorage.Bytes = jmBytes + tmBytes
+	return instStorage, true, nil
+}
+
+// buildArchivedInstanceStorage returns the usage of the logs packed into the archive of an instance,
+// the sizes of the members are counted, not the size of the archive.
+func buildArchivedInstanceStorage(client *hdfs.Client, instDir *instanceDir, instStorage *logpb.InstanceStorage) (*logpb.InstanceStorage, bool, error) {
+	archiveIndex, err := loadArchiveIndex(client, instDir.SpaceID, instDir.FlowID, instDir.InstanceID)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, member := range archiveIndex.Members {
+		switch {
+		case strings.HasPrefix(member.Path, constants.JobManagerName+"/"):
+			instStorage.JobManagerFiles++
+			instStorage.JobManagerBytes += member.Size
+		case strings.HasPrefix(member.Path, constants.TaskManagerName+"/"):
+			instStorage.TaskManagerFiles++
+			instStorage.TaskManagerBytes += member.Size
+		}
+	}
+	instStorage.Files = instStorage.JobManagerFiles + instStorage.TaskManagerFiles
+	instStorage.Bytes = instStorage.JobManagerBytes + instStorage.TaskManagerBytes
+	return instStorage, true, nil
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	archiveIndexVersion = 1
+)
+
+// ArchiveMember is a file packed into an instance archive, Offset is the position of its content in the archive.
+type ArchiveMember struct {
+	Path    string    `json:"path"`
+	Offset  int64     `json:"offset"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// ArchiveIndex lists the members of an instance archive,
+// so that a member can be read without scanning the tar headers.
+type ArchiveIndex struct {
+	Version int `json:"version"`
+	// Archive is the name of the archive file in the instance dir. Each compaction writes a new archive
+	// and replaces the index last, so an index never points into an archive it was not written for.
+	Archive string           `json:"archive"`
+	Members []*ArchiveMember `json:"members"`
+}
+
+// NewArchiveName returns the name of an archive written at t, e.g. "logs-1634601600000000000.tar".
+func NewArchiveName(t time.Time) string {
+	return fmt.Sprintf("logs-%d.tar", t.UnixNano())
+}
+
+// Find returns the member with the path relative to the logs dir, nil if not found.
+func (idx *ArchiveIndex) Find(relPath string) *ArchiveMember {
+	for _, m := range idx.Members {
+		if m.Path == relPath {
+			return m
+		}
+	}
+	return nil
+}
+
+func (idx *ArchiveIndex) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(idx)
+}
+
+func DecodeArchiveIndex(r io.Reader) (*ArchiveIndex, error) {
+	idx := &ArchiveIndex{}
+	if err := json.NewDecoder(r).Decode(idx); err != nil {
+		return nil, err
+	}
+	if idx.Archive == "" {
+		return nil, errors.New("archive index names no archive")
+	}
+	return idx, nil
+}
+
+// ArchiveSource is a file to pack into an archive.
+type ArchiveSource struct {
+	// Path relative to the logs dir of the instance
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Open    func() (io.ReadCloser, error)
+}
+
+// SidecarOwner returns the path of the file a hidden sidecar (line index or key) belongs to,
+// e.g. "jobmanager/jobmanager.log" for "jobmanager/.jobmanager.log.idx", ok is false if the file is not a sidecar.
+func SidecarOwner(filePath string) (owner string, ok bool) {
+	name := path.Base(filePath)
+	if !IsHiddenFile(name) {
+		return "", false
+	}
+	for _, suffix := range []string{lineIndexSuffix, fileKeySuffix} {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix)+1 {
+			return path.Join(path.Dir(filePath), strings.TrimSuffix(name[1:], suffix)), true
+		}
+	}
+	return "", false
+}
+
+// MergeArchiveSources adds the members of an existing archive to the loose files of the logs dir.
+// A loose file replaces the member with the same path, and the sidecars of the replaced member are dropped
+// since they were written for its previous content.
+func MergeArchiveSources(loose []*ArchiveSource, idx *ArchiveIndex, open func(*ArchiveMember) (io.ReadCloser, error)) []*ArchiveSource {
+	looseFiles := make(map[string]bool, len(loose))
+	for _, src := range loose {
+		looseFiles[src.Path] = true
+	}
+	merged := loose
+	for _, member := range idx.Members {
+		if looseFiles[member.Path] {
+			continue
+		}
+		if owner, ok := SidecarOwner(member.Path); ok && looseFiles[owner] {
+			continue
+		}
+		member := member
+		merged = append(merged, &ArchiveSource{
+			Path:    member.Path,
+			Size:    member.Size,
+			ModTime: member.ModTime,
+			Open: func() (io.ReadCloser, error) {
+				return open(member)
+			},
+		})
+	}
+	return merged
+}
+
+// CountingWriter counts the bytes written to W.
+type CountingWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// WriteArchive packs the sources into a tar stream and returns the index of its members.
+func WriteArchive(w io.Writer, sources []*ArchiveSource) (*ArchiveIndex, error) {
+	cw := &CountingWriter{W: w}
+	tw := tar.NewWriter(cw)
+	idx := &ArchiveIndex{Version: archiveIndexVersion}
+
+	for _, src := range sources {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     src.Path,
+			Size:     src.Size,
+			Mode:     0644,
+			ModTime:  src.ModTime,
+			Format:   tar.FormatPAX,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// the header is written when WriteHeader returns, so the content starts here
+		member := &ArchiveMember{
+			Path:    src.Path,
+			Offset:  cw.N,
+			Size:    src.Size,
+			ModTime: src.ModTime,
+		}
+
+		r, err := src.Open()
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(tw, r, src.Size)
+		_ = r.Close()
+		if err != nil {
+			return nil, err
+		}
+		idx.Members = append(idx.Members, member)
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func stringSource(relPath, content string, modTime time.Time) *ArchiveSource {
+	return &ArchiveSource{
+		Path:    relPath,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(content)), nil
+		},
+	}
+}
+
+func readMember(t *testing.T, archive []byte, member *ArchiveMember) string {
+	b, err := ioutil.ReadAll(io.NewSectionReader(bytes.NewReader(archive), member.Offset, member.Size))
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestRecompactArchive(t *testing.T) {
+	modTime := time.Unix(1634601600, 0).UTC()
+
+	// first compaction of the logs dir
+	var first bytes.Buffer
+	firstIndex, err := WriteArchive(&first, []*ArchiveSource{
+		stringSource("jobmanager/jobmanager.log", "jm 1\njm 2\n", modTime),
+		stringSource("jobmanager/.jobmanager.log.idx", "jm index", modTime),
+		stringSource("jobmanager/.jobmanager.log.key", "jm key", modTime),
+		stringSource("taskmanager/tm-1/taskmanager.log", "tm 1\n", modTime),
+		stringSource("taskmanager/tm-1/.taskmanager.log.idx", "tm index", modTime),
+	})
+	require.NoError(t, err)
+	firstIndex.Archive = NewArchiveName(modTime)
+
+	var encoded bytes.Buffer
+	require.NoError(t, firstIndex.Encode(&encoded))
+	decoded, err := DecodeArchiveIndex(&encoded)
+	require.NoError(t, err)
+	require.Equal(t, firstIndex.Archive, decoded.Archive)
+	require.Len(t, decoded.Members, 5)
+
+	// the job manager log is uploaded again without encryption and a new task manager log added,
+	// then the instance is compacted again
+	loose := []*ArchiveSource{
+		stringSource("jobmanager/jobmanager.log", "jm 1\njm 2\njm 3\n", modTime.Add(time.Hour)),
+		stringSource("jobmanager/.jobmanager.log.idx", "new jm index", modTime.Add(time.Hour)),
+		stringSource("taskmanager/tm-2/taskmanager.log", "tm 2\n", modTime.Add(time.Hour)),
+	}
+	sources := MergeArchiveSources(loose, decoded, func(member *ArchiveMember) (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(bytes.NewReader(first.Bytes()), member.Offset, member.Size)), nil
+	})
+	require.Len(t, sources, 5)
+
+	var second bytes.Buffer
+	secondIndex, err := WriteArchive(&second, sources)
+	require.NoError(t, err)
+	secondIndex.Archive = NewArchiveName(modTime.Add(time.Hour))
+	require.NotEqual(t, firstIndex.Archive, secondIndex.Archive)
+
+	tests := []struct {
+		path    string
+		content string
+	}{
+		{"jobmanager/jobmanager.log", "jm 1\njm 2\njm 3\n"},
+		{"jobmanager/.jobmanager.log.idx", "new jm index"},
+		{"taskmanager/tm-1/taskmanager.log", "tm 1\n"},
+		{"taskmanager/tm-1/.taskmanager.log.idx", "tm index"},
+		{"taskmanager/tm-2/taskmanager.log", "tm 2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			member := secondIndex.Find(tt.path)
+			require.NotNil(t, member)
+			require.Equal(t, tt.content, readMember(t, second.Bytes(), member))
+		})
+	}
+	require.Len(t, secondIndex.Members, len(tests))
+	// the key of the previous content is dropped with it
+	require.Nil(t, secondIndex.Find("jobmanager/.jobmanager.log.key"))
+}
+
+func TestSidecarOwner(t *testing.T) {
+	tests := []struct {
+		path  string
+		owner string
+		ok    bool
+	}{
+		{"jobmanager/.jobmanager.log.idx", "jobmanager/jobmanager.log", true},
+		{"taskmanager/tm-1/.taskmanager.log.key", "taskmanager/tm-1/taskmanager.log", true},
+		{"jobmanager/jobmanager.log", "", false},
+		{"jobmanager/.jobmanager.log", "", false},
+		{"jobmanager/.idx", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			owner, ok := SidecarOwner(tt.path)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.owner, owner)
+		})
+	}
+}
+
+func TestDecodeArchiveIndexWithoutArchive(t *testing.T) {
+	_, err := DecodeArchiveIndex(strings.NewReader(`{"version":1,"members":[]}`))
+	require.Error(t, err)
+}
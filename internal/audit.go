@@ -0,0 +1,442 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataWorkbench/logmanager/config"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+const (
+	AuditSinkFile = "file"
+	AuditSinkHdfs = "hdfs"
+
+	// suffix of the rotated audit files, it sorts in the order of the rotations
+	auditRotationLayout = "20060102T150405.000000000"
+	// prefix and suffix of the daily files of the hdfs sink, e.g. audit-20211019-logmanager-0.jsonl
+	auditDayPrefix = "audit-"
+	auditDayLayout = "20060102"
+	auditDaySuffix = ".jsonl"
+)
+
+// AuditEvent is a call of the service, who made it, on which logs and how it ended.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity,omitempty"`
+	// Address of the caller
+	Peer          string `json:"peer,omitempty"`
+	Method        string `json:"method"`
+	SpaceID       string `json:"space_id,omitempty"`
+	FlowID        string `json:"flow_id,omitempty"`
+	InstanceID    string `json:"instance_id,omitempty"`
+	TaskManagerID string `json:"task_manager_id,omitempty"`
+	FileName      string `json:"file_name,omitempty"`
+	// Bytes of log data sent to the caller, or stored by an upload
+	Bytes int64 `json:"bytes"`
+	// gRPC status code
+	Code  string `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// AuditSink stores the audit events, it's append-only: events are never changed once written.
+type AuditSink interface {
+	Write(ctx context.Context, events []*AuditEvent) error
+	// Read calls fn with the events written since the given time, in the order they were written
+	// (by time across the writers of a shared sink), until fn returns false.
+	Read(ctx context.Context, since time.Time, fn func(*AuditEvent) bool) error
+	Close() error
+}
+
+// NewAuditSink returns the sink of the config.
+func NewAuditSink(cfg *config.AuditConfig, hdfsConfig *config.HdfsConfig) (AuditSink, error) {
+	switch cfg.Sink {
+	case AuditSinkFile:
+		return OpenFileAuditSink(cfg.Path, cfg.MaxFileSize, cfg.MaxBackups)
+	case AuditSinkHdfs:
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("get hostname failed, %w", err)
+		}
+		return &HdfsAuditSink{hdfsConfig: hdfsConfig, dir: cfg.Path, host: auditFileHost(host)}, nil
+	}
+	return nil, fmt.Errorf("unknown audit sink [%s], \"%s\" or \"%s\" is expected", cfg.Sink, AuditSinkFile, AuditSinkHdfs)
+}
+
+func encodeAuditEvents(events []*AuditEvent) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// scanAuditLines splits on newlines, a last line without one is being written and is skipped.
+func scanAuditLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), nil, nil
+	}
+	return 0, nil, nil
+}
+
+// readAuditEvents reads the events of a file of json lines, it returns false if fn stopped the reading.
+func readAuditEvents(r io.Reader, since time.Time, fn func(*AuditEvent) bool) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxLineLength)
+	scanner.Split(scanAuditLines)
+	for scanner.Scan() {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			return false, err
+		}
+		if event.Time.Before(since) {
+			continue
+		}
+		if !fn(event) {
+			return false, nil
+		}
+	}
+	return true, scanner.Err()
+}
+
+// FileAuditSink appends the events to a local file, which is renamed with the time of
+// the rotation as suffix once it reaches the max size.
+type FileAuditSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenFileAuditSink opens the audit file at path, it's created if not exists.
+func OpenFileAuditSink(path string, maxSize int64, maxBackups int) (*FileAuditSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	s := &FileAuditSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileAuditSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileAuditSink) Write(_ context.Context, events []*AuditEvent) error {
+	data, err := encodeAuditEvents(events)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err = s.file.Sync(); err != nil {
+		return err
+	}
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		return s.rotate()
+	}
+	return nil
+}
+
+func (s *FileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	rotatedPath := s.path + "." + time.Now().UTC().Format(auditRotationLayout)
+	if err := os.Rename(s.path, rotatedPath); err != nil {
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		backups, err := s.backups()
+		if err != nil {
+			return err
+		}
+		for len(backups) > s.maxBackups {
+			if err = os.Remove(backups[0].path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+type auditBackup struct {
+	path      string
+	rotatedAt time.Time
+}
+
+// backups returns the rotated files, the oldest first.
+func (s *FileAuditSink) backups() ([]*auditBackup, error) {
+	matches, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []*auditBackup
+	for _, match := range matches {
+		rotatedAt, err := time.Parse(auditRotationLayout, strings.TrimPrefix(match, s.path+"."))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, &auditBackup{path: match, rotatedAt: rotatedAt})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotatedAt.Before(backups[j].rotatedAt) })
+	return backups, nil
+}
+
+func (s *FileAuditSink) Read(_ context.Context, since time.Time, fn func(*AuditEvent) bool) error {
+	s.mu.Lock()
+	backups, err := s.backups()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, backup := range backups {
+		// the events of a rotated file are older than its rotation
+		if backup.rotatedAt.Before(since) {
+			continue
+		}
+		paths = append(paths, backup.path)
+	}
+	paths = append(paths, s.path)
+
+	for _, p := range paths {
+		more, err := s.readFile(p, since, fn)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *FileAuditSink) readFile(path string, since time.Time, fn func(*AuditEvent) bool) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// removed by a rotation meanwhile
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return readAuditEvents(f, since, fn)
+}
+
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// HdfsAuditSink appends the events to a file per day (UTC) and per host in an HDFS dir,
+// so that the replicas of the service never append to the same file.
+type HdfsAuditSink struct {
+	hdfsConfig *config.HdfsConfig
+	dir        string
+	host       string
+}
+
+// auditFileHost returns the hostname with the chars not allowed in the file names replaced.
+func auditFileHost(host string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+func (s *HdfsAuditSink) dayFilePath(t time.Time) string {
+	return path.Join(s.dir, auditDayPrefix+t.UTC().Format(auditDayLayout)+"-"+s.host+auditDaySuffix)
+}
+
+// auditFileDay returns the day of a file of the hdfs sink, ok is false if name is not one.
+func auditFileDay(name string) (day string, ok bool) {
+	if !strings.HasPrefix(name, auditDayPrefix) || !strings.HasSuffix(name, auditDaySuffix) {
+		return "", false
+	}
+	day = strings.TrimSuffix(strings.TrimPrefix(name, auditDayPrefix), auditDaySuffix)
+	i := strings.IndexByte(day, '-')
+	if i < 0 {
+		return "", false
+	}
+	day = day[:i]
+	if _, err := time.Parse(auditDayLayout, day); err != nil {
+		return "", false
+	}
+	return day, true
+}
+
+func (s *HdfsAuditSink) Write(ctx context.Context, events []*AuditEvent) error {
+	client, err := GetClient(ctx, s.hdfsConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// events are written in order, a batch spans two files at most
+	for len(events) > 0 {
+		filePath := s.dayFilePath(events[0].Time)
+		n := 1
+		for n < len(events) && s.dayFilePath(events[n].Time) == filePath {
+			n++
+		}
+		if err = s.appendFile(client, filePath, events[:n]); err != nil {
+			return err
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+func (s *HdfsAuditSink) appendFile(client *hdfs.Client, filePath string, events []*AuditEvent) error {
+	data, err := encodeAuditEvents(events)
+	if err != nil {
+		return err
+	}
+
+	writer, err := client.Append(filePath)
+	if os.IsNotExist(err) {
+		if err = client.MkdirAll(s.dir, 0750); err != nil {
+			return err
+		}
+		writer, err = client.Create(filePath)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(data); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (s *HdfsAuditSink) Read(ctx context.Context, since time.Time, fn func(*AuditEvent) bool) error {
+	client, err := GetClient(ctx, s.hdfsConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	fileInfos, err := StatFilesInDir(ctx, client, s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sinceDay := since.UTC().Format(auditDayLayout)
+	days := make(map[string][]string)
+	for _, info := range fileInfos {
+		day, ok := auditFileDay(info.Name())
+		if info.IsDir() || !ok {
+			continue
+		}
+		if !since.IsZero() && day < sinceDay {
+			continue
+		}
+		days[day] = append(days[day], path.Join(s.dir, info.Name()))
+	}
+	var sortedDays []string
+	for day := range days {
+		sortedDays = append(sortedDays, day)
+	}
+	sort.Strings(sortedDays)
+
+	for _, day := range sortedDays {
+		more, err := s.readDay(client, days[day], since, fn)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readDay reads the files of the hosts for a day, their events are merged by time.
+func (s *HdfsAuditSink) readDay(client *hdfs.Client, filePaths []string, since time.Time, fn func(*AuditEvent) bool) (bool, error) {
+	var events []*AuditEvent
+	for _, filePath := range filePaths {
+		if _, err := s.readFile(client, filePath, since, func(event *AuditEvent) bool {
+			events = append(events, event)
+			return true
+		}); err != nil {
+			return false, err
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	for _, event := range events {
+		if !fn(event) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s *HdfsAuditSink) readFile(client *hdfs.Client, filePath string, since time.Time, fn func(*AuditEvent) bool) (bool, error) {
+	f, err := client.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return readAuditEvents(f, since, fn)
+}
+
+func (s *HdfsAuditSink) Close() error {
+	return nil
+}
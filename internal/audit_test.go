@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAuditEventsPartialLine(t *testing.T) {
+	data := `{"time":"2021-10-19T10:00:00Z","method":"ListLogFiles","bytes":0,"code":"OK"}
+{"time":"2021-10-19T11:00:00Z","method":"UploadLogFile","bytes":42,"code":"OK"}
+{"time":"2021-10-19T12:00:00Z","meth`
+
+	var events []*AuditEvent
+	more, err := readAuditEvents(strings.NewReader(data), time.Time{}, func(event *AuditEvent) bool {
+		events = append(events, event)
+		return true
+	})
+	require.NoError(t, err)
+	require.True(t, more)
+	require.Len(t, events, 2)
+	require.Equal(t, int64(42), events[1].Bytes)
+}
+
+func TestAuditFileDay(t *testing.T) {
+	tests := []struct {
+		name string
+		day  string
+		ok   bool
+	}{
+		{"audit-20211019-logmanager-0.jsonl", "20211019", true},
+		{"audit-20211019.jsonl", "", false},
+		{"audit-2021.jsonl", "", false},
+		{"audit-20211019-logmanager-0.jsonl.tmp", "", false},
+		{"other-20211019.jsonl", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			day, ok := auditFileDay(tt.name)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.day, day)
+		})
+	}
+
+	s := &HdfsAuditSink{dir: "/audit", host: auditFileHost("logmanager-0.svc")}
+	day, ok := auditFileDay("audit-20211019-logmanager-0_svc.jsonl")
+	require.True(t, ok)
+	require.Equal(t, "/audit/audit-"+day+"-logmanager-0_svc.jsonl", s.dayFilePath(time.Date(2021, 10, 19, 1, 0, 0, 0, time.UTC)))
+}
@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrCatalogLocked is returned by OpenCatalog if the catalog is opened by another process.
+var ErrCatalogLocked = errors.New("catalog is used by another process")
+
+// the journal is rewritten once it holds this many records more than the catalog has entries
+const catalogCompactThreshold = 10000
+
+// CatalogEntry is a log file archived in HDFS.
+type CatalogEntry struct {
+	SpaceID    string `json:"space_id"`
+	FlowID     string `json:"flow_id"`
+	InstanceID string `json:"instance_id"`
+	// Path relative to the logs dir of the instance, e.g. "jobmanager/:log_file"
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Checksum string    `json:"checksum,omitempty"`
+}
+
+// CatalogStamp is the mtime of the manifest of an instance when its entries were listed from HDFS.
+type CatalogStamp struct {
+	SpaceID         string    `json:"space_id"`
+	FlowID          string    `json:"flow_id"`
+	InstanceID      string    `json:"instance_id"`
+	ManifestModTime time.Time `json:"manifest_mod_time"`
+}
+
+type catalogRecord struct {
+	// Put is set to add or replace an entry, Stamp to set the stamp of an instance,
+	// otherwise the entries and stamps under Delete are removed
+	Put    *CatalogEntry `json:"put,omitempty"`
+	Stamp  *CatalogStamp `json:"stamp,omitempty"`
+	Delete []string      `json:"delete,omitempty"`
+}
+
+// Catalog keeps the archived log files in memory, backed by a journal on local disk,
+// so that listings are served without listing the dirs of the instances on the NameNode.
+//
+// Each replica has its own catalog, which misses the files other replicas collect, delete or sweep.
+// The entries of an instance are stamped with the mtime of its manifest, rewritten at the end of each
+// collection and removed with the instance, and only used while the manifest still has that mtime.
+//
+// A journal of json lines is used rather than SQLite or bbolt: the catalog is a cache that
+// the reconcile command rebuilds from HDFS, it's only read by instance, which the in-memory map serves,
+// and it keeps the build free of cgo and of a storage engine to operate. The journal is compacted
+// once it holds catalogCompactThreshold records more than the entries, which bounds the load time.
+type Catalog struct {
+	mu     sync.RWMutex
+	path   string
+	lock   *os.File
+	file   *os.File
+	writer *bufio.Writer
+	// records in the journal and entries in the catalog
+	records int
+	entries int
+	// instance key /:space_id/:flow_id/:inst_id => path => entry
+	instances map[string]map[string]*CatalogEntry
+	// instance key => stamp
+	stamps map[string]*CatalogStamp
+}
+
+func catalogInstanceKey(ids ...string) string {
+	return "/" + strings.Join(ids, "/")
+}
+
+// OpenCatalog loads the catalog journal at path, it's created if not exists.
+// The catalog is locked until Close so that it's never written by two processes.
+func OpenCatalog(path string) (*Catalog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = lockFile.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrCatalogLocked
+		}
+		return nil, err
+	}
+
+	c := &Catalog{
+		path:      path,
+		lock:      lockFile,
+		instances: make(map[string]map[string]*CatalogEntry),
+		stamps:    make(map[string]*CatalogStamp),
+	}
+	if err = c.load(); err != nil {
+		_ = lockFile.Close()
+		return nil, err
+	}
+	if err = c.rewrite(); err != nil {
+		_ = lockFile.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Catalog) load() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), MaxLineLength)
+	for scanner.Scan() {
+		var record catalogRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// the last record may be partially written if the process crashed
+			break
+		}
+		c.apply(&record)
+	}
+	return scanner.Err()
+}
+
+func (c *Catalog) apply(record *catalogRecord) {
+	if e := record.Put; e != nil {
+		key := catalogInstanceKey(e.SpaceID, e.FlowID, e.InstanceID)
+		files, ok := c.instances[key]
+		if !ok {
+			files = make(map[string]*CatalogEntry)
+			c.instances[key] = files
+		}
+		if _, exists := files[e.Path]; !exists {
+			c.entries++
+		}
+		files[e.Path] = e
+		return
+	}
+	if st := record.Stamp; st != nil {
+		c.stamps[catalogInstanceKey(st.SpaceID, st.FlowID, st.InstanceID)] = st
+		return
+	}
+	if len(record.Delete) == 0 {
+		return
+	}
+	prefix := catalogInstanceKey(record.Delete...) + "/"
+	for key := range c.instances {
+		if strings.HasPrefix(key+"/", prefix) {
+			c.entries -= len(c.instances[key])
+			delete(c.instances, key)
+		}
+	}
+	for key := range c.stamps {
+		if strings.HasPrefix(key+"/", prefix) {
+			delete(c.stamps, key)
+		}
+	}
+}
+
+// rewrite writes the entries into a new journal, which replaces the current one.
+func (c *Catalog) rewrite() (err error) {
+	tmpPath := c.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	records := 0
+	for _, files := range c.instances {
+		for _, e := range files {
+			if err = encoder.Encode(&catalogRecord{Put: e}); err != nil {
+				_ = f.Close()
+				return
+			}
+			records++
+		}
+	}
+	for _, st := range c.stamps {
+		if err = encoder.Encode(&catalogRecord{Stamp: st}); err != nil {
+			_ = f.Close()
+			return
+		}
+		records++
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmpPath, c.path); err != nil {
+		return
+	}
+
+	if c.file != nil {
+		_ = c.file.Close()
+	}
+	c.file, err = os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	c.writer = bufio.NewWriter(c.file)
+	c.records = records
+	return
+}
+
+func (c *Catalog) append(record *catalogRecord) error {
+	c.apply(record)
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = c.writer.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err = c.writer.Flush(); err != nil {
+		return err
+	}
+
+	c.records++
+	if c.records-c.entries-len(c.stamps) > catalogCompactThreshold {
+		return c.rewrite()
+	}
+	return nil
+}
+
+// Put adds or replaces an entry.
+func (c *Catalog) Put(e *CatalogEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.append(&catalogRecord{Put: e})
+}
+
+// Delete removes the entries of an instance, of a flow or of a space, e.g. Delete(space_id, flow_id).
+func (c *Catalog) Delete(ids ...string) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("catalog delete needs at least the space id")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.append(&catalogRecord{Delete: ids})
+}
+
+// ReplaceInstance replaces the entries of an instance by the ones listed from HDFS, stamped with the mtime
+// of the manifest of the instance before the listing.
+func (c *Catalog) ReplaceInstance(st *CatalogStamp, entries []*CatalogEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.append(&catalogRecord{Delete: []string{st.SpaceID, st.FlowID, st.InstanceID}}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := c.append(&catalogRecord{Put: e}); err != nil {
+			return err
+		}
+	}
+	return c.append(&catalogRecord{Stamp: st})
+}
+
+// Replace drops all the entries and sets the given ones, used to rebuild the catalog from HDFS.
+func (c *Catalog) Replace(entries []*CatalogEntry, stamps []*CatalogStamp) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances = make(map[string]map[string]*CatalogEntry)
+	c.stamps = make(map[string]*CatalogStamp)
+	c.entries = 0
+	for _, e := range entries {
+		c.apply(&catalogRecord{Put: e})
+	}
+	for _, st := range stamps {
+		c.apply(&catalogRecord{Stamp: st})
+	}
+	return c.rewrite()
+}
+
+// List returns the entries of an instance ordered by path and the mtime of the manifest they were listed at,
+// ok is false if the instance is not in the catalog or was never listed from HDFS.
+func (c *Catalog) List(spaceID, flowID, instID string) (entries []*CatalogEntry, manifestModTime time.Time, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key := catalogInstanceKey(spaceID, flowID, instID)
+	st, ok := c.stamps[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	for _, e := range c.instances[key] {
+		entry := *e
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, st.ManifestModTime, true
+}
+
+// Close flushes the journal and releases the lock of the catalog.
+func (c *Catalog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.writer.Flush()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	_ = c.lock.Close()
+	c.file = nil
+	return err
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogStamp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.jsonl")
+
+	c, err := OpenCatalog(path)
+	require.NoError(t, err)
+	entry := &CatalogEntry{SpaceID: "s", FlowID: "f", InstanceID: "i", Path: "jobmanager/jm.log", Size: 10}
+	require.NoError(t, c.Put(entry))
+	// entries saved by this replica are not listed until the instance is listed from HDFS
+	_, _, ok := c.List("s", "f", "i")
+	require.False(t, ok)
+
+	manifestModTime := time.Date(2021, 10, 19, 10, 0, 0, 0, time.UTC)
+	stamp := &CatalogStamp{SpaceID: "s", FlowID: "f", InstanceID: "i", ManifestModTime: manifestModTime}
+	listed := &CatalogEntry{SpaceID: "s", FlowID: "f", InstanceID: "i", Path: "taskmanager/tm-1/tm.log", Size: 20}
+	require.NoError(t, c.ReplaceInstance(stamp, []*CatalogEntry{listed}))
+	entries, modTime, ok := c.List("s", "f", "i")
+	require.True(t, ok)
+	require.True(t, manifestModTime.Equal(modTime))
+	require.Len(t, entries, 1)
+	require.Equal(t, listed.Path, entries[0].Path)
+	require.NoError(t, c.Close())
+
+	// the stamps are kept in the journal
+	c, err = OpenCatalog(path)
+	require.NoError(t, err)
+	entries, modTime, ok = c.List("s", "f", "i")
+	require.True(t, ok)
+	require.True(t, manifestModTime.Equal(modTime))
+	require.Len(t, entries, 1)
+
+	require.NoError(t, c.Delete("s", "f"))
+	_, _, ok = c.List("s", "f", "i")
+	require.False(t, ok)
+	require.NoError(t, c.Close())
+
+	c, err = OpenCatalog(path)
+	require.NoError(t, err)
+	_, _, ok = c.List("s", "f", "i")
+	require.False(t, ok)
+	require.NoError(t, c.Close())
+}
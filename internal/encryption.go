@@ -0,0 +1,450 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/DataWorkbench/logmanager/config"
+)
+
+const (
+	fileKeyVersion = 2
+	// AES-256-CTR keeps the size and the offsets of a file, so line indexes, archive members
+	// and partial reads work on encrypted files as they do on plain ones.
+	fileKeyAlgorithm = "AES-256-CTR"
+	dataKeySize      = 32
+	fileKeySuffix    = ".key"
+
+	// the encrypted content is authenticated by chunks, so a partial read only reads the chunks it needs
+	fileChunkSize = 1 << 20
+	chunkMACSize  = 16
+)
+
+var (
+	// ErrUnknownMasterKey is returned if a data key was wrapped by a master key the provider does not have.
+	ErrUnknownMasterKey = errors.New("unknown master key")
+	ErrInvalidFileKey   = errors.New("invalid file key")
+	// ErrFileIntegrity is returned if an encrypted file does not match the MACs of its key,
+	// e.g. it was modified or truncated, or its upload did not complete.
+	ErrFileIntegrity = errors.New("encrypted file integrity check failed")
+)
+
+// KeyProvider wraps the data keys of encrypted files with master keys, e.g. a local key file or a KMS.
+type KeyProvider interface {
+	// CurrentKeyID returns the id of the master key new data keys are wrapped with.
+	CurrentKeyID() string
+	WrapKey(keyID string, dataKey []byte) ([]byte, error)
+	UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+// LocalKeyProvider wraps data keys with AES-256-GCM master keys read from a local key file.
+type LocalKeyProvider struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewLocalKeyProvider reads the master keys from filePath, see config.LoadMasterKeys.
+func NewLocalKeyProvider(filePath string) (*LocalKeyProvider, error) {
+	masterKeys, err := config.LoadMasterKeys(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &LocalKeyProvider{current: masterKeys.Current, keys: make(map[string]cipher.AEAD)}
+	for keyID, encoded := range masterKeys.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key [%s], %s", keyID, err.Error())
+		}
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("invalid master key [%s], %d bytes are expected", keyID, dataKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if p.keys[keyID], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := p.keys[p.current]; !ok {
+		return nil, fmt.Errorf("%w: current master key [%s] not found in [%s]", ErrUnknownMasterKey, p.current, filePath)
+	}
+	return p, nil
+}
+
+func (p *LocalKeyProvider) CurrentKeyID() string {
+	return p.current
+}
+
+// WrapKey seals the data key, the key id is authenticated so a wrapped key can not be passed off as another key's.
+func (p *LocalKeyProvider) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: [%s]", ErrUnknownMasterKey, keyID)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(keyID)), nil
+}
+
+func (p *LocalKeyProvider) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: [%s]", ErrUnknownMasterKey, keyID)
+	}
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, ErrInvalidFileKey
+	}
+	nonce, sealed := wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: unwrap with master key [%s] failed", ErrInvalidFileKey, keyID)
+	}
+	return dataKey, nil
+}
+
+// FileKey is the envelope of an encrypted log file: its data key wrapped by a master key,
+// and the MACs of the chunks of the encrypted file. It's stored as a hidden sidecar next to the file.
+type FileKey struct {
+	Version    int    `json:"version"`
+	Algorithm  string `json:"algorithm"`
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	IV         []byte `json:"iv"`
+	// ChunkSize, Size and MACs are set by EncryptWriter.Seal once the file is written,
+	// a key without MACs belongs to a file whose upload did not complete.
+	ChunkSize int64  `json:"chunk_size,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	MACs      []byte `json:"macs,omitempty"`
+}
+
+// NewFileKey generates a data key wrapped by the current master key of the provider.
+func NewFileKey(provider KeyProvider) (fileKey *FileKey, dataKey []byte, err error) {
+	dataKey = make([]byte, dataKeySize)
+	if _, err = rand.Read(dataKey); err != nil {
+		return
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err = rand.Read(iv); err != nil {
+		return
+	}
+
+	keyID := provider.CurrentKeyID()
+	wrappedKey, err := provider.WrapKey(keyID, dataKey)
+	if err != nil {
+		return
+	}
+	fileKey = &FileKey{
+		Version:    fileKeyVersion,
+		Algorithm:  fileKeyAlgorithm,
+		KeyID:      keyID,
+		WrappedKey: wrappedKey,
+		IV:         iv,
+		ChunkSize:  fileChunkSize,
+	}
+	return
+}
+
+// DataKey unwraps the data key of the file.
+func (k *FileKey) DataKey(provider KeyProvider) ([]byte, error) {
+	return provider.UnwrapKey(k.KeyID, k.WrappedKey)
+}
+
+// Rewrap wraps the data key with the current master key of the provider,
+// returns false if it's already wrapped by the current key. The encrypted file is unchanged.
+func (k *FileKey) Rewrap(provider KeyProvider) (bool, error) {
+	keyID := provider.CurrentKeyID()
+	if k.KeyID == keyID {
+		return false, nil
+	}
+	dataKey, err := k.DataKey(provider)
+	if err != nil {
+		return false, err
+	}
+	wrappedKey, err := provider.WrapKey(keyID, dataKey)
+	if err != nil {
+		return false, err
+	}
+	k.KeyID = keyID
+	k.WrappedKey = wrappedKey
+	return true, nil
+}
+
+func (k *FileKey) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(k)
+}
+
+func DecodeFileKey(r io.Reader) (*FileKey, error) {
+	k := &FileKey{}
+	if err := json.NewDecoder(r).Decode(k); err != nil {
+		return nil, err
+	}
+	// any other version would decrypt the file with other integrity checks, or none
+	if k.Version != fileKeyVersion {
+		return nil, ErrInvalidFileKey
+	}
+	if k.Algorithm != fileKeyAlgorithm || len(k.IV) != aes.BlockSize {
+		return nil, ErrInvalidFileKey
+	}
+	if k.ChunkSize <= 0 || k.ChunkSize%aes.BlockSize != 0 || len(k.MACs)%chunkMACSize != 0 {
+		return nil, ErrInvalidFileKey
+	}
+	return k, nil
+}
+
+// FileKeyPath returns the path of the key of an encrypted log file.
+func FileKeyPath(filePath string) string {
+	return path.Join(path.Dir(filePath), "."+path.Base(filePath)+fileKeySuffix)
+}
+
+// IsFileKeyPath reports whether the file is the key of an encrypted log file.
+func IsFileKeyPath(filePath string) bool {
+	name := path.Base(filePath)
+	return IsHiddenFile(name) && strings.HasSuffix(name, fileKeySuffix)
+}
+
+// chunkCount returns the number of chunks of a file, an empty file has one empty chunk.
+func chunkCount(size, chunkSize int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + chunkSize - 1) / chunkSize
+}
+
+// newChunkMAC returns the MAC of the chunks of a file, keyed by a key derived from the data key.
+func newChunkMAC(dataKey []byte) hash.Hash {
+	derive := hmac.New(sha256.New, dataKey)
+	derive.Write([]byte("logmanager file chunk mac"))
+	return hmac.New(sha256.New, derive.Sum(nil))
+}
+
+// startChunkMAC and endChunkMAC authenticate an encrypted chunk with its position in the file and whether
+// it's the last one, so chunks can neither be reordered nor dropped from the end of the file.
+func startChunkMAC(mac hash.Hash, iv []byte, index int64) {
+	var header [8]byte
+	binary.BigEndian.PutUint64(header[:], uint64(index))
+	mac.Reset()
+	mac.Write(iv)
+	mac.Write(header[:])
+}
+
+func endChunkMAC(mac hash.Hash, last bool) []byte {
+	flag := []byte{0}
+	if last {
+		flag[0] = 1
+	}
+	mac.Write(flag)
+	return mac.Sum(nil)[:chunkMACSize]
+}
+
+// newCTRAt returns the key stream of the file from pos.
+func newCTRAt(block cipher.Block, iv []byte, pos int64) cipher.Stream {
+	// the counter of the block at pos is the IV plus the block number, as a 128 bits big endian integer
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	carry := uint64(pos / aes.BlockSize)
+	for i := aes.BlockSize - 1; i >= 0 && carry != 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, counter)
+
+	skip := make([]byte, pos%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
+}
+
+// EncryptWriter encrypts the content of a file and computes the MACs of its chunks.
+type EncryptWriter struct {
+	w         io.Writer
+	stream    cipher.Stream
+	mac       hash.Hash
+	iv        []byte
+	chunkSize int64
+	// index and n are the number and the size of the current chunk
+	index int64
+	n     int64
+	size  int64
+	macs  []byte
+}
+
+// NewEncryptWriter returns a writer encrypting the data written to w with the data key of fileKey,
+// Seal must be called once the whole file is written.
+func NewEncryptWriter(w io.Writer, fileKey *FileKey, dataKey []byte) (*EncryptWriter, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	e := &EncryptWriter{
+		w:         w,
+		stream:    cipher.NewCTR(block, fileKey.IV),
+		mac:       newChunkMAC(dataKey),
+		iv:        fileKey.IV,
+		chunkSize: fileKey.ChunkSize,
+	}
+	startChunkMAC(e.mac, e.iv, 0)
+	return e, nil
+}
+
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		// a full chunk is only known not to be the last one when more data comes
+		if e.n == e.chunkSize {
+			e.macs = append(e.macs, endChunkMAC(e.mac, false)...)
+			e.index++
+			e.n = 0
+			startChunkMAC(e.mac, e.iv, e.index)
+		}
+		n := e.chunkSize - e.n
+		if int64(len(p)) < n {
+			n = int64(len(p))
+		}
+		buf := make([]byte, n)
+		e.stream.XORKeyStream(buf, p[:n])
+		m, err := e.w.Write(buf)
+		e.mac.Write(buf[:m])
+		e.n += int64(m)
+		e.size += int64(m)
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Seal sets the size and the MACs of the written file in its key, nothing can be written afterwards.
+func (e *EncryptWriter) Seal(fileKey *FileKey) {
+	fileKey.Size = e.size
+	fileKey.MACs = append(e.macs, endChunkMAC(e.mac, true)...)
+}
+
+// NewDecryptReader returns a reader decrypting r, which must be at the beginning of the encrypted file.
+// The chunks of the file are authenticated with the MACs of its key before they are returned,
+// an ErrFileIntegrity error is returned for a chunk that does not match.
+func NewDecryptReader(r io.ReadSeeker, fileKey *FileKey, dataKey []byte) (io.ReadSeeker, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(fileKey.MACs)) != chunkCount(fileKey.Size, fileKey.ChunkSize)*chunkMACSize {
+		return nil, fmt.Errorf("%w: the file key is not sealed", ErrFileIntegrity)
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size != fileKey.Size {
+		return nil, fmt.Errorf("%w: [%d] bytes are expected, [%d] are stored", ErrFileIntegrity, fileKey.Size, size)
+	}
+	d := &verifyingReader{
+		r:       r,
+		block:   block,
+		mac:     newChunkMAC(dataKey),
+		fileKey: fileKey,
+		chunk:   -1,
+	}
+	// the empty chunk of an empty file is never read
+	if fileKey.Size == 0 {
+		if err = d.readChunk(0); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// verifyingReader decrypts a file by chunks, each chunk is read whole and authenticated before it's returned.
+type verifyingReader struct {
+	r       io.ReadSeeker
+	block   cipher.Block
+	mac     hash.Hash
+	fileKey *FileKey
+	pos     int64
+	// chunk is the index of the decrypted chunk in plain, -1 if none
+	chunk int64
+	plain []byte
+}
+
+func (d *verifyingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.fileKey.Size {
+		return 0, io.EOF
+	}
+	chunk := d.pos / d.fileKey.ChunkSize
+	if chunk != d.chunk {
+		if err := d.readChunk(chunk); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos-chunk*d.fileKey.ChunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *verifyingReader) readChunk(chunk int64) error {
+	offset := chunk * d.fileKey.ChunkSize
+	size := d.fileKey.Size - offset
+	if size > d.fileKey.ChunkSize {
+		size = d.fileKey.ChunkSize
+	}
+	if _, err := d.r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if cap(d.plain) < int(size) {
+		d.plain = make([]byte, size)
+	}
+	d.chunk = -1
+	d.plain = d.plain[:size]
+	if _, err := io.ReadFull(d.r, d.plain); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: chunk [%d] is truncated", ErrFileIntegrity, chunk)
+		}
+		return err
+	}
+
+	startChunkMAC(d.mac, d.fileKey.IV, chunk)
+	d.mac.Write(d.plain)
+	last := chunk == chunkCount(d.fileKey.Size, d.fileKey.ChunkSize)-1
+	expected := d.fileKey.MACs[chunk*chunkMACSize : (chunk+1)*chunkMACSize]
+	if !hmac.Equal(endChunkMAC(d.mac, last), expected) {
+		return fmt.Errorf("%w: chunk [%d] does not match its MAC", ErrFileIntegrity, chunk)
+	}
+	newCTRAt(d.block, d.fileKey.IV, offset).XORKeyStream(d.plain, d.plain)
+	d.chunk = chunk
+	return nil
+}
+
+func (d *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += d.pos
+	case io.SeekEnd:
+		pos += d.fileKey.Size
+	default:
+		return d.pos, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return d.pos, errors.New("negative position")
+	}
+	d.pos = pos
+	return pos, nil
+}
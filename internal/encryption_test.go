@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// plainKeyProvider "wraps" data keys by copying them, the wrapping is not under test.
+type plainKeyProvider struct{}
+
+func (plainKeyProvider) CurrentKeyID() string { return "test" }
+
+func (plainKeyProvider) WrapKey(_ string, dataKey []byte) ([]byte, error) {
+	return append([]byte(nil), dataKey...), nil
+}
+
+func (plainKeyProvider) UnwrapKey(_ string, wrappedKey []byte) ([]byte, error) {
+	return append([]byte(nil), wrappedKey...), nil
+}
+
+// encryptForTest encrypts content by writes of writeSize bytes and returns the sealed key.
+func encryptForTest(t *testing.T, content []byte, chunkSize int64, writeSize int) ([]byte, *FileKey, []byte) {
+	fileKey, dataKey, err := NewFileKey(plainKeyProvider{})
+	require.NoError(t, err)
+	fileKey.ChunkSize = chunkSize
+
+	var encrypted bytes.Buffer
+	w, err := NewEncryptWriter(&encrypted, fileKey, dataKey)
+	require.NoError(t, err)
+	for p := content; len(p) > 0; {
+		n := writeSize
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err = w.Write(p[:n])
+		require.NoError(t, err)
+		p = p[n:]
+	}
+	w.Seal(fileKey)
+
+	// the key is stored as a sidecar
+	var buf bytes.Buffer
+	require.NoError(t, fileKey.Encode(&buf))
+	decoded, err := DecodeFileKey(&buf)
+	require.NoError(t, err)
+	return encrypted.Bytes(), decoded, dataKey
+}
+
+func TestDecryptSeek(t *testing.T) {
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	tests := []struct {
+		name      string
+		content   []byte
+		chunkSize int64
+		writeSize int
+	}{
+		{"single chunk", content, 1024, 100},
+		{"chunks", content, 64, 7},
+		{"chunk aligned size", content[:960], 64, 64},
+		{"empty file", nil, 64, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, fileKey, dataKey := encryptForTest(t, tt.content, tt.chunkSize, tt.writeSize)
+			require.Len(t, encrypted, len(tt.content))
+
+			r, err := NewDecryptReader(bytes.NewReader(encrypted), fileKey, dataKey)
+			require.NoError(t, err)
+			all, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, string(tt.content), string(all))
+
+			// offsets inside a block, on a block boundary, inside and across chunks
+			for _, offset := range []int64{0, 1, 15, 16, 17, 63, 64, 65, 500, int64(len(tt.content)) - 1} {
+				if offset < 0 || offset >= int64(len(tt.content)) {
+					continue
+				}
+				pos, err := r.Seek(offset, io.SeekStart)
+				require.NoError(t, err)
+				require.Equal(t, offset, pos)
+
+				buf := make([]byte, 100)
+				n, err := io.ReadFull(r, buf)
+				if err != io.ErrUnexpectedEOF {
+					require.NoError(t, err)
+				}
+				require.Equal(t, string(tt.content[offset:offset+int64(n)]), string(buf[:n]), "offset %d", offset)
+			}
+		})
+	}
+}
+
+func TestDecryptIntegrity(t *testing.T) {
+	content := bytes.Repeat([]byte("2021-10-19 10:00:00,000 INFO line\n"), 20)
+
+	tests := []struct {
+		name   string
+		tamper func(encrypted []byte, fileKey *FileKey) []byte
+	}{
+		{"flipped bit", func(encrypted []byte, _ *FileKey) []byte {
+			encrypted[100] ^= 1
+			return encrypted
+		}},
+		{"truncated file", func(encrypted []byte, _ *FileKey) []byte {
+			return encrypted[:len(encrypted)-1]
+		}},
+		{"truncated at a chunk boundary", func(encrypted []byte, fileKey *FileKey) []byte {
+			fileKey.Size = 2 * fileKey.ChunkSize
+			fileKey.MACs = fileKey.MACs[:2*chunkMACSize]
+			return encrypted[:fileKey.Size]
+		}},
+		{"swapped chunks", func(encrypted []byte, fileKey *FileKey) []byte {
+			chunk := fileKey.ChunkSize
+			swapped := append([]byte(nil), encrypted...)
+			copy(swapped[:chunk], encrypted[chunk:2*chunk])
+			copy(swapped[chunk:2*chunk], encrypted[:chunk])
+			return swapped
+		}},
+		{"unsealed key", func(encrypted []byte, fileKey *FileKey) []byte {
+			fileKey.MACs = nil
+			return encrypted
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, fileKey, dataKey := encryptForTest(t, content, 64, 50)
+			encrypted = tt.tamper(encrypted, fileKey)
+
+			r, err := NewDecryptReader(bytes.NewReader(encrypted), fileKey, dataKey)
+			if err == nil {
+				_, err = ioutil.ReadAll(r)
+			}
+			require.Error(t, err)
+			require.True(t, errors.Is(err, ErrFileIntegrity), err.Error())
+		})
+	}
+}
+
+func TestDecodeFileKeyInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(fileKey *FileKey)
+	}{
+		{"older version", func(fileKey *FileKey) { fileKey.Version = fileKeyVersion - 1 }},
+		{"newer version", func(fileKey *FileKey) { fileKey.Version = fileKeyVersion + 1 }},
+		{"other algorithm", func(fileKey *FileKey) { fileKey.Algorithm = "AES-128-CTR" }},
+		{"short iv", func(fileKey *FileKey) { fileKey.IV = fileKey.IV[:8] }},
+		{"unaligned chunk size", func(fileKey *FileKey) { fileKey.ChunkSize = 100 }},
+		{"partial mac", func(fileKey *FileKey) { fileKey.MACs = fileKey.MACs[1:] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, fileKey, _ := encryptForTest(t, []byte("line\n"), 64, 5)
+			tt.modify(fileKey)
+
+			var buf bytes.Buffer
+			require.NoError(t, fileKey.Encode(&buf))
+			_, err := DecodeFileKey(&buf)
+			require.Equal(t, ErrInvalidFileKey, err)
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// number of frames of the top-level exception used to build the fingerprint
+	fingerprintFrames = 5
+	// max lines kept as sample of an exception
+	maxSampleLines = 50
+	// max lines of an exception message before the first frame
+	maxMessageLines = 20
+)
+
+var (
+	exceptionHeaderRegexp = regexp.MustCompile(`^(?:Caused by: |Suppressed: )?((?:[a-zA-Z_$][\w$]*\.)+[a-zA-Z_$][\w$]*(?:Exception|Error|Throwable))(?::|\s*$)`)
+	stackFrameRegexp      = regexp.MustCompile(`^\s+at\s+(\S+)`)
+	moreFramesRegexp      = regexp.MustCompile(`^\s+\.\.\. \d+ (?:more|common frames omitted)`)
+	frameModuleRegexp     = regexp.MustCompile(`^[\w.]+@[^/]*/`)
+	frameNumberRegexp     = regexp.MustCompile(`0x[0-9a-fA-F]+|\d+`)
+)
+
+// ExceptionTrace is a java exception with its stack trace found in a log file.
+type ExceptionTrace struct {
+	// Class is the class of the top-level exception.
+	Class string
+	// RootCause is the class of the innermost "Caused by" exception, same as Class if there is none.
+	RootCause string
+	// Frames is the normalized frames of the top-level exception.
+	Frames []string
+	// Lines is the raw text of the exception, truncated to maxSampleLines.
+	Lines []string
+	// Time is the timestamp of the log record the exception belongs to.
+	Time time.Time
+	// LineNo is the line number of the exception header in the log file.
+	LineNo int64
+
+	inCause bool
+}
+
+// Fingerprint identifies exceptions thrown by the same code path,
+// it's built from the exception classes and the top frames with numbers and ids stripped.
+func (e *ExceptionTrace) Fingerprint() string {
+	frames := e.Frames
+	if len(frames) > fingerprintFrames {
+		frames = frames[:fingerprintFrames]
+	}
+	h := sha1.New()
+	_, _ = io.WriteString(h, e.Class+"|"+e.RootCause+"|"+strings.Join(frames, "\n"))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// NormalizeFrame strips file names, line numbers, lambda ids and other numbers from a stack frame.
+func NormalizeFrame(frame string) string {
+	if i := strings.IndexByte(frame, '('); i >= 0 {
+		frame = frame[:i]
+	}
+	frame = frameModuleRegexp.ReplaceAllString(frame, "")
+	return frameNumberRegexp.ReplaceAllString(frame, "")
+}
+
+// ScanExceptions reads the log content from r and calls fn for each exception found.
+func ScanExceptions(r io.Reader, fn func(*ExceptionTrace)) error {
+	var (
+		recordTime time.Time
+		current    *ExceptionTrace
+	)
+
+	flush := func() {
+		if current != nil {
+			fn(current)
+			current = nil
+		}
+	}
+
+	err := ScanLines(r, func(line []byte, lineNo int64, _ int64) error {
+		if t, ok := ParseLogTime(line); ok {
+			flush()
+			recordTime = t
+			return nil
+		}
+
+		text := string(line)
+		if current != nil {
+			switch {
+			case stackFrameRegexp.MatchString(text):
+				if !current.inCause {
+					frame := stackFrameRegexp.FindStringSubmatch(text)[1]
+					current.Frames = append(current.Frames, NormalizeFrame(frame))
+				}
+				current.addLine(text)
+				return nil
+			case moreFramesRegexp.MatchString(text):
+				current.addLine(text)
+				return nil
+			}
+
+			trimmed := strings.TrimSpace(text)
+			if strings.HasPrefix(trimmed, "Caused by: ") || strings.HasPrefix(trimmed, "Suppressed: ") {
+				// only the causes of the top-level exception count as root cause
+				if m := exceptionHeaderRegexp.FindStringSubmatch(text); m != nil && strings.HasPrefix(text, "Caused by: ") {
+					current.RootCause = m[1]
+				}
+				current.inCause = true
+				current.addLine(text)
+				return nil
+			}
+
+			// multi-line exception messages are printed before the first frame
+			if len(current.Frames) == 0 && !current.inCause && len(current.Lines) < maxMessageLines && len(line) != 0 &&
+				!exceptionHeaderRegexp.MatchString(text) {
+				current.addLine(text)
+				return nil
+			}
+			flush()
+		}
+
+		if m := exceptionHeaderRegexp.FindStringSubmatch(text); m != nil {
+			current = &ExceptionTrace{
+				Class:     m[1],
+				RootCause: m[1],
+				Time:      recordTime,
+				LineNo:    lineNo,
+			}
+			current.addLine(text)
+		}
+		return nil
+	})
+	flush()
+	return err
+}
+
+func (e *ExceptionTrace) addLine(line string) {
+	if len(e.Lines) < maxSampleLines {
+		e.Lines = append(e.Lines, line)
+	}
+}
+
+// ExceptionStat is the aggregated occurrences of exceptions with the same fingerprint.
+type ExceptionStat struct {
+	Fingerprint string
+	Class       string
+	RootCause   string
+	Frames      []string
+	Count       int64
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	// Sample is the text of the first occurrence and SampleFile the file it was found in.
+	Sample     string
+	SampleFile string
+}
+
+// ExceptionSummary groups exceptions by fingerprint.
+type ExceptionSummary map[string]*ExceptionStat
+
+// Add counts an exception found in file.
+func (s ExceptionSummary) Add(e *ExceptionTrace, file string) {
+	fp := e.Fingerprint()
+	stat, ok := s[fp]
+	if !ok {
+		frames := e.Frames
+		if len(frames) > fingerprintFrames {
+			frames = frames[:fingerprintFrames]
+		}
+		stat = &ExceptionStat{
+			Fingerprint: fp,
+			Class:       e.Class,
+			RootCause:   e.RootCause,
+			Frames:      frames,
+			Sample:      strings.Join(e.Lines, "\n"),
+			SampleFile:  file,
+		}
+		s[fp] = stat
+	}
+
+	stat.Count++
+	if e.Time.IsZero() {
+		return
+	}
+	if stat.FirstSeen.IsZero() || e.Time.Before(stat.FirstSeen) {
+		stat.FirstSeen = e.Time
+		stat.Sample = strings.Join(e.Lines, "\n")
+		stat.SampleFile = file
+	}
+	if e.Time.After(stat.LastSeen) {
+		stat.LastSeen = e.Time
+	}
+}
+
+// Sorted returns the stats ordered by count desc and then by first occurrence.
+func (s ExceptionSummary) Sorted() []*ExceptionStat {
+	stats := make([]*ExceptionStat, 0, len(s))
+	for _, stat := range s {
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		if !stats[i].FirstSeen.Equal(stats[j].FirstSeen) {
+			return stats[i].FirstSeen.Before(stats[j].FirstSeen)
+		}
+		return stats[i].Fingerprint < stats[j].Fingerprint
+	})
+	return stats
+}
+
+// ExceptionChange is an exception found in both summaries with a different count.
+type ExceptionChange struct {
+	Base   *ExceptionStat
+	Target *ExceptionStat
+}
+
+// CompareExceptionSummary returns the exceptions only found in target, only found in base,
+// and the ones found in both with different counts ordered by the change of count desc.
+func CompareExceptionSummary(base, target ExceptionSummary) (added, disappeared []*ExceptionStat, changed []*ExceptionChange) {
+	for _, stat := range target.Sorted() {
+		baseStat, ok := base[stat.Fingerprint]
+		if !ok {
+			added = append(added, stat)
+			continue
+		}
+		if baseStat.Count != stat.Count {
+			changed = append(changed, &ExceptionChange{Base: baseStat, Target: stat})
+		}
+	}
+	for _, stat := range base.Sorted() {
+		if _, ok := target[stat.Fingerprint]; !ok {
+			disappeared = append(disappeared, stat)
+		}
+	}
+
+	delta := func(c *ExceptionChange) int64 {
+		d := c.Target.Count - c.Base.Count
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+	sort.SliceStable(changed, func(i, j int) bool {
+		return delta(changed[i]) > delta(changed[j])
+	})
+	return
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeFrame(t *testing.T) {
+	tests := []struct {
+		frame string
+		want  string
+	}{
+		{"org.apache.flink.runtime.taskmanager.Task.run(Task.java:100)", "org.apache.flink.runtime.taskmanager.Task.run"},
+		{"org.apache.flink.runtime.taskmanager.Task.run(Task.java:745)", "org.apache.flink.runtime.taskmanager.Task.run"},
+		{"java.base@11.0.2/java.lang.Thread.run(Thread.java:834)", "java.lang.Thread.run"},
+		{"org.example.Job$$Lambda$123/0x0000000800c4b040.apply(Unknown Source)", "org.example.Job$$Lambda$/.apply"},
+		{"sun.reflect.GeneratedMethodAccessor42.invoke(Unknown Source)", "sun.reflect.GeneratedMethodAccessor.invoke"},
+		{"org.example.Job.main(Native Method)", "org.example.Job.main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.frame, func(t *testing.T) {
+			require.Equal(t, tt.want, NormalizeFrame(tt.frame))
+		})
+	}
+}
+
+func TestScanExceptions(t *testing.T) {
+	log := `2021-10-19 10:00:00,000 INFO  org.apache.flink.runtime.taskmanager.Task - Source switched to RUNNING
+2021-10-19 10:01:00,000 WARN  org.apache.flink.runtime.taskmanager.Task - Source switched to FAILED
+java.lang.RuntimeException: Checkpoint 42 failed
+	at org.example.Job$$Lambda$123/0x0000000800c4b040.apply(Unknown Source)
+	at org.apache.flink.runtime.taskmanager.Task.run(Task.java:100)
+Caused by: java.io.IOException: connection reset
+	at org.example.Sink.write(Sink.java:10)
+	... 2 more
+2021-10-19 10:02:00,000 INFO  org.apache.flink.runtime.taskmanager.Task - Source switched to RUNNING
+2021-10-19 10:03:00,000 WARN  org.apache.flink.runtime.taskmanager.Task - Source switched to FAILED
+java.lang.RuntimeException: Checkpoint 43 failed
+	at org.example.Job$$Lambda$456/0x0000000800c4c000.apply(Unknown Source)
+	at org.apache.flink.runtime.taskmanager.Task.run(Task.java:101)
+Caused by: java.io.IOException: connection reset
+	at org.example.Sink.write(Sink.java:12)
+2021-10-19 10:04:00,000 ERROR org.apache.flink.runtime.taskmanager.Task - Source switched to FAILED
+java.lang.RuntimeException: Checkpoint 44 failed
+	at org.example.Job$$Lambda$123/0x0000000800c4b040.apply(Unknown Source)
+	at org.apache.flink.runtime.taskmanager.Task.run(Task.java:100)
+Caused by: java.util.concurrent.TimeoutException
+	at org.example.Sink.write(Sink.java:10)
+2021-10-19 10:05:00,000 ERROR org.apache.flink.runtime.jobmaster.JobMaster - Job failed
+org.apache.flink.runtime.JobException: Recovery is suppressed
+by NoRestartBackoffTimeStrategy
+	at org.apache.flink.runtime.executiongraph.failover.ExecutionFailureHandler.handleFailure(ExecutionFailureHandler.java:138)
+`
+	var traces []*ExceptionTrace
+	require.NoError(t, ScanExceptions(strings.NewReader(log), func(e *ExceptionTrace) {
+		traces = append(traces, e)
+	}))
+	require.Len(t, traces, 4)
+
+	first := traces[0]
+	require.Equal(t, "java.lang.RuntimeException", first.Class)
+	require.Equal(t, "java.io.IOException", first.RootCause)
+	require.Equal(t, int64(3), first.LineNo)
+	require.Equal(t, "2021-10-19 10:01:00", first.Time.Format("2006-01-02 15:04:05"))
+	// the frames of the causes are not part of the top-level frames
+	require.Equal(t, []string{"org.example.Job$$Lambda$/.apply", "org.apache.flink.runtime.taskmanager.Task.run"}, first.Frames)
+	require.Len(t, first.Lines, 6)
+
+	// same code path with other line numbers, lambda ids and messages
+	require.Equal(t, first.Fingerprint(), traces[1].Fingerprint())
+	// same frames with another root cause
+	require.Equal(t, "java.util.concurrent.TimeoutException", traces[2].RootCause)
+	require.NotEqual(t, first.Fingerprint(), traces[2].Fingerprint())
+
+	// a message spanning lines is kept with the exception
+	last := traces[3]
+	require.Equal(t, "org.apache.flink.runtime.JobException", last.Class)
+	require.Equal(t, "by NoRestartBackoffTimeStrategy", last.Lines[1])
+	require.Len(t, last.Frames, 1)
+
+	summary := ExceptionSummary{}
+	for _, trace := range traces {
+		summary.Add(trace, "taskmanager.log")
+	}
+	stats := summary.Sorted()
+	require.Len(t, stats, 3)
+	require.Equal(t, int64(2), stats[0].Count)
+	require.Equal(t, first.Time, stats[0].FirstSeen)
+	require.Equal(t, traces[1].Time, stats[0].LastSeen)
+}
+
+func TestCompareExceptionSummary(t *testing.T) {
+	base := ExceptionSummary{
+		"same":  {Fingerprint: "same", Count: 3},
+		"fewer": {Fingerprint: "fewer", Count: 10},
+		"more":  {Fingerprint: "more", Count: 2},
+		"gone":  {Fingerprint: "gone", Count: 4},
+	}
+	target := ExceptionSummary{
+		"same":  {Fingerprint: "same", Count: 3},
+		"fewer": {Fingerprint: "fewer", Count: 9},
+		"more":  {Fingerprint: "more", Count: 7},
+		"new":   {Fingerprint: "new", Count: 1},
+		"newer": {Fingerprint: "newer", Count: 5},
+	}
+
+	tests := []struct {
+		name        string
+		base        ExceptionSummary
+		target      ExceptionSummary
+		added       []string
+		disappeared []string
+		// fingerprint:base count:target count
+		changed []string
+	}{
+		// added and disappeared are ordered by count desc, changed by the change of count desc
+		{"changes", base, target, []string{"newer", "new"}, []string{"gone"}, []string{"more:2:7", "fewer:10:9"}},
+		{"no change", target, target, nil, nil, nil},
+		{"all new", ExceptionSummary{}, base, []string{"fewer", "gone", "same", "more"}, nil, nil},
+	}
+	fingerprints := func(stats []*ExceptionStat) []string {
+		var fps []string
+		for _, stat := range stats {
+			fps = append(fps, stat.Fingerprint)
+		}
+		return fps
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, disappeared, changed := CompareExceptionSummary(tt.base, tt.target)
+			require.Equal(t, tt.added, fingerprints(added))
+			require.Equal(t, tt.disappeared, fingerprints(disappeared))
+			var changes []string
+			for _, change := range changed {
+				changes = append(changes, fmt.Sprintf("%s:%d:%d", change.Target.Fingerprint, change.Base.Count, change.Target.Count))
+			}
+			require.Equal(t, tt.changed, changes)
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/DataWorkbench/common/qerror"
 	"github.com/DataWorkbench/glog"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 )
 
@@ -20,11 +23,39 @@ type LogFileDir struct {
 	Logs []FileInfo `json:"logs"`
 }
 
+type taskManagersInfo struct {
+	TaskManagers []struct {
+		ID string `json:"id"`
+	} `json:"taskmanagers"`
+}
+
+// The TaskManager ids and log file names returned by a Flink server are spliced into HDFS paths and urls,
+// they must match the same patterns as the ones of requests.
+var (
+	// Flink TaskManager ids, e.g. "10.0.0.1:34567-6f1a2b" or "container_e01_1620000000000_0001_01_000002"
+	TaskManagerIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,256}$`)
+	// log file names, e.g. "flink-root-taskexecutor-0-host.log.1"
+	FileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.:@+-]{1,255}$`)
+)
+
+// ErrInvalidFlinkName is returned if a TaskManager id or a log file name of a Flink server can't be used in a path.
+var ErrInvalidFlinkName = errors.New("invalid name returned by flink server")
+
+// CheckFlinkName checks a name returned by a Flink server against pattern, names starting with a dot
+// are dot segments or hidden metadata files such as line indexes and keys.
+func CheckFlinkName(name string, pattern *regexp.Regexp) error {
+	if strings.HasPrefix(name, ".") || !pattern.MatchString(name) {
+		return fmt.Errorf("%w [%s]", ErrInvalidFlinkName, name)
+	}
+	return nil
+}
+
 // baseServerURL format [http://ip:port]
 // e.g. "http://127.0.0.1:8081"
-func GetTaskManagerIDs(logger *glog.Logger, baseServerURL string) ([]string, error) {
+func GetTaskManagerIDs(ctx context.Context, baseServerURL string) ([]string, error) {
+	logger := glog.FromContext(ctx)
 	apiURL := GetTaskManagersURL(baseServerURL)
-	resp, err := http.Get(apiURL)
+	resp, err := flinkGet(ctx, apiURL)
 	if err != nil {
 		logger.Error().Error("fail to get taskManagers info", err).Fire()
 		return nil, err
@@ -37,35 +68,31 @@ func GetTaskManagerIDs(logger *glog.Logger, baseServerURL string) ([]string, err
 		return nil, err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := readFlinkResponse(resp.Body)
 	if err != nil {
 		logger.Error().Error("read response from flink api failed", err).Fire()
 		return nil, err
 	}
 
-	var taskManagerInfo map[string]interface{}
+	// the body is decoded into a typed struct, so a response of another shape is an error rather than a panic
+	var taskManagerInfo taskManagersInfo
 	err = json.Unmarshal(body, &taskManagerInfo)
 	if err != nil {
 		logger.Error().Error("failed to Unmarshal Json", err).Fire()
 		return nil, err
 	}
 
-	if taskManagerInfo["taskmanagers"] != nil {
-		respTaskManagers := taskManagerInfo["taskmanagers"].([]interface{})
-		taskManagerIDs := []string{}
-		for _, info := range respTaskManagers {
-			id := info.(map[string]interface{})["id"]
-			taskManagerIDs = append(taskManagerIDs, id.(string))
-		}
-		return taskManagerIDs, nil
+	taskManagerIDs := []string{}
+	for _, info := range taskManagerInfo.TaskManagers {
+		taskManagerIDs = append(taskManagerIDs, info.ID)
 	}
-
-	return []string{}, nil
+	return taskManagerIDs, nil
 }
 
 // select the log to upload if there are many Rolling log files
-func SelectLogFileToUpload(logger *glog.Logger, apiURL string) (file FileInfo, err error) {
-	resp, err := http.Get(apiURL)
+func SelectLogFileToUpload(ctx context.Context, apiURL string) (file FileInfo, err error) {
+	logger := glog.FromContext(ctx)
+	resp, err := flinkGet(ctx, apiURL)
 	if err != nil {
 		logger.Error().Error("failed to query api", qerror.RequestForFlinkFailed.Format(apiURL)).Fire()
 		return
@@ -78,7 +105,7 @@ func SelectLogFileToUpload(logger *glog.Logger, apiURL string) (file FileInfo, e
 		return
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := readFlinkResponse(resp.Body)
 	if err != nil {
 		logger.Error().Error("read flink restful api resp data failed", err).Fire()
 		return
@@ -110,8 +137,25 @@ func selectLogFile(files []FileInfo) FileInfo {
 	return FileInfo{}
 }
 
-func DownloadSelectedFile(logger *glog.Logger, fileURL string, writer io.Writer) (err error) {
-	downloadResp, err := http.Get(fileURL)
+// DownloadSelectedFile writes the content of a log file to writer, ErrResponseTooLarge is returned
+// once the max log file size is written if the file is larger, the partial content must be discarded.
+func DownloadSelectedFile(ctx context.Context, fileURL string, writer io.Writer) (err error) {
+	logger := glog.FromContext(ctx)
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return
+	}
+	if err = serverPolicy.checkURL(u); err != nil {
+		logger.Error().Error("refused to download log file from flink", err).Fire()
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return
+	}
+
+	downloadResp, err := flinkClient.Do(req)
 	if err != nil {
 		logger.Error().Error("failed to dowload log file from flink", err).Fire()
 		return
@@ -119,26 +163,131 @@ func DownloadSelectedFile(logger *glog.Logger, fileURL string, writer io.Writer)
 
 	defer downloadResp.Body.Close()
 
-	writtenCount, err := io.Copy(writer, downloadResp.Body)
+	if downloadResp.StatusCode != http.StatusOK {
+		err = qerror.RequestForFlinkFailed.Format(fileURL)
+		logger.Error().Error("status for flink api", err).Fire()
+		return
+	}
+
+	var body io.Reader = downloadResp.Body
+	if maxSize := serverPolicy.maxLogFileSize; maxSize > 0 {
+		if downloadResp.ContentLength > maxSize {
+			err = ErrResponseTooLarge
+			logger.Error().Error("log file is too large to download", err).Fire()
+			return
+		}
+		body = io.LimitReader(body, maxSize)
+	}
+
+	writtenCount, err := io.Copy(writer, body)
 	if err != nil {
 		logger.Error().Error("write data to HDFS file failed", err).Fire()
 		return
 	}
+	// the file is larger than the limit if anything is left past it
+	if maxSize := serverPolicy.maxLogFileSize; maxSize > 0 && writtenCount == maxSize {
+		if n, _ := io.ReadFull(downloadResp.Body, make([]byte, 1)); n != 0 {
+			err = ErrResponseTooLarge
+			logger.Error().Error("log file is too large to download", err).Fire()
+			return
+		}
+	}
 
-	logger.Info().Msg(fmt.Sprintf("file [%s] had written [%d] bytes into hdfs", writtenCount, writtenCount)).Fire()
+	logger.Info().Msg(fmt.Sprintf("file [%s] had written [%d] bytes into hdfs", fileURL, writtenCount)).Fire()
 	return
 }
 
+// VerifyFlinkServer checks that baseServerURL is allowed and serves the Flink REST API,
+// it returns the version of the Flink cluster, e.g. "1.12.2"
+func VerifyFlinkServer(ctx context.Context, baseServerURL string) (string, error) {
+	if err := CheckServerURL(baseServerURL); err != nil {
+		return "", err
+	}
+
+	// the dashboard configuration is served by every Flink REST endpoint
+	var clusterConfig struct {
+		RefreshInterval *int64 `json:"refresh-interval"`
+		FlinkVersion    string `json:"flink-version"`
+	}
+	if err := getFlinkAPI(ctx, GetConfigURL(baseServerURL), &clusterConfig); err != nil {
+		return "", err
+	}
+	if clusterConfig.RefreshInterval == nil || clusterConfig.FlinkVersion == "" {
+		return "", fmt.Errorf("%w: [%s]", ErrNotFlinkServer, baseServerURL)
+	}
+	return clusterConfig.FlinkVersion, nil
+}
+
+// GetJobIDs returns the ids of the jobs of the Flink cluster
+func GetJobIDs(ctx context.Context, baseServerURL string) ([]string, error) {
+	var jobs struct {
+		Jobs []struct {
+			ID string `json:"id"`
+		} `json:"jobs"`
+	}
+	if err := getFlinkAPI(ctx, GetJobsURL(baseServerURL), &jobs); err != nil {
+		return nil, err
+	}
+
+	jobIDs := []string{}
+	for _, job := range jobs.Jobs {
+		jobIDs = append(jobIDs, job.ID)
+	}
+	return jobIDs, nil
+}
+
+// getFlinkAPI queries a flink restful api and decodes the JSON response into v
+func getFlinkAPI(ctx context.Context, apiURL string, v interface{}) error {
+	logger := glog.FromContext(ctx)
+	resp, err := flinkGet(ctx, apiURL)
+	if err != nil {
+		logger.Error().Error("failed to query api", qerror.RequestForFlinkFailed.Format(apiURL)).Fire()
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = qerror.RequestForFlinkFailed.Format(apiURL)
+		logger.Error().Error("status for flink api", err).Fire()
+		return err
+	}
+	if !isJSONResponse(resp) {
+		err = fmt.Errorf("%w: [%s] responded with [%s]", ErrNotFlinkServer, apiURL, resp.Header.Get("Content-Type"))
+		logger.Error().Error("status for flink api", err).Fire()
+		return err
+	}
+
+	body, err := readFlinkResponse(resp.Body)
+	if err != nil {
+		logger.Error().Error("read flink restful api resp data failed", err).Fire()
+		return err
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		logger.Error().Error("parse flink api resp.Body failed", err).Fire()
+		return err
+	}
+	return nil
+}
+
+func GetConfigURL(baseServerURL string) string {
+	return fmt.Sprintf("%s/config", baseServerURL)
+}
+
+func GetJobsURL(baseServerURL string) string {
+	return fmt.Sprintf("%s/jobs", baseServerURL)
+}
+
 func GetTaskManagersURL(baseServerURL string) string {
 	return fmt.Sprintf("%s/taskmanagers", baseServerURL)
 }
 
 func GetTaskManagerLogsURL(baseServerURL, taskManagerID string) string {
-	return fmt.Sprintf("%s/taskmanagers/%s/logs", baseServerURL, taskManagerID)
+	return fmt.Sprintf("%s/taskmanagers/%s/logs", baseServerURL, url.PathEscape(taskManagerID))
 }
 
 func GetTaskManagerLogFileURL(baseServerURL, taskManagerID, fileName string) string {
-	return fmt.Sprintf("%s/taskmanagers/%s/logs/%s", baseServerURL, taskManagerID, fileName)
+	return fmt.Sprintf("%s/taskmanagers/%s/logs/%s", baseServerURL, url.PathEscape(taskManagerID), url.PathEscape(fileName))
 }
 
 func GetJobManagerLogsURL(baseServerURL string) string {
@@ -146,5 +295,5 @@ func GetJobManagerLogsURL(baseServerURL string) string {
 }
 
 func GetJobManagerLogFileURL(baseServerURL, fileName string) string {
-	return fmt.Sprintf("%s/jobmanager/logs/%s", baseServerURL, fileName)
+	return fmt.Sprintf("%s/jobmanager/logs/%s", baseServerURL, url.PathEscape(fileName))
 }
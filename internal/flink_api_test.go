@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFlinkName(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		isTMID  bool
+		allowed bool
+	}{
+		{"log file", "flink-root-taskexecutor-0-host.log", false, true},
+		{"rolled log file", "flink-root-taskexecutor-0-host.log.1", false, true},
+		{"taskmanager id", "10.0.0.1:34567-6f1a2b", true, true},
+		{"yarn container id", "container_e01_1620000000000_0001_01_000002", true, true},
+		{"empty", "", false, false},
+		{"manifest", ".manifest.json", false, false},
+		{"key sidecar", ".x.log.key", false, false},
+		{"dot segment", "..", true, false},
+		{"subdir", "a/b.log", false, false},
+		{"subdir id", "a/b", true, false},
+		{"escaped separator", "a%2Fb.log", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern := FileNameRegexp
+			if tt.isTMID {
+				pattern = TaskManagerIDRegexp
+			}
+			err := CheckFlinkName(tt.value, pattern)
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.True(t, errors.Is(err, ErrInvalidFlinkName), "got %v", err)
+			}
+		})
+	}
+}
+
+func TestFlinkLogFileURL(t *testing.T) {
+	require.Equal(t, "http://flink:8081/taskmanagers/10.0.0.1:34567-6f1a2b/logs/taskmanager.log",
+		GetTaskManagerLogFileURL("http://flink:8081", "10.0.0.1:34567-6f1a2b", "taskmanager.log"))
+	require.Equal(t, "http://flink:8081/taskmanagers/a%2Fb/logs/c%3Fd",
+		GetTaskManagerLogFileURL("http://flink:8081", "a/b", "c?d"))
+	require.Equal(t, "http://flink:8081/jobmanager/logs/a%2F..%2Fb",
+		GetJobManagerLogFileURL("http://flink:8081", "a/../b"))
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DataWorkbench/logmanager/config"
+)
+
+const (
+	defaultMaxResponseSize = 4 << 20
+	maxFlinkRedirects      = 3
+)
+
+var (
+	// ErrInvalidServerURL is returned if a Flink server url is malformed.
+	ErrInvalidServerURL = errors.New("invalid flink server url")
+	// ErrURLNotAllowed is returned if a Flink server url or the address it resolves to is not allowed.
+	ErrURLNotAllowed = errors.New("flink server url is not allowed")
+	// ErrResponseTooLarge is returned if a Flink response exceeds the configured size limit.
+	ErrResponseTooLarge = errors.New("flink response exceeds the size limit")
+	// ErrNotFlinkServer is returned if the server does not answer like the Flink REST API.
+	ErrNotFlinkServer = errors.New("server does not speak the Flink REST API")
+)
+
+// loopback, link-local (cloud metadata services), unspecified, multicast and private addresses
+// (RFC 1918, shared address space and unique local addresses) are only reachable if they are listed
+// in the allowed CIDRs, so the internal services are not reachable through a caller-chosen url
+var deniedByDefaultNets = mustParseCIDRs("127.0.0.0/8", "::1/128", "169.254.0.0/16", "fe80::/10",
+	"0.0.0.0/8", "::/128", "224.0.0.0/4", "ff00::/8",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+// flinkPolicy decides which Flink servers the service may send requests to.
+type flinkPolicy struct {
+	schemes      map[string]bool
+	hostPatterns []string
+	// empty for any address except the denied by default ones
+	nets            []*net.IPNet
+	maxResponseSize int64
+	// 0 means no limit
+	maxLogFileSize int64
+	// nil for the default TLS settings
+	tlsConfig *tls.Config
+}
+
+var (
+	serverPolicy = &flinkPolicy{schemes: map[string]bool{"http": true, "https": true}, maxResponseSize: defaultMaxResponseSize}
+	flinkClient  = newFlinkClient(serverPolicy)
+)
+
+// InitFlinkClient applies the allowlist and size limits to all the requests sent to Flink servers.
+func InitFlinkClient(cfg *config.FlinkClientConfig) error {
+	p := &flinkPolicy{
+		schemes:         make(map[string]bool),
+		maxResponseSize: cfg.MaxResponseSize,
+		maxLogFileSize:  cfg.MaxLogFileSize,
+	}
+	for _, scheme := range splitList(cfg.AllowedSchemes) {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("unsupported scheme [%s] for flink server", scheme)
+		}
+		p.schemes[scheme] = true
+	}
+	for _, pattern := range splitList(cfg.AllowedHosts) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern [%s], %s", pattern, err.Error())
+		}
+		p.hostPatterns = append(p.hostPatterns, pattern)
+	}
+	for _, cidr := range splitList(cfg.AllowedCIDRs) {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR [%s], %s", cidr, err.Error())
+		}
+		p.nets = append(p.nets, ipNet)
+	}
+	if p.maxResponseSize <= 0 {
+		p.maxResponseSize = defaultMaxResponseSize
+	}
+	if cfg.TLS != nil {
+		tlsConfig, err := newFlinkTLSConfig(cfg.TLS)
+		if err != nil {
+			return err
+		}
+		p.tlsConfig = tlsConfig
+	}
+
+	serverPolicy = p
+	flinkClient = newFlinkClient(p)
+	return nil
+}
+
+// newFlinkTLSConfig loads the CAs and the client certificate the https requests are sent with.
+func newFlinkTLSConfig(cfg *config.FlinkTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read flink CA file failed, %s", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in flink CA file [%s]", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load flink client certificate failed, %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newFlinkClient returns a client that checks the address of every connection it dials,
+// so a host name resolving to a denied address after the url check (DNS rebinding) is still rejected.
+func newFlinkClient(p *flinkPolicy) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   p.control,
+	}
+	transport := &http.Transport{
+		// a proxy would connect on our behalf without the address check
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       p.tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   8,
+	}
+	return &http.Client{
+		Transport: &instrumentedTransport{next: transport},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFlinkRedirects {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			return p.checkURL(req.URL)
+		},
+	}
+}
+
+// control is called with the resolved address right before a connection is made.
+func (p *flinkPolicy) control(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !p.allowIP(ip) {
+		return fmt.Errorf("%w: connect to [%s]", ErrURLNotAllowed, address)
+	}
+	return nil
+}
+
+func (p *flinkPolicy) allowIP(ip net.IP) bool {
+	if len(p.nets) != 0 {
+		return containsIP(p.nets, ip)
+	}
+	return !containsIP(deniedByDefaultNets, ip)
+}
+
+func (p *flinkPolicy) allowHost(host string) bool {
+	if len(p.hostPatterns) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range p.hostPatterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *flinkPolicy) checkURL(u *url.URL) error {
+	if !p.schemes[u.Scheme] {
+		return fmt.Errorf("%w: scheme [%s]", ErrURLNotAllowed, u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("%w: empty host", ErrURLNotAllowed)
+	}
+	if !p.allowHost(host) {
+		return fmt.Errorf("%w: host [%s]", ErrURLNotAllowed, host)
+	}
+	// host names are checked once resolved, when connecting
+	if ip := net.ParseIP(host); ip != nil && !p.allowIP(ip) {
+		return fmt.Errorf("%w: address [%s]", ErrURLNotAllowed, host)
+	}
+	return nil
+}
+
+// CheckServerURL checks that baseServerURL is a plain [scheme://host:port] url allowed by the policy.
+func CheckServerURL(baseServerURL string) error {
+	u, err := url.Parse(baseServerURL)
+	if err != nil {
+		return fmt.Errorf("%w [%s], %s", ErrInvalidServerURL, baseServerURL, err.Error())
+	}
+	if u.Opaque != "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%w [%s], only scheme, host and path are expected", ErrInvalidServerURL, baseServerURL)
+	}
+	return serverPolicy.checkURL(u)
+}
+
+// flinkGet sends a GET request to a Flink server, apiURL is checked against the policy before.
+func flinkGet(ctx context.Context, apiURL string) (*http.Response, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, err
+	}
+	if err = serverPolicy.checkURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return flinkClient.Do(req)
+}
+
+// readFlinkResponse reads the body of a Flink REST API response up to the size limit.
+func readFlinkResponse(body io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, serverPolicy.maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > serverPolicy.maxResponseSize {
+		return nil, ErrResponseTooLarge
+	}
+	return b, nil
+}
+
+// isJSONResponse reports whether the response is declared as JSON, as all the Flink REST API responses are.
+func isJSONResponse(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// splitList splits a comma separated config value, empty items are dropped.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
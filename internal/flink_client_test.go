@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlinkPolicyCheckURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   []string
+		cidrs   []string
+		rawURL  string
+		allowed bool
+	}{
+		{"http", nil, nil, "http://flink.example.com:8081", true},
+		{"https", nil, nil, "https://203.0.113.10:8081", true},
+		{"private address", nil, nil, "http://10.1.2.3:8081", false},
+		{"ftp", nil, nil, "ftp://flink.example.com", false},
+		{"empty host", nil, nil, "http://:8081", false},
+		{"loopback", nil, nil, "http://127.0.0.1:8081", false},
+		{"ipv6 loopback", nil, nil, "http://[::1]:8081", false},
+		{"ipv4-mapped loopback", nil, nil, "http://[::ffff:127.0.0.1]:8081", false},
+		{"metadata service", nil, nil, "http://169.254.169.254/latest/meta-data", false},
+		{"ipv4-mapped metadata service", nil, nil, "http://[::ffff:169.254.169.254]/", false},
+		{"unspecified", nil, nil, "http://0.0.0.0:8081", false},
+		{"host pattern", []string{"flink-*.example.com"}, []string{"10.0.0.0/8"}, "http://flink-1.example.com:8081", true},
+		{"host pattern case", []string{"flink-*.example.com"}, []string{"10.0.0.0/8"}, "http://FLINK-1.example.com:8081", true},
+		{"host not in patterns", []string{"flink-*.example.com"}, []string{"10.0.0.0/8"}, "http://other.example.com:8081", false},
+		{"address not in nets", []string{"flink-*.example.com"}, []string{"10.0.0.0/8"}, "http://192.168.0.1:8081", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.rawURL)
+			require.NoError(t, err)
+			p := &flinkPolicy{
+				schemes:      map[string]bool{"http": true, "https": true},
+				hostPatterns: tt.hosts,
+				nets:         mustParseCIDRs(tt.cidrs...),
+			}
+			err = p.checkURL(u)
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.True(t, errors.Is(err, ErrURLNotAllowed), "got %v", err)
+			}
+		})
+	}
+}
+
+func TestFlinkPolicyControl(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   []string
+		address string
+		allowed bool
+	}{
+		{"public address", nil, "203.0.113.10:8081", true},
+		{"rfc1918 10/8", nil, "10.0.0.1:8081", false},
+		{"rfc1918 172.16/12", nil, "172.31.255.1:8081", false},
+		{"rfc1918 192.168/16", nil, "192.168.128.12:8081", false},
+		{"shared address space", nil, "100.64.0.1:8081", false},
+		{"unique local address", nil, "[fd00::1]:8081", false},
+		{"ipv4-mapped private address", nil, "[::ffff:10.0.0.1]:8081", false},
+		{"listed private address", []string{"10.0.0.0/8"}, "10.0.0.1:8081", true},
+		{"ipv6 address", nil, "[2001:db8::1]:8081", true},
+		{"loopback", nil, "127.0.0.1:8081", false},
+		{"ipv4-mapped loopback", nil, "[::ffff:127.0.0.1]:8081", false},
+		{"metadata service", nil, "169.254.169.254:80", false},
+		{"ipv4-mapped metadata service", nil, "[::ffff:169.254.169.254]:80", false},
+		{"link-local ipv6", nil, "[fe80::1]:8081", false},
+		{"listed loopback", []string{"127.0.0.0/8"}, "127.0.0.1:8081", true},
+		{"listed ipv4-mapped loopback", []string{"127.0.0.0/8"}, "[::ffff:127.0.0.1]:8081", true},
+		{"not listed", []string{"127.0.0.0/8"}, "10.0.0.1:8081", false},
+		{"host name", nil, "localhost:8081", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &flinkPolicy{nets: mustParseCIDRs(tt.cidrs...)}
+			err := p.control("tcp", tt.address, nil)
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.True(t, errors.Is(err, ErrURLNotAllowed), "got %v", err)
+			}
+		})
+	}
+}
+
+func TestFlinkClientRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	}))
+	defer server.Close()
+
+	// the test server listens on the loopback address
+	client := newFlinkClient(&flinkPolicy{
+		schemes:         map[string]bool{"http": true},
+		nets:            mustParseCIDRs("127.0.0.0/8"),
+		maxResponseSize: defaultMaxResponseSize,
+	})
+
+	get := func(path string) error {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	t.Run("to metadata service", func(t *testing.T) {
+		err := get("/redirect")
+		require.True(t, errors.Is(err, ErrURLNotAllowed), "got %v", err)
+	})
+	t.Run("too many redirects", func(t *testing.T) {
+		err := get("/loop")
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrURLNotAllowed))
+	})
+}
+
+func TestFlinkClientDialCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	// the host name passes the url check, the address it resolves to is checked when dialing
+	u, err := url.Parse("http://localhost:" + port)
+	require.NoError(t, err)
+	p := &flinkPolicy{schemes: map[string]bool{"http": true}, maxResponseSize: defaultMaxResponseSize}
+	require.NoError(t, p.checkURL(u))
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, u.String(), nil)
+	require.NoError(t, err)
+	_, err = newFlinkClient(p).Do(req)
+	require.True(t, errors.Is(err, ErrURLNotAllowed), "got %v", err)
+}
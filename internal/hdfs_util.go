@@ -1,21 +1,51 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"github.com/DataWorkbench/logmanager/config"
 	"github.com/colinmarc/hdfs/v2"
+	"net"
 	"os"
 	"strings"
+	"time"
 )
 
-func GetClient(hdfsConfig *config.HdfsConfig) (*hdfs.Client, error) {
+func GetClient(ctx context.Context, hdfsConfig *config.HdfsConfig) (*hdfs.Client, error) {
+	return newClient(ctx, clientOptions(hdfsConfig))
+}
+
+// GetClientWithDeadline returns a client whose connections to the NameNode fail once deadline is passed,
+// so that the calls to a NameNode that does not answer never hang.
+func GetClientWithDeadline(ctx context.Context, hdfsConfig *config.HdfsConfig, deadline time.Time) (*hdfs.Client, error) {
+	options := clientOptions(hdfsConfig)
+	options.NamenodeDialFunc = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := (&net.Dialer{Deadline: deadline}).DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err = conn.SetDeadline(deadline); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return newClient(ctx, options)
+}
+
+func clientOptions(hdfsConfig *config.HdfsConfig) hdfs.ClientOptions {
 	nameNodesAddr := strings.Split(hdfsConfig.Addresses, ",")
-	options := hdfs.ClientOptions{
+	return hdfs.ClientOptions{
 		Addresses:           nameNodesAddr,
 		User:                hdfsConfig.UserName,
 		UseDatanodeHostname: false,
 	}
+}
+
+func newClient(ctx context.Context, options hdfs.ClientOptions) (*hdfs.Client, error) {
+	finish := StartHdfsOperation(ctx, "connect")
 	client, err := hdfs.NewClient(options)
+	finish(err)
 	if err != nil {
 		return nil, err
 	}
@@ -23,8 +53,10 @@ func GetClient(hdfsConfig *config.HdfsConfig) (*hdfs.Client, error) {
 	return client, nil
 }
 
-func StatFilesInDir(client *hdfs.Client, dirPath string) ([]os.FileInfo, error) {
+func StatFilesInDir(ctx context.Context, client *hdfs.Client, dirPath string) ([]os.FileInfo, error) {
+	finish := StartHdfsOperation(ctx, "readdir")
 	fileInfos, err := client.ReadDir(dirPath)
+	finish(err)
 	if err != nil {
 		return nil, err
 	}
@@ -32,14 +64,119 @@ func StatFilesInDir(client *hdfs.Client, dirPath string) ([]os.FileInfo, error)
 	return fileInfos, nil
 }
 
-func StatFile(client *hdfs.Client, filePath string) (os.FileInfo, error) {
+func StatFile(ctx context.Context, client *hdfs.Client, filePath string) (os.FileInfo, error) {
+	finish := StartHdfsOperation(ctx, "stat")
 	fileInfo, err := client.Stat(filePath)
+	finish(err)
 	if err != nil {
 		return nil, err
 	}
 	return fileInfo, nil
 }
 
+// OpenFile opens an HDFS file for reading.
+func OpenFile(ctx context.Context, client *hdfs.Client, filePath string) (*HdfsReader, error) {
+	finish := StartHdfsOperation(ctx, "open")
+	f, err := client.Open(filePath)
+	finish(err)
+	if err != nil {
+		return nil, err
+	}
+	return &HdfsReader{FileReader: f}, nil
+}
+
+// CreateFile creates an HDFS file, it fails if the file exists.
+func CreateFile(ctx context.Context, client *hdfs.Client, filePath string) (*HdfsWriter, error) {
+	finish := StartHdfsOperation(ctx, "create")
+	f, err := client.Create(filePath)
+	finish(err)
+	if err != nil {
+		return nil, err
+	}
+	return &HdfsWriter{FileWriter: f}, nil
+}
+
+func RemoveFile(ctx context.Context, client *hdfs.Client, filePath string) error {
+	finish := StartHdfsOperation(ctx, "remove")
+	err := client.Remove(filePath)
+	finish(err)
+	return err
+}
+
+// RemoveDir removes a dir and all the files under it.
+func RemoveDir(ctx context.Context, client *hdfs.Client, dirPath string) error {
+	finish := StartHdfsOperation(ctx, "remove")
+	err := client.RemoveAll(dirPath)
+	finish(err)
+	return err
+}
+
+func RenameFile(ctx context.Context, client *hdfs.Client, oldPath, newPath string) error {
+	finish := StartHdfsOperation(ctx, "rename")
+	err := client.Rename(oldPath, newPath)
+	finish(err)
+	return err
+}
+
+// StatDirUsage returns the total bytes and the number of files under a dir,
+// the dir is walked if the NameNode does not provide its content summary.
+func StatDirUsage(ctx context.Context, client *hdfs.Client, dirPath string) (size int64, fileCount int, err error) {
+	finish := StartHdfsOperation(ctx, "content_summary")
+	summary, err := client.GetContentSummary(dirPath)
+	finish(err)
+	if err == nil {
+		return summary.Size(), summary.FileCount(), nil
+	}
+	if os.IsNotExist(err) {
+		return
+	}
+
+	size, fileCount = 0, 0
+	err = client.Walk(dirPath, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+			fileCount++
+		}
+		return nil
+	})
+	return
+}
+
+func GetHdfsSpaceDirPath(space_id string) string {
+	return fmt.Sprintf("/%s", space_id)
+}
+
+func GetHdfsFlowDirPath(space_id, flow_id string) string {
+	return fmt.Sprintf("/%s/%s", space_id, flow_id)
+}
+
+func GetHdfsInstanceDirPath(space_id, flow_id, inst_id string) string {
+	return fmt.Sprintf("/%s/%s/%s", space_id, flow_id, inst_id)
+}
+
+func GetHdfsLogsDirPath(space_id, flow_id, inst_id string) string {
+	return fmt.Sprintf("/%s/%s/%s/logs", space_id, flow_id, inst_id)
+}
+
+// GetHdfsArchiveFilePath returns the path of an archive the logs dir of an instance is packed into,
+// the current one is named by the archive index.
+func GetHdfsArchiveFilePath(space_id, flow_id, inst_id, archiveName string) string {
+	return fmt.Sprintf("/%s/%s/%s/%s", space_id, flow_id, inst_id, archiveName)
+}
+
+// GetHdfsArchiveIndexPath returns the path of the member index of an instance archive.
+func GetHdfsArchiveIndexPath(space_id, flow_id, inst_id string) string {
+	return fmt.Sprintf("/%s/%s/%s/.logs.tar.idx", space_id, flow_id, inst_id)
+}
+
+// GetHdfsManifestPath returns the path of the manifest of what was collected for an instance.
+func GetHdfsManifestPath(space_id, flow_id, inst_id string) string {
+	return fmt.Sprintf("/%s/%s/%s/.manifest.json", space_id, flow_id, inst_id)
+}
+
 func GetHdfsDirPath(space_id, flow_id, inst_id, managerName string) string {
 	return fmt.Sprintf("/%s/%s/%s/logs/%s", space_id, flow_id, inst_id, managerName)
 }
@@ -51,3 +188,22 @@ func GetHdfsJobMgrFilePath(space_id, flow_id, inst_id, fileName string) string {
 func GetHdfsTaskMgrFilePath(space_id, flow_id, inst_id, taskManagerID, fileName string) string {
 	return fmt.Sprintf("/%s/%s/%s/logs/taskmanager/%s/%s", space_id, flow_id, inst_id, taskManagerID, fileName)
 }
+
+// ParseHdfsLogFilePath splits a log file path built by GetHdfsJobMgrFilePath or GetHdfsTaskMgrFilePath
+// into the ids and the path relative to the logs dir of the instance.
+func ParseHdfsLogFilePath(filePath string) (space_id, flow_id, inst_id, relPath string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(filePath, "/"), "/", 5)
+	if len(parts) != 5 || parts[3] != "logs" {
+		return
+	}
+	return parts[0], parts[1], parts[2], parts[4], true
+}
+
+// ParseHdfsInstanceDirPath splits a dir path built by GetHdfsInstanceDirPath into the ids.
+func ParseHdfsInstanceDirPath(dirPath string) (space_id, flow_id, inst_id string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(dirPath, "/"), "/")
+	if len(parts) != 3 {
+		return
+	}
+	return parts[0], parts[1], parts[2], true
+}
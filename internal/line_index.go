@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// LineIndexInterval is the number of lines between two entries of a line index.
+	LineIndexInterval = 1000
+
+	lineIndexMagic   = "DWLI"
+	lineIndexVersion = 1
+	lineIndexSuffix  = ".idx"
+)
+
+var ErrInvalidLineIndex = errors.New("invalid line index")
+
+// LineIndexEntry records where a block of LineIndexInterval lines begins.
+type LineIndexEntry struct {
+	// Line is the 1-based line number of the first line of the block.
+	Line int64
+	// Offset is the byte offset of the first line of the block.
+	Offset int64
+	// Time is the first log timestamp (unix milliseconds) found in the block, 0 if there is none.
+	Time int64
+}
+
+// LineIndex is a sparse index over the lines of a log file,
+// it's stored as a hidden sidecar file next to the log file.
+type LineIndex struct {
+	Interval int64
+	// Lines and Size are the number of lines and bytes of the indexed file,
+	// an index whose Size differs from the file is stale.
+	Lines   int64
+	Size    int64
+	Entries []LineIndexEntry
+}
+
+// LineIndexPath returns the path of the line index of a log file.
+func LineIndexPath(filePath string) string {
+	return path.Join(path.Dir(filePath), "."+path.Base(filePath)+lineIndexSuffix)
+}
+
+// IsHiddenFile reports whether the file is a metadata file maintained by logmanager
+// that must not be listed as a log file.
+func IsHiddenFile(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// LineIndexBuilder builds a LineIndex from the lines of a file, AddLine can be used as a LineFunc.
+type LineIndexBuilder struct {
+	index LineIndex
+}
+
+func NewLineIndexBuilder(interval int64) *LineIndexBuilder {
+	return &LineIndexBuilder{index: LineIndex{Interval: interval}}
+}
+
+func (b *LineIndexBuilder) AddLine(line []byte, lineNo int64, offset int64) error {
+	idx := &b.index
+	if (lineNo-1)%idx.Interval == 0 {
+		idx.Entries = append(idx.Entries, LineIndexEntry{Line: lineNo, Offset: offset})
+	}
+	if entry := &idx.Entries[len(idx.Entries)-1]; entry.Time == 0 {
+		if t, ok := ParseLogTime(line); ok {
+			entry.Time = UnixMilli(t)
+		}
+	}
+	return nil
+}
+
+// Index returns the index of a file with the given number of lines and bytes.
+func (b *LineIndexBuilder) Index(lines, size int64) *LineIndex {
+	b.index.Lines = lines
+	b.index.Size = size
+	return &b.index
+}
+
+// Seek returns the last entry at or before the line.
+func (idx *LineIndex) Seek(line int64) LineIndexEntry {
+	i := sort.Search(len(idx.Entries), func(i int) bool {
+		return idx.Entries[i].Line > line
+	})
+	if i == 0 {
+		return LineIndexEntry{Line: 1}
+	}
+	return idx.Entries[i-1]
+}
+
+// SeekTime returns the last entry whose block begins before the time (unix milliseconds),
+// the first log record at or after the time is in that block or a later one.
+func (idx *LineIndex) SeekTime(t int64) LineIndexEntry {
+	result := LineIndexEntry{Line: 1}
+	for _, entry := range idx.Entries {
+		if entry.Time == 0 {
+			continue
+		}
+		if entry.Time >= t {
+			break
+		}
+		result = entry
+	}
+	return result
+}
+
+// Encode writes the index in a compact binary format with delta encoded entries.
+func (idx *LineIndex) Encode(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(lineIndexMagic)
+	buf.WriteByte(lineIndexVersion)
+
+	tmp := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v int64) {
+		buf.Write(tmp[:binary.PutUvarint(tmp, uint64(v))])
+	}
+	putVarint := func(v int64) {
+		buf.Write(tmp[:binary.PutVarint(tmp, v)])
+	}
+
+	putUvarint(idx.Interval)
+	putUvarint(idx.Lines)
+	putUvarint(idx.Size)
+	putUvarint(int64(len(idx.Entries)))
+
+	var prev LineIndexEntry
+	for _, entry := range idx.Entries {
+		putUvarint(entry.Line - prev.Line)
+		putUvarint(entry.Offset - prev.Offset)
+		putVarint(entry.Time - prev.Time)
+		prev = entry
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// DecodeLineIndex reads an index written by Encode.
+func DecodeLineIndex(r io.Reader) (*LineIndex, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(lineIndexMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrInvalidLineIndex
+	}
+	if string(header[:len(lineIndexMagic)]) != lineIndexMagic || header[len(lineIndexMagic)] != lineIndexVersion {
+		return nil, ErrInvalidLineIndex
+	}
+
+	var err error
+	readUvarint := func() int64 {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = binary.ReadUvarint(br)
+		return int64(v)
+	}
+	readVarint := func() int64 {
+		if err != nil {
+			return 0
+		}
+		var v int64
+		v, err = binary.ReadVarint(br)
+		return v
+	}
+
+	idx := &LineIndex{
+		Interval: readUvarint(),
+		Lines:    readUvarint(),
+		Size:     readUvarint(),
+	}
+	count := readUvarint()
+	if err != nil || idx.Interval <= 0 || count < 0 || count > idx.Lines/idx.Interval+1 {
+		return nil, ErrInvalidLineIndex
+	}
+
+	idx.Entries = make([]LineIndexEntry, count)
+	var prev LineIndexEntry
+	for i := range idx.Entries {
+		entry := LineIndexEntry{
+			Line:   prev.Line + readUvarint(),
+			Offset: prev.Offset + readUvarint(),
+			Time:   prev.Time + readVarint(),
+		}
+		idx.Entries[i] = entry
+		prev = entry
+	}
+	if err != nil {
+		return nil, ErrInvalidLineIndex
+	}
+	return idx, nil
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// records begin every other line, their timestamps go back so the time deltas are negative
+const lineIndexContent = `2021-09-28 10:00:00,001 INFO line 1
+	at frame 2
+2021-09-27 10:00:00,003 INFO line 3
+	at frame 4
+2021-09-26 10:00:00,005 INFO line 5
+	at frame 6
+2021-09-25 10:00:00,007 INFO line 7
+`
+
+func buildLineIndex(t *testing.T, content string, interval int64) *LineIndex {
+	b := NewLineIndexBuilder(interval)
+	w := NewLineWriter(b.AddLine)
+	_, err := w.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return b.Index(w.Lines(), w.Written())
+}
+
+func TestLineIndexRoundTrip(t *testing.T) {
+	lines := strings.SplitAfter(lineIndexContent, "\n")
+	tests := []struct {
+		interval int64
+		entries  int
+	}{
+		{1, 7},
+		{3, 3},
+		{6, 2},
+		{100, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("interval %d", tt.interval), func(t *testing.T) {
+			idx := buildLineIndex(t, lineIndexContent, tt.interval)
+			require.Equal(t, int64(7), idx.Lines)
+			require.Equal(t, int64(len(lineIndexContent)), idx.Size)
+			require.Len(t, idx.Entries, tt.entries)
+
+			var buf bytes.Buffer
+			require.NoError(t, idx.Encode(&buf))
+			decoded, err := DecodeLineIndex(&buf)
+			require.NoError(t, err)
+			require.Equal(t, idx, decoded)
+
+			for line := int64(1); line <= 7; line++ {
+				entry := decoded.Seek(line)
+				require.Equal(t, (line-1)/tt.interval*tt.interval+1, entry.Line)
+				require.True(t, strings.HasPrefix(lineIndexContent[entry.Offset:], lines[entry.Line-1]),
+					"offset %d of line %d", entry.Offset, entry.Line)
+			}
+		})
+	}
+}
+
+func TestLineIndexSeekTime(t *testing.T) {
+	content := "no time yet\n" +
+		"2021-09-28 10:00:00,000 INFO a\n" +
+		"2021-09-28 10:00:01,000 INFO b\n" +
+		"2021-09-28 10:00:02,000 INFO c\n"
+	idx := buildLineIndex(t, content, 1)
+	require.Equal(t, int64(0), idx.Entries[0].Time)
+
+	second, _ := ParseLogTime([]byte("2021-09-28 10:00:01,000"))
+	require.Equal(t, int64(2), idx.SeekTime(UnixMilli(second)).Line)
+	require.Equal(t, int64(3), idx.SeekTime(UnixMilli(second)+1).Line)
+	require.Equal(t, int64(1), idx.SeekTime(0).Line)
+}
+
+func TestDecodeLineIndexInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, buildLineIndex(t, lineIndexContent, 3).Encode(&buf))
+	encoded := buf.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte("XXXX"), encoded[4:]...)},
+		{"bad version", append(append([]byte(lineIndexMagic), lineIndexVersion+1), encoded[5:]...)},
+		{"truncated", encoded[:len(encoded)-1]},
+		{"too many entries", func() []byte {
+			var b bytes.Buffer
+			idx := &LineIndex{Interval: 10, Lines: 5, Size: 10, Entries: make([]LineIndexEntry, 3)}
+			require.NoError(t, idx.Encode(&b))
+			return b.Bytes()
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeLineIndex(bytes.NewReader(tt.data))
+			require.Equal(t, ErrInvalidLineIndex, err)
+		})
+	}
+}
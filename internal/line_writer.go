@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+)
+
+// MaxLineLength is the max length of a line passed to LineFunc,
+// the rest of a longer line is dropped.
+const MaxLineLength = 64 * 1024
+
+// LineFunc is called for each line of a log file.
+// lineNo starts from 1 and offset is the position of the first byte of the line.
+// The line does not contain the trailing line break and is only valid during the call.
+type LineFunc func(line []byte, lineNo int64, offset int64) error
+
+// LineWriter is an io.Writer that splits the data written into lines
+// and calls fn for each of them, so that a log file can be analysed while it
+// is being copied somewhere else.
+type LineWriter struct {
+	fn LineFunc
+
+	buf       []byte
+	lineNo    int64
+	lineStart int64 // offset of the line being buffered
+	written   int64 // total bytes written
+}
+
+func NewLineWriter(fn LineFunc) *LineWriter {
+	return &LineWriter{fn: fn}
+}
+
+func (w *LineWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.buffer(p)
+			w.written += int64(len(p))
+			return
+		}
+
+		w.buffer(p[:i])
+		w.written += int64(i + 1)
+		p = p[i+1:]
+		if err = w.emit(); err != nil {
+			return
+		}
+		w.lineStart = w.written
+	}
+	return
+}
+
+// Close flushes the last line if the data is not terminated by a line break.
+func (w *LineWriter) Close() error {
+	if w.written == w.lineStart {
+		return nil
+	}
+	err := w.emit()
+	w.lineStart = w.written
+	return err
+}
+
+// Lines returns the number of lines emitted.
+func (w *LineWriter) Lines() int64 {
+	return w.lineNo
+}
+
+// Written returns the number of bytes written.
+func (w *LineWriter) Written() int64 {
+	return w.written
+}
+
+func (w *LineWriter) buffer(p []byte) {
+	if room := MaxLineLength - len(w.buf); room < len(p) {
+		p = p[:room]
+	}
+	w.buf = append(w.buf, p...)
+}
+
+func (w *LineWriter) emit() error {
+	w.lineNo++
+	line := bytes.TrimSuffix(w.buf, []byte{'\r'})
+	err := w.fn(line, w.lineNo, w.lineStart)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// ScanLines reads all data from r and calls fn for each line.
+func ScanLines(r io.Reader, fn LineFunc) error {
+	w := NewLineWriter(fn)
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
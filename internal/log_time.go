@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"regexp"
+	"time"
+)
+
+// Flink writes log records with the log4j pattern "%d{yyyy-MM-dd HH:mm:ss,SSS} ..."
+var logTimeRegexp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2})(?:[,.](\d{3}))?`)
+
+// ParseLogTime returns the timestamp at the beginning of a log record line,
+// ok is false if the line is not the first line of a log record.
+func ParseLogTime(line []byte) (t time.Time, ok bool) {
+	m := logTimeRegexp.FindSubmatch(line)
+	if m == nil {
+		return
+	}
+
+	value := string(m[1])
+	if value[10] == 'T' {
+		value = value[:10] + " " + value[11:]
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	if err != nil {
+		return
+	}
+	if len(m[2]) != 0 {
+		var ms int
+		for _, c := range m[2] {
+			ms = ms*10 + int(c-'0')
+		}
+		t = t.Add(time.Duration(ms) * time.Millisecond)
+	}
+	return t, true
+}
+
+// UnixMilli returns t as milliseconds since the epoch, 0 for the zero time.
+func UnixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
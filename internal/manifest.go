@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+const ManifestVersion = 1
+
+// ManifestFile is a log file collected from Flink.
+type ManifestFile struct {
+	// Path relative to the logs dir of the instance, e.g. "jobmanager/:log_file"
+	Path      string `json:"path"`
+	SourceURL string `json:"source_url"`
+	// SourceSize is the size reported by Flink, Size is the size stored
+	SourceSize int64 `json:"source_size"`
+	Size       int64 `json:"size"`
+	// hex encoded sha256 of the stored content, before encryption
+	Checksum string `json:"checksum"`
+	// number of secrets redacted, the stored size differs from the source size if not 0
+	Redactions int64 `json:"redactions"`
+	// the stored content was truncated because the quota of the space or the flow was reached
+	Truncated   bool      `json:"truncated,omitempty"`
+	CollectedAt time.Time `json:"collected_at"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// ManifestFailure is a step of the collection that failed before a file could be downloaded,
+// e.g. listing the TaskManagers or the log files of a TaskManager.
+type ManifestFailure struct {
+	Source string    `json:"source"`
+	Error  string    `json:"error"`
+	Time   time.Time `json:"time"`
+}
+
+// InstanceManifest describes what was collected for an instance.
+type InstanceManifest struct {
+	Version        int                `json:"version"`
+	SpaceID        string             `json:"space_id"`
+	FlowID         string             `json:"flow_id"`
+	InstanceID     string             `json:"instance_id"`
+	ServerURL      string             `json:"server_url"`
+	FlinkVersion   string             `json:"flink_version"`
+	JobIDs         []string           `json:"job_ids"`
+	TaskManagerIDs []string           `json:"task_manager_ids"`
+	StartedAt      time.Time          `json:"started_at"`
+	FinishedAt     time.Time          `json:"finished_at"`
+	Files          []*ManifestFile    `json:"files"`
+	Failures       []*ManifestFailure `json:"failures"`
+}
+
+func (m *InstanceManifest) Encode(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
+
+// FindFile returns the file of the path relative to the logs dir, nil if it was not collected.
+func (m *InstanceManifest) FindFile(relPath string) *ManifestFile {
+	for _, file := range m.Files {
+		if file.Path == relPath {
+			return file
+		}
+	}
+	return nil
+}
+
+// Redactions returns the number of secrets redacted from all the files.
+func (m *InstanceManifest) Redactions() int64 {
+	var n int64
+	for _, file := range m.Files {
+		n += file.Redactions
+	}
+	return n
+}
+
+// TruncatedFiles returns the number of files truncated by the quota.
+func (m *InstanceManifest) TruncatedFiles() int32 {
+	var n int32
+	for _, file := range m.Files {
+		if file.Truncated {
+			n++
+		}
+	}
+	return n
+}
+
+func DecodeInstanceManifest(r io.Reader) (*InstanceManifest, error) {
+	m := &InstanceManifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "logmanager"
+
+var (
+	flinkRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "flink",
+		Name:      "requests_total",
+		Help:      "Number of requests sent to Flink REST APIs, by endpoint and HTTP status code, \"error\" if no response.",
+	}, []string{"endpoint", "code"})
+
+	flinkRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "flink",
+		Name:      "request_duration_seconds",
+		Help:      "Time until the response headers of Flink REST APIs are received.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"endpoint"})
+
+	hdfsOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "hdfs",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of HDFS operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"operation"})
+
+	hdfsOperationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "hdfs",
+		Name:      "operation_errors_total",
+		Help:      "Number of failed HDFS operations, files not found excluded.",
+	}, []string{"operation"})
+)
+
+// observeHdfsOperation records the duration of an HDFS operation started at startTime.
+func observeHdfsOperation(operation string, startTime time.Time, err error) {
+	hdfsOperationDuration.WithLabelValues(operation).Observe(time.Since(startTime).Seconds())
+	if err != nil && !os.IsNotExist(err) {
+		hdfsOperationErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// HdfsReader records the duration of the reads of an HDFS file as the "read" operation.
+type HdfsReader struct {
+	*hdfs.FileReader
+}
+
+func (r *HdfsReader) Read(p []byte) (int, error) {
+	startTime := time.Now()
+	n, err := r.FileReader.Read(p)
+	observeHdfsIO("read", startTime, err)
+	return n, err
+}
+
+func (r *HdfsReader) ReadAt(p []byte, off int64) (int, error) {
+	startTime := time.Now()
+	n, err := r.FileReader.ReadAt(p, off)
+	observeHdfsIO("read", startTime, err)
+	return n, err
+}
+
+// HdfsWriter records the duration of the writes to an HDFS file as the "write" operation.
+type HdfsWriter struct {
+	*hdfs.FileWriter
+}
+
+func (w *HdfsWriter) Write(p []byte) (int, error) {
+	startTime := time.Now()
+	n, err := w.FileWriter.Write(p)
+	observeHdfsIO("write", startTime, err)
+	return n, err
+}
+
+// observeHdfsIO records a read or a write, the reads and writes are too many to be traced.
+func observeHdfsIO(operation string, startTime time.Time, err error) {
+	if err == io.EOF {
+		err = nil
+	}
+	observeHdfsOperation(operation, startTime, err)
+}
+
+// instrumentedTransport records the latency and the status codes of the Flink requests.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := flinkEndpoint(req.URL.Path)
+	span, ctx := StartSpan(req.Context(), "flink "+req.Method+" "+endpoint)
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.HTTPUrl.Set(span, req.URL.String())
+	startTime := time.Now()
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	flinkRequestDuration.WithLabelValues(endpoint).Observe(time.Since(startTime).Seconds())
+	if err != nil {
+		flinkRequests.WithLabelValues(endpoint, "error").Inc()
+		FinishSpan(span, err)
+		return nil, err
+	}
+	flinkRequests.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		ext.Error.Set(span, true)
+	}
+	span.Finish()
+	return resp, nil
+}
+
+// flinkEndpoint returns the REST API of a url path without the ids and file names,
+// e.g. "/taskmanagers/:id/logs/:file", the base path of the server is ignored.
+func flinkEndpoint(urlPath string) string {
+	if i := strings.LastIndex(urlPath, "/jobmanager/logs"); i >= 0 {
+		if strings.Trim(urlPath[i+len("/jobmanager/logs"):], "/") == "" {
+			return "/jobmanager/logs"
+		}
+		return "/jobmanager/logs/:file"
+	}
+	if i := strings.LastIndex(urlPath, "/taskmanagers"); i >= 0 {
+		switch rest := strings.Split(strings.Trim(urlPath[i+len("/taskmanagers"):], "/"), "/"); {
+		case len(rest) == 1 && rest[0] == "":
+			return "/taskmanagers"
+		case len(rest) == 2 && rest[1] == "logs":
+			return "/taskmanagers/:id/logs"
+		case len(rest) == 3 && rest[1] == "logs":
+			return "/taskmanagers/:id/logs/:file"
+		}
+	}
+	for _, endpoint := range []string{"/config", "/jobs"} {
+		if strings.HasSuffix(strings.TrimSuffix(urlPath, "/"), endpoint) {
+			return endpoint
+		}
+	}
+	return "other"
+}
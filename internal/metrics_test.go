@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlinkEndpoint(t *testing.T) {
+	tests := []struct {
+		urlPath  string
+		endpoint string
+	}{
+		{"/jobmanager/logs", "/jobmanager/logs"},
+		{"/jobmanager/logs/", "/jobmanager/logs"},
+		{"/jobmanager/logs/jobmanager.log", "/jobmanager/logs/:file"},
+		{"/taskmanagers", "/taskmanagers"},
+		{"/taskmanagers/", "/taskmanagers"},
+		{"/taskmanagers/10.0.0.1:34567-6f1a2b/logs", "/taskmanagers/:id/logs"},
+		{"/taskmanagers/10.0.0.1:34567-6f1a2b/logs/taskmanager.log", "/taskmanagers/:id/logs/:file"},
+		{"/taskmanagers/10.0.0.1:34567-6f1a2b/metrics", "other"},
+		{"/proxy/application_1/jobmanager/logs/jobmanager.log", "/jobmanager/logs/:file"},
+		{"/proxy/application_1/taskmanagers", "/taskmanagers"},
+		{"/config", "/config"},
+		{"/proxy/application_1/jobs/", "/jobs"},
+		{"/jobs/overview", "other"},
+		{"", "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.urlPath, func(t *testing.T) {
+			require.Equal(t, tt.endpoint, flinkEndpoint(tt.urlPath))
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	segmentFileExt = ".seg"
+
+	minTokenLength = 2
+	maxTokenLength = 64
+
+	// max number of segments kept in memory
+	maxCachedSegments = 256
+
+	// max number of token positions indexed per file, the lines after are not indexed
+	// so building the index of a large file does not use unbounded memory
+	MaxFilePositions = 4 << 20
+)
+
+// Posting records the occurrences of a token in a line.
+type Posting struct {
+	File   int32
+	Line   int64
+	Offset int64
+	// Time is the timestamp of the log record of the line in unix milliseconds,
+	// the lines of a multi-line record share its timestamp, 0 if unknown.
+	Time int64
+	// Pos is the positions of the token in the line, counted in tokens.
+	Pos []int32
+}
+
+// SegmentFile is a log file indexed in a segment.
+type SegmentFile struct {
+	// Path relative to the logs dir of the instance, e.g. "jobmanager/:log_file".
+	Path string
+	// MinTime and MaxTime are the range of log record timestamps in unix milliseconds.
+	MinTime int64
+	MaxTime int64
+	// Truncated is set if the file has more token positions than the builder indexes,
+	// only its first IndexedLines lines are indexed then.
+	Truncated    bool
+	IndexedLines int64
+}
+
+// IndexSegment is the inverted index of all log files of an instance.
+type IndexSegment struct {
+	SpaceID    string
+	FlowID     string
+	InstanceID string
+	Files      []*SegmentFile
+	Postings   map[string][]Posting
+}
+
+// Tokenize splits text into lower case tokens made of letters, digits and '_',
+// fn is called with each token and its position.
+func Tokenize(text []byte, fn func(token string, pos int32)) {
+	var (
+		pos   int32
+		start = -1
+	)
+	emit := func(end int) {
+		if n := end - start; n >= minTokenLength && n <= maxTokenLength {
+			fn(strings.ToLower(string(text[start:end])), pos)
+			pos++
+		}
+		start = -1
+	}
+
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRune(text[i:])
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			emit(i)
+		}
+		i += size
+	}
+	if start >= 0 {
+		emit(len(text))
+	}
+}
+
+// FileIndexBuilder builds the postings of a single log file, AddLine can be used as a LineFunc.
+// The lines after the first maxPositions token positions are not indexed.
+type FileIndexBuilder struct {
+	file     SegmentFile
+	postings map[string][]Posting
+	// time of the last log record
+	lastTime     int64
+	positions    int
+	maxPositions int
+}
+
+func NewFileIndexBuilder(maxPositions int) *FileIndexBuilder {
+	return &FileIndexBuilder{postings: make(map[string][]Posting), maxPositions: maxPositions}
+}
+
+// Truncated reports whether lines were left out of the index, see SegmentFile.Truncated.
+func (b *FileIndexBuilder) Truncated() bool {
+	return b.file.Truncated
+}
+
+func (b *FileIndexBuilder) AddLine(line []byte, lineNo int64, offset int64) error {
+	if b.Truncated() {
+		return nil
+	}
+	if m := logTimeRegexp.FindIndex(line); m != nil {
+		if t, ok := ParseLogTime(line); ok {
+			ms := UnixMilli(t)
+			if b.file.MinTime == 0 || ms < b.file.MinTime {
+				b.file.MinTime = ms
+			}
+			if ms > b.file.MaxTime {
+				b.file.MaxTime = ms
+			}
+			b.lastTime = ms
+		}
+		// the timestamp of log records is not worth indexing
+		line = line[m[1]:]
+	}
+
+	var tokens []string
+	Tokenize(line, func(token string, _ int32) {
+		tokens = append(tokens, token)
+	})
+	if b.positions+len(tokens) > b.maxPositions {
+		b.file.Truncated = true
+		b.file.IndexedLines = lineNo - 1
+		return nil
+	}
+	b.positions += len(tokens)
+
+	for pos, token := range tokens {
+		postings := b.postings[token]
+		if n := len(postings); n != 0 && postings[n-1].Line == lineNo {
+			postings[n-1].Pos = append(postings[n-1].Pos, int32(pos))
+			continue
+		}
+		b.postings[token] = append(postings, Posting{Line: lineNo, Offset: offset, Time: b.lastTime, Pos: []int32{int32(pos)}})
+	}
+	return nil
+}
+
+// SearchIndex stores the index segments in a local dir,
+// one segment file per instance at :dir/:space_id/:flow_id/:inst_id.seg
+// Segments are never modified once cached, AddFile replaces the segment of the instance,
+// so searches only lock the cache.
+type SearchIndex struct {
+	dir string
+
+	// writeMu serializes the changes of the segments
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	cache   map[string]*IndexSegment
+}
+
+func NewSearchIndex(dir string) (*SearchIndex, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &SearchIndex{
+		dir:   dir,
+		cache: make(map[string]*IndexSegment),
+	}, nil
+}
+
+func (s *SearchIndex) segmentPath(spaceID, flowID, instID string) string {
+	return filepath.Join(s.dir, spaceID, flowID, instID+segmentFileExt)
+}
+
+// AddFile adds the postings built for a log file into the segment of its instance,
+// the previous postings of the file are replaced if it was indexed before.
+func (s *SearchIndex) AddFile(spaceID, flowID, instID, filePath string, b *FileIndexBuilder) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	segPath := s.segmentPath(spaceID, flowID, instID)
+	seg, err := s.loadSegment(segPath)
+	if err != nil {
+		// a segment that can not be decoded is replaced by a new one
+		seg = &IndexSegment{
+			SpaceID:    spaceID,
+			FlowID:     flowID,
+			InstanceID: instID,
+			Postings:   make(map[string][]Posting),
+		}
+	}
+
+	fileIdx := int32(-1)
+	for i, f := range seg.Files {
+		if f.Path == filePath {
+			fileIdx = int32(i)
+			break
+		}
+	}
+
+	// the cached segment may be read by searches, the new one is a copy
+	newSeg := &IndexSegment{
+		SpaceID:    seg.SpaceID,
+		FlowID:     seg.FlowID,
+		InstanceID: seg.InstanceID,
+		Files:      append([]*SegmentFile(nil), seg.Files...),
+		Postings:   make(map[string][]Posting, len(seg.Postings)),
+	}
+	for token, postings := range seg.Postings {
+		kept := make([]Posting, 0, len(postings))
+		for _, p := range postings {
+			if p.File != fileIdx {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) != 0 {
+			newSeg.Postings[token] = kept
+		}
+	}
+	if fileIdx < 0 {
+		fileIdx = int32(len(newSeg.Files))
+		newSeg.Files = append(newSeg.Files, nil)
+	}
+
+	file := b.file
+	file.Path = filePath
+	newSeg.Files[fileIdx] = &file
+	for token, postings := range b.postings {
+		for i := range postings {
+			postings[i].File = fileIdx
+		}
+		newSeg.Postings[token] = append(newSeg.Postings[token], postings...)
+	}
+
+	if err = writeSegment(segPath, newSeg); err != nil {
+		s.mu.Lock()
+		delete(s.cache, segPath)
+		s.mu.Unlock()
+		return err
+	}
+	s.cacheSegment(segPath, newSeg)
+	return nil
+}
+
+// loadSegment returns the segment from cache or reads it from disk, the segment must not be modified.
+func (s *SearchIndex) loadSegment(segPath string) (*IndexSegment, error) {
+	s.mu.Lock()
+	seg, ok := s.cache[segPath]
+	s.mu.Unlock()
+	if ok {
+		return seg, nil
+	}
+
+	f, err := os.Open(segPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	seg = &IndexSegment{}
+	if err = gob.NewDecoder(bufio.NewReader(f)).Decode(seg); err != nil {
+		return nil, fmt.Errorf("decode segment [%s] failed, %w", segPath, err)
+	}
+	return seg, nil
+}
+
+func (s *SearchIndex) cacheSegment(segPath string, seg *IndexSegment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cache[segPath]; !ok && len(s.cache) >= maxCachedSegments {
+		for key := range s.cache {
+			delete(s.cache, key)
+			break
+		}
+	}
+	s.cache[segPath] = seg
+}
+
+// writeSegment writes the segment to a temporary file and renames it, so readers never see a partial segment.
+func writeSegment(segPath string, seg *IndexSegment) (err error) {
+	if err = os.MkdirAll(filepath.Dir(segPath), 0755); err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(segPath), "."+filepath.Base(segPath))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(tmp)
+	if err = gob.NewEncoder(w).Encode(seg); err != nil {
+		_ = tmp.Close()
+		return
+	}
+	if err = w.Flush(); err != nil {
+		_ = tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), segPath)
+}
+
+// SearchScope limits a search to a space, flow or instance and to a time range.
+type SearchScope struct {
+	SpaceID    string
+	FlowID     string
+	InstanceID string
+	// StartTime and EndTime are unix milliseconds, 0 means unbounded.
+	StartTime int64
+	EndTime   int64
+}
+
+// SearchHit is a line matching a query.
+type SearchHit struct {
+	SpaceID    string
+	FlowID     string
+	InstanceID string
+	File       string
+	Line       int64
+	Offset     int64
+}
+
+// Search returns the lines matching the query in the scope, at most limit hits are returned
+// with the total number of matching lines.
+func (s *SearchIndex) Search(query *SearchQuery, scope *SearchScope, limit int) ([]*SearchHit, int64, error) {
+	segPaths, err := s.listSegments(scope)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		hits  []*SearchHit
+		total int64
+	)
+	for _, segPath := range segPaths {
+		seg, err := s.loadSegment(segPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		s.cacheSegment(segPath, seg)
+
+		// the segment is not modified once loaded, it's matched without lock
+		matches, err := query.match(seg)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, m := range matches {
+			file := seg.Files[m.File]
+			if !inTimeRange(scope, m.Time, file) {
+				continue
+			}
+			total++
+			if len(hits) < limit {
+				hits = append(hits, &SearchHit{
+					SpaceID:    seg.SpaceID,
+					FlowID:     seg.FlowID,
+					InstanceID: seg.InstanceID,
+					File:       file.Path,
+					Line:       m.Line,
+					Offset:     m.Offset,
+				})
+			}
+		}
+	}
+	return hits, total, nil
+}
+
+// inTimeRange reports whether a line of a file with the log record time t (0 if unknown) is in the time range
+// of the scope, the range of the file is used for the lines indexed without time.
+func inTimeRange(scope *SearchScope, t int64, file *SegmentFile) bool {
+	minTime, maxTime := t, t
+	if t == 0 {
+		minTime, maxTime = file.MinTime, file.MaxTime
+	}
+	if scope.StartTime > 0 && maxTime != 0 && maxTime < scope.StartTime {
+		return false
+	}
+	if scope.EndTime > 0 && minTime != 0 && minTime > scope.EndTime {
+		return false
+	}
+	return true
+}
+
+// listSegments returns the paths of all segments in the scope, sorted.
+func (s *SearchIndex) listSegments(scope *SearchScope) ([]string, error) {
+	if scope.InstanceID != "" {
+		return []string{s.segmentPath(scope.SpaceID, scope.FlowID, scope.InstanceID)}, nil
+	}
+
+	root := filepath.Join(s.dir, scope.SpaceID, scope.FlowID)
+	var result []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(p, segmentFileExt) && !strings.HasPrefix(info.Name(), ".") {
+			result = append(result, p)
+		}
+		return nil
+	})
+	sort.Strings(result)
+	return result, err
+}
+
+// Remove deletes the segment of an instance, or the segments of all instances of
+// the flow if instID is empty, or of the space if flowID is empty too.
+func (s *SearchIndex) Remove(spaceID, flowID, instID string) error {
+	if spaceID == "" || (flowID == "" && instID != "") {
+		return fmt.Errorf("remove segments of [%s/%s/%s] failed, space id is required, and flow id is required if instance id is set",
+			spaceID, flowID, instID)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var (
+		target string
+		err    error
+	)
+	if instID != "" {
+		target = s.segmentPath(spaceID, flowID, instID)
+		err = os.Remove(target)
+	} else {
+		target = filepath.Join(s.dir, spaceID, flowID)
+		err = os.RemoveAll(target)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for segPath := range s.cache {
+		if segPath == target || strings.HasPrefix(segPath, target+string(filepath.Separator)) {
+			delete(s.cache, segPath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		tokens []string
+	}{
+		{"words", "Checkpoint 42 expired", []string{"checkpoint", "42", "expired"}},
+		{"punctuation", "java.lang.OutOfMemoryError: Java heap space", []string{"java", "lang", "outofmemoryerror", "java", "heap", "space"}},
+		{"underscore", "container_e01_000002 started", []string{"container_e01_000002", "started"}},
+		{"single chars dropped", "a b cd e", []string{"cd"}},
+		{"too long dropped", strings.Repeat("x", 65) + " ok", []string{"ok"}},
+		{"unicode", "Größe überschritten", []string{"größe", "überschritten"}},
+		{"empty", "", nil},
+		{"no token", "-- :: --", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tokens []string
+			var positions []int32
+			Tokenize([]byte(tt.text), func(token string, pos int32) {
+				tokens = append(tokens, token)
+				positions = append(positions, pos)
+			})
+			require.Equal(t, tt.tokens, tokens)
+			for i, pos := range positions {
+				require.Equal(t, int32(i), pos)
+			}
+		})
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		valid bool
+	}{
+		{"term", "OutOfMemoryError", true},
+		{"phrase", `"heap space"`, true},
+		{"dotted term", "java.lang.OutOfMemoryError", true},
+		{"implicit and", "checkpoint expired", true},
+		{"or", `OutOfMemoryError OR "heap space"`, true},
+		{"not", "checkpoint AND NOT (expired OR declined)", true},
+		{"minus", "checkpoint -expired", true},
+		{"nested parentheses", "((a1 OR b1) AND c1)", true},
+
+		{"empty", "", false},
+		{"blank", "   ", false},
+		{"unterminated phrase", `"heap space`, false},
+		{"missing paren", "(a1 OR b1", false},
+		{"extra paren", "a1 OR b1)", false},
+		{"dangling or", "a1 OR", false},
+		{"dangling not", "NOT", false},
+		{"no searchable term", "a", false},
+		{"leading and", "AND a1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSearchQuery(tt.query)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.True(t, errors.Is(err, ErrInvalidQuery), err.Error())
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	index, err := NewSearchIndex(t.TempDir())
+	require.NoError(t, err)
+
+	lines := []string{
+		"2021-10-19 10:00:00,000 INFO checkpoint 1 completed",
+		"2021-10-19 11:00:00,000 WARN checkpoint 2 expired",
+		"2021-10-19 12:00:00,000 ERROR java.lang.OutOfMemoryError: Java heap space",
+		"\tat org.apache.flink.runtime.taskmanager.Task.run(Task.java:100)",
+		"2021-10-19 13:00:00,000 INFO checkpoint 3 declined",
+	}
+	builder := NewFileIndexBuilder(MaxFilePositions)
+	var offset int64
+	for i, line := range lines {
+		require.NoError(t, builder.AddLine([]byte(line), int64(i+1), offset))
+		offset += int64(len(line)) + 1
+	}
+	require.False(t, builder.Truncated())
+	require.NoError(t, index.AddFile("space", "flow", "inst", "jobmanager/jobmanager.log", builder))
+
+	at := func(hour int) int64 {
+		return UnixMilli(time.Date(2021, 10, 19, hour, 0, 0, 0, time.Local))
+	}
+	tests := []struct {
+		name  string
+		query string
+		start int64
+		end   int64
+		lines []int64
+	}{
+		{"term", "checkpoint", 0, 0, []int64{1, 2, 5}},
+		{"not", "checkpoint NOT expired", 0, 0, []int64{1, 5}},
+		{"or", "expired OR declined", 0, 0, []int64{2, 5}},
+		{"phrase", `"heap space"`, 0, 0, []int64{3}},
+		{"phrase out of order", `"space heap"`, 0, 0, nil},
+		{"dotted term", "java.lang.OutOfMemoryError", 0, 0, []int64{3}},
+		{"time range of lines", "checkpoint", at(11), at(12), []int64{2}},
+		{"start time", "checkpoint", at(12), 0, []int64{5}},
+		{"continuation line has the time of its record", "taskmanager", at(12), at(12), []int64{4}},
+		{"continuation line out of range", "taskmanager", at(13), 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := ParseSearchQuery(tt.query)
+			require.NoError(t, err)
+			hits, total, err := index.Search(query, &SearchScope{SpaceID: "space", StartTime: tt.start, EndTime: tt.end}, 10)
+			require.NoError(t, err)
+
+			var found []int64
+			for _, hit := range hits {
+				require.Equal(t, "jobmanager/jobmanager.log", hit.File)
+				found = append(found, hit.Line)
+			}
+			require.Equal(t, tt.lines, found)
+			require.Equal(t, int64(len(tt.lines)), total)
+		})
+	}
+}
+
+func TestSearchIndexRemove(t *testing.T) {
+	index, err := NewSearchIndex(t.TempDir())
+	require.NoError(t, err)
+	builder := NewFileIndexBuilder(MaxFilePositions)
+	require.NoError(t, builder.AddLine([]byte("2021-10-19 10:00:00,000 INFO checkpoint 1 completed"), 1, 0))
+	require.NoError(t, index.AddFile("space", "flow", "inst", "jobmanager/jobmanager.log", builder))
+
+	query, err := ParseSearchQuery("checkpoint")
+	require.NoError(t, err)
+	search := func() int64 {
+		_, total, err := index.Search(query, &SearchScope{SpaceID: "space"}, 10)
+		require.NoError(t, err)
+		return total
+	}
+
+	// the whole index is never removed
+	require.Error(t, index.Remove("", "", ""))
+	require.Error(t, index.Remove("space", "", "inst"))
+	require.Equal(t, int64(1), search())
+
+	require.NoError(t, index.Remove("space", "flow", "inst"))
+	require.Equal(t, int64(0), search())
+}
+
+func TestFileIndexBuilderLimit(t *testing.T) {
+	builder := NewFileIndexBuilder(5)
+	require.NoError(t, builder.AddLine([]byte("one two three"), 1, 0))
+	require.NoError(t, builder.AddLine([]byte("four five six"), 2, 14))
+	require.NoError(t, builder.AddLine([]byte("seven"), 3, 28))
+
+	require.True(t, builder.Truncated())
+	require.Equal(t, int64(1), builder.file.IndexedLines)
+	require.Len(t, builder.postings, 3)
+}
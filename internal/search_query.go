@@ -0,0 +1,389 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidQuery is wrapped by all errors caused by the query text.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// SearchQuery is a parsed full-text query. The syntax supports terms, "quoted phrases",
+// AND, OR, NOT (or a leading '-') and parentheses, terms next to each other are combined with AND.
+// e.g. `OutOfMemoryError OR "heap space"`, `checkpoint AND NOT (expired OR declined)`
+type SearchQuery struct {
+	root queryNode
+}
+
+type lineKey struct {
+	File int32
+	Line int64
+}
+
+// lineInfo is the offset and the log record time of a line, see Posting.
+type lineInfo struct {
+	Offset int64
+	Time   int64
+}
+
+// lineSet maps the matched lines to their offsets and times.
+type lineSet map[lineKey]lineInfo
+
+type lineMatch struct {
+	File   int32
+	Line   int64
+	Offset int64
+	Time   int64
+}
+
+type queryNode interface {
+	// eval returns the matched lines, negated is true if the node matches all lines except the returned ones.
+	eval(seg *IndexSegment) (lines lineSet, negated bool, err error)
+}
+
+func ParseSearchQuery(text string) (*SearchQuery, error) {
+	tokens, err := lexQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty query", ErrInvalidQuery)
+	}
+
+	p := &queryParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, p.tokens[p.pos].text)
+	}
+	return &SearchQuery{root: root}, nil
+}
+
+// match returns the lines of the segment matching the query ordered by file and line.
+func (q *SearchQuery) match(seg *IndexSegment) ([]lineMatch, error) {
+	lines, negated, err := q.root.eval(seg)
+	if err != nil {
+		return nil, err
+	}
+	if negated {
+		return nil, fmt.Errorf("%w: query must contain at least one positive term", ErrInvalidQuery)
+	}
+
+	result := make([]lineMatch, 0, len(lines))
+	for key, info := range lines {
+		result = append(result, lineMatch{File: key.File, Line: key.Line, Offset: info.Offset, Time: info.Time})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].File != result[j].File {
+			return result[i].File < result[j].File
+		}
+		return result[i].Line < result[j].Line
+	})
+	return result, nil
+}
+
+// phraseNode matches lines containing the tokens next to each other, a single term is a phrase of one token.
+type phraseNode struct {
+	tokens []string
+}
+
+func (n *phraseNode) eval(seg *IndexSegment) (lineSet, bool, error) {
+	result := make(lineSet)
+	first := seg.Postings[n.tokens[0]]
+	if len(n.tokens) == 1 {
+		for _, p := range first {
+			result[lineKey{File: p.File, Line: p.Line}] = lineInfo{Offset: p.Offset, Time: p.Time}
+		}
+		return result, false, nil
+	}
+
+	rest := make([]map[lineKey][]int32, len(n.tokens)-1)
+	for i, token := range n.tokens[1:] {
+		positions := make(map[lineKey][]int32)
+		for _, p := range seg.Postings[token] {
+			positions[lineKey{File: p.File, Line: p.Line}] = p.Pos
+		}
+		rest[i] = positions
+	}
+
+	for _, p := range first {
+		key := lineKey{File: p.File, Line: p.Line}
+		for _, pos := range p.Pos {
+			matched := true
+			for i, positions := range rest {
+				if !containsPos(positions[key], pos+int32(i)+1) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				result[key] = lineInfo{Offset: p.Offset, Time: p.Time}
+				break
+			}
+		}
+	}
+	return result, false, nil
+}
+
+func containsPos(positions []int32, pos int32) bool {
+	for _, p := range positions {
+		if p == pos {
+			return true
+		}
+	}
+	return false
+}
+
+type notNode struct {
+	child queryNode
+}
+
+func (n *notNode) eval(seg *IndexSegment) (lineSet, bool, error) {
+	lines, negated, err := n.child.eval(seg)
+	return lines, !negated, err
+}
+
+type andNode struct {
+	left, right queryNode
+}
+
+func (n *andNode) eval(seg *IndexSegment) (lineSet, bool, error) {
+	left, leftNeg, err := n.left.eval(seg)
+	if err != nil {
+		return nil, false, err
+	}
+	right, rightNeg, err := n.right.eval(seg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch {
+	case !leftNeg && !rightNeg:
+		return intersectLines(left, right), false, nil
+	case leftNeg && rightNeg:
+		// NOT a AND NOT b == NOT (a OR b)
+		return unionLines(left, right), true, nil
+	case leftNeg:
+		return subtractLines(right, left), false, nil
+	default:
+		return subtractLines(left, right), false, nil
+	}
+}
+
+type orNode struct {
+	left, right queryNode
+}
+
+func (n *orNode) eval(seg *IndexSegment) (lineSet, bool, error) {
+	left, leftNeg, err := n.left.eval(seg)
+	if err != nil {
+		return nil, false, err
+	}
+	right, rightNeg, err := n.right.eval(seg)
+	if err != nil {
+		return nil, false, err
+	}
+	if leftNeg || rightNeg {
+		return nil, false, fmt.Errorf("%w: NOT can not be used in OR", ErrInvalidQuery)
+	}
+	return unionLines(left, right), false, nil
+}
+
+func intersectLines(a, b lineSet) lineSet {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	result := make(lineSet)
+	for key, info := range a {
+		if _, ok := b[key]; ok {
+			result[key] = info
+		}
+	}
+	return result
+}
+
+func unionLines(a, b lineSet) lineSet {
+	result := make(lineSet, len(a)+len(b))
+	for key, info := range a {
+		result[key] = info
+	}
+	for key, info := range b {
+		result[key] = info
+	}
+	return result
+}
+
+func subtractLines(a, b lineSet) lineSet {
+	result := make(lineSet)
+	for key, info := range a {
+		if _, ok := b[key]; !ok {
+			result[key] = info
+		}
+	}
+	return result
+}
+
+type queryTokenKind int
+
+const (
+	queryWord queryTokenKind = iota
+	queryPhrase
+	queryAnd
+	queryOr
+	queryNot
+	queryLParen
+	queryRParen
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+}
+
+func lexQuery(text string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: queryLParen, text: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: queryRParen, text: ")"})
+			i++
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, queryToken{kind: queryNot, text: "-"})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("%w: unterminated phrase", ErrInvalidQuery)
+			}
+			tokens = append(tokens, queryToken{kind: queryPhrase, text: string(runes[i+1 : end])})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()"`, runes[end]) {
+				end++
+			}
+			word := string(runes[i:end])
+			switch word {
+			case "AND":
+				tokens = append(tokens, queryToken{kind: queryAnd, text: word})
+			case "OR":
+				tokens = append(tokens, queryToken{kind: queryOr, text: word})
+			case "NOT":
+				tokens = append(tokens, queryToken{kind: queryNot, text: word})
+			default:
+				tokens = append(tokens, queryToken{kind: queryWord, text: word})
+			}
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// or := and ("OR" and)*
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != queryOr {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+}
+
+// and := unary (["AND"] unary)*
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind == queryOr || t.kind == queryRParen {
+			return left, nil
+		}
+		if t.kind == queryAnd {
+			p.pos++
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+}
+
+// unary := ("NOT" | "-") unary | "(" or ")" | phrase | word
+func (p *queryParser) parseUnary() (queryNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected end of query", ErrInvalidQuery)
+	}
+	p.pos++
+
+	switch t.kind {
+	case queryNot:
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child: child}, nil
+	case queryLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.kind != queryRParen {
+			return nil, fmt.Errorf("%w: missing ')'", ErrInvalidQuery)
+		}
+		p.pos++
+		return node, nil
+	case queryWord, queryPhrase:
+		// a word like "java.lang.OutOfMemoryError" is made of several tokens and matched as phrase
+		var tokens []string
+		Tokenize([]byte(t.text), func(token string, _ int32) {
+			tokens = append(tokens, token)
+		})
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("%w: %q contains no searchable term", ErrInvalidQuery, t.text)
+		}
+		return &phraseNode{tokens: tokens}, nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, t.text)
+	}
+}
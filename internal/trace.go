@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// StartSpan starts a span child of the span of ctx, the span is a noop one if ctx has no span,
+// e.g. out of the grpc calls.
+func StartSpan(ctx context.Context, operationName string) (opentracing.Span, context.Context) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return opentracing.NoopTracer{}.StartSpan(operationName), ctx
+	}
+	span := parent.Tracer().StartSpan(operationName, opentracing.ChildOf(parent.Context()))
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+// StartFollowsFromSpan starts the span of a background task started by the request of the span of ctx,
+// the task may outlive the request.
+func StartFollowsFromSpan(ctx context.Context, operationName string) (opentracing.Span, context.Context) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return opentracing.NoopTracer{}.StartSpan(operationName), ctx
+	}
+	span := parent.Tracer().StartSpan(operationName, opentracing.FollowsFrom(parent.Context()))
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+// FinishSpan finishes the span, it's marked as failed if err is not nil.
+func FinishSpan(span opentracing.Span, err error) {
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error", err.Error())
+	}
+	span.Finish()
+}
+
+// StartHdfsOperation starts the span of an HDFS operation, finish records its duration and result.
+// Files not found are not counted as failures.
+func StartHdfsOperation(ctx context.Context, operation string) (finish func(err error)) {
+	span, _ := StartSpan(ctx, "hdfs "+operation)
+	startTime := time.Now()
+	return func(err error) {
+		observeHdfsOperation(operation, startTime, err)
+		if os.IsNotExist(err) {
+			span.SetTag("not_found", true)
+			err = nil
+		}
+		FinishSpan(span, err)
+	}
+}
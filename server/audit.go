@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/DataWorkbench/logmanager/handler"
+	"github.com/DataWorkbench/logmanager/internal"
+)
+
+// auditor records an audit event for each call, including the ones denied by the authorizer.
+type auditor struct {
+	// nil if the authorization is disabled, the callers are only known by their address then
+	authorizer *authorizer
+}
+
+func (a *auditor) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, event := a.begin(ctx, time.Now(), info.FullMethod, req)
+	resp, err := handler(ctx, req)
+	a.end(ctx, event, err)
+	return resp, err
+}
+
+func (a *auditor) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	startTime := time.Now()
+	stream := &auditedStream{ServerStream: ss}
+	err := handler(srv, stream)
+	a.record(ss.Context(), startTime, info.FullMethod, stream.req, stream.bytes, err)
+	return err
+}
+
+// begin returns a ctx carrying the event of a unary call, the event of an upload is recorded
+// once the files it collects in the background are saved.
+func (a *auditor) begin(ctx context.Context, startTime time.Time, fullMethod string, req interface{}) (context.Context, *internal.AuditEvent) {
+	event := a.newEvent(ctx, startTime, fullMethod, req)
+	return handler.WithAuditEvent(ctx, event), event
+}
+
+func (a *auditor) end(ctx context.Context, event *internal.AuditEvent, err error) {
+	setEventStatus(event, err)
+	handler.FinishAuditEvent(ctx)
+}
+
+func (a *auditor) record(ctx context.Context, startTime time.Time, fullMethod string, req interface{}, bytes int64, err error) {
+	event := a.newEvent(ctx, startTime, fullMethod, req)
+	event.Bytes = bytes
+	setEventStatus(event, err)
+	handler.RecordAuditEvent(event)
+}
+
+func (a *auditor) newEvent(ctx context.Context, startTime time.Time, fullMethod string, req interface{}) *internal.AuditEvent {
+	event := &internal.AuditEvent{
+		Time:   startTime,
+		Method: path.Base(fullMethod),
+	}
+	if a.authorizer != nil {
+		// the calls of unknown callers are recorded without identity
+		event.Identity, _ = a.authorizer.identity(ctx)
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		event.Peer = p.Addr.String()
+	}
+
+	if r, ok := req.(interface{ GetSpaceId() string }); ok {
+		event.SpaceID = r.GetSpaceId()
+	}
+	if r, ok := req.(interface{ GetFlowId() string }); ok {
+		event.FlowID = r.GetFlowId()
+	}
+	if r, ok := req.(interface{ GetInstanceId() string }); ok {
+		event.InstanceID = r.GetInstanceId()
+	}
+	if r, ok := req.(interface{ GetTaskManagerId() string }); ok {
+		event.TaskManagerID = r.GetTaskManagerId()
+	}
+	if r, ok := req.(interface{ GetFileName() string }); ok {
+		event.FileName = r.GetFileName()
+	}
+	return event
+}
+
+func setEventStatus(event *internal.AuditEvent, err error) {
+	s := status.Convert(err)
+	event.Code = s.Code().String()
+	if err != nil {
+		event.Error = s.Message()
+	}
+}
+
+// auditedStream keeps the request of a server streaming RPC and counts the bytes of log data sent.
+type auditedStream struct {
+	grpc.ServerStream
+	req   interface{}
+	bytes int64
+}
+
+func (s *auditedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if s.req == nil {
+		s.req = m
+	}
+	return nil
+}
+
+func (s *auditedStream) SendMsg(m interface{}) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	switch r := m.(type) {
+	case interface{ GetFileData() []byte }:
+		s.bytes += int64(len(r.GetFileData()))
+	case interface{ GetData() []byte }:
+		s.bytes += int64(len(r.GetData()))
+	}
+	return nil
+}
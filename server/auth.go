@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/DataWorkbench/logmanager/config"
+)
+
+const (
+	authorizationHeader = "authorization"
+	bearerPrefix        = "bearer "
+	// members of allSpaces may access every space, and call the RPCs across all spaces
+	allSpaces = "*"
+)
+
+// adminMethods may only be called by the members of allSpaces, whatever the space of the request.
+var adminMethods = map[string]bool{
+	"QueryAuditEvents": true,
+}
+
+// PolicyProvider identifies the callers and decides which spaces they may access.
+type PolicyProvider interface {
+	// IdentityOfToken returns the identity a bearer token belongs to.
+	IdentityOfToken(token string) (string, bool)
+	// IdentityOfCertificate returns the identity of a verified client certificate.
+	IdentityOfCertificate(commonName string) (string, bool)
+	// IsMember reports whether the identity may access the space, spaceID is empty for the RPCs across all spaces.
+	IsMember(identity, spaceID string) bool
+}
+
+// staticPolicy is the PolicyProvider of the identities read from a yaml file at startup.
+type staticPolicy struct {
+	// sha256 of the token => identity
+	tokens map[string]string
+	// identities without token, authenticated by client certificate
+	certificates map[string]bool
+	spaces       map[string]map[string]bool
+}
+
+// NewStaticPolicy reads the identities of the callers from filePath, see config.LoadAuthIdentities.
+func NewStaticPolicy(filePath string) (PolicyProvider, error) {
+	identities, err := config.LoadAuthIdentities(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &staticPolicy{
+		tokens:       make(map[string]string),
+		certificates: make(map[string]bool),
+		spaces:       make(map[string]map[string]bool),
+	}
+	for name, identity := range identities {
+		if identity.Token == "" {
+			p.certificates[name] = true
+		} else {
+			key := hashToken(identity.Token)
+			if other, ok := p.tokens[key]; ok {
+				return nil, fmt.Errorf("identities [%s] and [%s] have the same token", other, name)
+			}
+			p.tokens[key] = name
+		}
+		p.spaces[name] = make(map[string]bool)
+		for _, spaceID := range identity.Spaces {
+			p.spaces[name][spaceID] = true
+		}
+	}
+	return p, nil
+}
+
+// tokens are looked up by hash so that the lookup time does not depend on how much of a token matches
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func (p *staticPolicy) IdentityOfToken(token string) (string, bool) {
+	identity, ok := p.tokens[hashToken(token)]
+	return identity, ok
+}
+
+func (p *staticPolicy) IdentityOfCertificate(commonName string) (string, bool) {
+	return commonName, p.certificates[commonName]
+}
+
+func (p *staticPolicy) IsMember(identity, spaceID string) bool {
+	spaces := p.spaces[identity]
+	if spaces[allSpaces] {
+		return true
+	}
+	return spaceID != "" && spaces[spaceID]
+}
+
+// authorizer denies the calls to the spaces the caller is not a member of.
+type authorizer struct {
+	policy PolicyProvider
+}
+
+// identity authenticates the caller by the bearer token of the "authorization" metadata,
+// or by the client certificate if the server is served over mTLS.
+func (a *authorizer) identity(ctx context.Context) (string, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(authorizationHeader); len(values) != 0 {
+			value := values[0]
+			if len(value) <= len(bearerPrefix) || !strings.EqualFold(value[:len(bearerPrefix)], bearerPrefix) {
+				return "", status.Error(codes.Unauthenticated, "malformed authorization metadata, a bearer token is expected")
+			}
+			identity, ok := a.policy.IdentityOfToken(value[len(bearerPrefix):])
+			if !ok {
+				return "", status.Error(codes.Unauthenticated, "invalid token")
+			}
+			return identity, nil
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok &&
+			len(tlsInfo.State.VerifiedChains) != 0 && len(tlsInfo.State.VerifiedChains[0]) != 0 {
+			commonName := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+			identity, ok := a.policy.IdentityOfCertificate(commonName)
+			if !ok {
+				return "", status.Error(codes.Unauthenticated, fmt.Sprintf("unknown client certificate [%s]", commonName))
+			}
+			return identity, nil
+		}
+	}
+	return "", status.Error(codes.Unauthenticated, "a bearer token or a client certificate is required")
+}
+
+// authorize checks that the caller may access the space of the request,
+// requests without a space id are the ones across all spaces.
+func (a *authorizer) authorize(ctx context.Context, fullMethod string, req interface{}) error {
+	identity, err := a.identity(ctx)
+	if err != nil {
+		return err
+	}
+
+	var spaceID string
+	if r, ok := req.(interface{ GetSpaceId() string }); ok && !adminMethods[path.Base(fullMethod)] {
+		spaceID = r.GetSpaceId()
+	}
+	if a.policy.IsMember(identity, spaceID) {
+		return nil
+	}
+	if spaceID == "" {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("[%s] is not allowed to access all spaces", identity))
+	}
+	return status.Error(codes.PermissionDenied, fmt.Sprintf("[%s] is not allowed to access space [%s]", identity, spaceID))
+}
+
+func (a *authorizer) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.authorize(ctx, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *authorizer) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &authorizedStream{ServerStream: ss, authorizer: a, fullMethod: info.FullMethod})
+}
+
+// authorizedStream authorizes the request of a server streaming RPC when it's received.
+type authorizedStream struct {
+	grpc.ServerStream
+	authorizer *authorizer
+	fullMethod string
+	authorized bool
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if !s.authorized {
+		if err := s.authorizer.authorize(s.ServerStream.Context(), s.fullMethod, m); err != nil {
+			return err
+		}
+		s.authorized = true
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakePolicy knows the identities of the tokens "token-<identity>".
+type fakePolicy struct {
+	spaces map[string][]string
+}
+
+func (p *fakePolicy) IdentityOfToken(token string) (string, bool) {
+	for identity := range p.spaces {
+		if token == "token-"+identity {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+func (p *fakePolicy) IdentityOfCertificate(string) (string, bool) {
+	return "", false
+}
+
+func (p *fakePolicy) IsMember(identity, spaceID string) bool {
+	for _, s := range p.spaces[identity] {
+		if s == allSpaces || (spaceID != "" && s == spaceID) {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestAuthorizer() *authorizer {
+	return &authorizer{policy: &fakePolicy{spaces: map[string][]string{
+		"alice": {"space-a"},
+		"admin": {allSpaces},
+	}}}
+}
+
+func contextWithAuthorization(value string) context.Context {
+	if value == "" {
+		return context.Background()
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(authorizationHeader, value))
+}
+
+func TestAuthorizeUnary(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		method        string
+		req           interface{}
+		code          codes.Code
+	}{
+		{"member of the space", "Bearer token-alice", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-a"}, codes.OK},
+		{"lowercase scheme", "bearer token-alice", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-a"}, codes.OK},
+		{"other space", "Bearer token-alice", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-b"}, codes.PermissionDenied},
+		{"admin of all spaces", "Bearer token-admin", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-b"}, codes.OK},
+
+		{"report of all spaces", "Bearer token-alice", "GetStorageReport", &logpb.StorageReportRequest{}, codes.PermissionDenied},
+		{"report of own space", "Bearer token-alice", "GetStorageReport", &logpb.StorageReportRequest{SpaceId: "space-a"}, codes.OK},
+		{"report of all spaces by admin", "Bearer token-admin", "GetStorageReport", &logpb.StorageReportRequest{}, codes.OK},
+		{"index query of all spaces", "Bearer token-alice", "QueryLogIndex", &logpb.QueryLogIndexRequest{}, codes.PermissionDenied},
+		{"index query of own space", "Bearer token-alice", "QueryLogIndex", &logpb.QueryLogIndexRequest{SpaceId: "space-a"}, codes.OK},
+		{"index query of all spaces by admin", "Bearer token-admin", "QueryLogIndex", &logpb.QueryLogIndexRequest{}, codes.OK},
+		{"audit of own space", "Bearer token-alice", "QueryAuditEvents", &logpb.QueryAuditEventsRequest{SpaceId: "space-a"}, codes.PermissionDenied},
+		{"audit by admin", "Bearer token-admin", "QueryAuditEvents", &logpb.QueryAuditEventsRequest{SpaceId: "space-a"}, codes.OK},
+
+		{"no credentials", "", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-a"}, codes.Unauthenticated},
+		{"unknown token", "Bearer token-bob", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-a"}, codes.Unauthenticated},
+		{"basic scheme", "Basic YWxpY2U6c2VjcmV0", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-a"}, codes.Unauthenticated},
+		{"scheme without token", "Bearer", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-a"}, codes.Unauthenticated},
+		{"empty token", "Bearer ", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-a"}, codes.Unauthenticated},
+		{"token without scheme", "token-alice", "ListLogFiles", &logpb.ListLogFilesRequest{SpaceId: "space-a"}, codes.Unauthenticated},
+	}
+	a := newTestAuthorizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			info := &grpc.UnaryServerInfo{FullMethod: "/logpb.LogManager/" + tt.method}
+			_, err := a.unaryInterceptor(contextWithAuthorization(tt.authorization), tt.req, info,
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					called = true
+					return nil, nil
+				})
+			require.Equal(t, tt.code, status.Code(err), "%v", err)
+			require.Equal(t, tt.code == codes.OK, called)
+		})
+	}
+}
+
+// recvStream receives a download request of a space.
+type recvStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	spaceID string
+}
+
+func (s *recvStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *recvStream) RecvMsg(m interface{}) error {
+	m.(*logpb.DownloadJobMgrRequest).SpaceId = s.spaceID
+	return nil
+}
+
+func TestAuthorizeStream(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		spaceID       string
+		code          codes.Code
+	}{
+		{"member of the space", "Bearer token-alice", "space-a", codes.OK},
+		{"other space", "Bearer token-alice", "space-b", codes.PermissionDenied},
+		{"admin of all spaces", "Bearer token-admin", "space-b", codes.OK},
+		{"unknown token", "Bearer token-bob", "space-a", codes.Unauthenticated},
+		{"malformed authorization", "Bearer", "space-a", codes.Unauthenticated},
+	}
+	a := newTestAuthorizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &recvStream{ctx: contextWithAuthorization(tt.authorization), spaceID: tt.spaceID}
+			info := &grpc.StreamServerInfo{FullMethod: "/logpb.LogManager/DownloadJobMgrLogFile", IsServerStream: true}
+			sent := false
+			err := a.streamInterceptor(nil, stream, info, func(srv interface{}, ss grpc.ServerStream) error {
+				if err := ss.RecvMsg(&logpb.DownloadJobMgrRequest{}); err != nil {
+					return err
+				}
+				sent = true
+				return nil
+			})
+			require.Equal(t, tt.code, status.Code(err), "%v", err)
+			require.Equal(t, tt.code == codes.OK, sent)
+		})
+	}
+}
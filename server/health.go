@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DataWorkbench/common/metrics"
+	"github.com/DataWorkbench/glog"
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/DataWorkbench/logmanager/config"
+	"github.com/DataWorkbench/logmanager/handler"
+)
+
+// healthChecker probes the NameNode periodically, the service is serving while the NameNode answers.
+// The status is reported by the grpc health service, for the server ("") and the LogManager service,
+// and by the readiness endpoint.
+type healthChecker struct {
+	cfg    *config.HealthConfig
+	lp     *glog.Logger
+	server *health.Server
+
+	mu  sync.RWMutex
+	err error
+	// set by shutdown, the probes are ignored from then on
+	stopped bool
+}
+
+func newHealthChecker(cfg *config.HealthConfig, lp *glog.Logger) *healthChecker {
+	h := &healthChecker{
+		cfg:    cfg,
+		lp:     lp,
+		server: health.NewServer(),
+		err:    fmt.Errorf("not probed yet"),
+	}
+	h.setStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+func (h *healthChecker) setStatus(s grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	h.server.SetServingStatus("", s)
+	h.server.SetServingStatus(logpb.LogManager_ServiceDesc.ServiceName, s)
+}
+
+// run probes the NameNode every probe interval until ctx is done.
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		h.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthChecker) probe(ctx context.Context) {
+	err := handler.CheckStorage(ctx, h.cfg.ProbeTimeout)
+
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		return
+	}
+	changed := (err == nil) != (h.err == nil)
+	h.err = err
+	h.mu.Unlock()
+
+	if err != nil {
+		h.setStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+		if changed {
+			h.lp.Error().Msg(fmt.Sprintf("HDFS is unreachable, service is not serving, %s", err.Error())).Fire()
+		}
+		return
+	}
+	h.setStatus(grpc_health_v1.HealthCheckResponse_SERVING)
+	if changed {
+		h.lp.Info().Msg("HDFS is reachable, service is serving").Fire()
+	}
+}
+
+// shutdown reports the service as not serving from now on, so that no more calls are routed to it.
+func (h *healthChecker) shutdown() {
+	h.mu.Lock()
+	h.stopped = true
+	h.err = fmt.Errorf("server is shutting down")
+	h.mu.Unlock()
+	h.server.Shutdown()
+}
+
+// ServeHTTP is the readiness endpoint, 503 if the service is not serving.
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	h.mu.RLock()
+	err := h.err
+	h.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(w, "not ready: %s\n", err.Error())
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ready")
+}
+
+// newMetricsServer serves the prometheus metrics like metrics.Server, along with the readiness endpoint.
+// It returns nil if the metrics server is disabled.
+func newMetricsServer(cfg *metrics.Config, readinessPath string, readiness http.Handler) *http.Server {
+	if !cfg.Enabled {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle(cfg.URLPath, promhttp.Handler())
+	mux.Handle(readinessPath, readiness)
+	return &http.Server{
+		Addr:              cfg.Address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
@@ -14,10 +14,18 @@ type LogManagerServer struct {
 	logpb.UnimplementedLogManagerServer
 }
 
-func (s *LogManagerServer) ListJMHistoryLogFiles(_ context.Context, req *logpb.ListHistLogsRequest) (*logpb.ListJMHistLogsReply, error) {
+func (s *LogManagerServer) ListJMHistoryLogFiles(ctx context.Context, req *logpb.ListHistLogsRequest) (*logpb.ListJMHistLogsReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
 	JMHdfsDirPath := internal.GetHdfsDirPath(req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId(), constants.JobManagerName)
 	resp := &logpb.ListJMHistLogsReply{
-		Stat: getFileStatInDir(JMHdfsDirPath),
+		Stat: getFileStatInDir(ctx, JMHdfsDirPath),
 	}
 	return resp, nil
 }
@@ -25,9 +33,17 @@ func (s *LogManagerServer) ListJMHistoryLogFiles(_ context.Context, req *logpb.L
 // full path for taskManager log files:
 // /:space_id/:flow_id/:inst_id/logs/taskmanager/:taskManager_id/:log_file
 // so we need to get existed taskManagerIDs first
-func (s *LogManagerServer) ListTMHistoryLogFiles(_ context.Context, req *logpb.ListHistLogsRequest) (*logpb.ListTMHistLogsReply, error) {
+func (s *LogManagerServer) ListTMHistoryLogFiles(ctx context.Context, req *logpb.ListHistLogsRequest) (*logpb.ListTMHistLogsReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
 	TMHdfsDirPath := internal.GetHdfsDirPath(req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId(), constants.TaskManagerName)
-	subDirInfos, err := handler.ListHistoryLogFiles(TMHdfsDirPath)
+	subDirInfos, err := handler.ListHistoryLogFiles(ctx, TMHdfsDirPath)
 	if err != nil {
 		return nil, err
 	}
@@ -38,21 +54,25 @@ func (s *LogManagerServer) ListTMHistoryLogFiles(_ context.Context, req *logpb.L
 			continue
 		}
 		fullSubPath := fmt.Sprintf("%s/%s", TMHdfsDirPath, _dirInfo.Name())
-		_logFileInfosUnderTaskManager := getFileStatInDir(fullSubPath)
+		_logFileInfosUnderTaskManager := getFileStatInDir(ctx, fullSubPath)
 		resultMap[_dirInfo.Name()] = &logpb.TaskLogFiles{Stat: _logFileInfosUnderTaskManager}
 	}
 
 	return &logpb.ListTMHistLogsReply{TaskLogs: resultMap}, nil
 }
 
-func getFileStatInDir(hdfsDirPath string) []*logpb.FileState {
+func getFileStatInDir(ctx context.Context, hdfsDirPath string) []*logpb.FileState {
 	result := []*logpb.FileState{}
-	logFileInfos, err := handler.ListHistoryLogFiles(hdfsDirPath)
+	logFileInfos, err := handler.ListHistoryLogFiles(ctx, hdfsDirPath)
 	if err == nil {
 		for _, JMLogFile := range logFileInfos {
+			if internal.IsHiddenFile(JMLogFile.Name()) {
+				continue
+			}
 			_info := &logpb.FileState{
 				FileSize: JMLogFile.Size(),
 				FileName: JMLogFile.Name(),
+				ModTime:  internal.UnixMilli(JMLogFile.ModTime()),
 			}
 			result = append(result, _info)
 		}
@@ -60,22 +80,275 @@ func getFileStatInDir(hdfsDirPath string) []*logpb.FileState {
 	return result
 }
 
+func (s *LogManagerServer) ListLogFiles(ctx context.Context, req *logpb.ListLogFilesRequest) (*logpb.ListLogFilesReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+		optionalTaskManagerID(req.GetTaskManagerIdPrefix()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.ListLogFiles(ctx, req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId(), &handler.ListLogFilesOptions{
+		ManagerName:         req.GetManagerName(),
+		TaskManagerIDPrefix: req.GetTaskManagerIdPrefix(),
+		FileNamePattern:     req.GetFileNamePattern(),
+		SortBy:              req.GetSortBy(),
+		Descending:          req.GetDescending(),
+		PageSize:            req.GetPageSize(),
+		PageToken:           req.GetPageToken(),
+	})
+}
+
+func (s *LogManagerServer) ListFlowsWithLogs(ctx context.Context, req *logpb.ListFlowsWithLogsRequest) (*logpb.ListFlowsWithLogsReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.ListFlowsWithLogs(ctx, req.GetSpaceId(), req.GetPageSize(), req.GetPageToken())
+}
+
+func (s *LogManagerServer) ListInstancesWithLogs(ctx context.Context, req *logpb.ListInstancesWithLogsRequest) (*logpb.ListInstancesWithLogsReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.ListInstancesWithLogs(ctx, req.GetSpaceId(), req.GetFlowId(), req.GetPageSize(), req.GetPageToken())
+}
+
 func (s *LogManagerServer) DownloadJobMgrLogFile(req *logpb.DownloadJobMgrRequest, stream logpb.LogManager_DownloadJobMgrLogFileServer) error {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+		requireFileName(req.GetFileName()),
+	); err != nil {
+		return err
+	}
+
 	hdfsJobMgrFilePath := internal.GetHdfsJobMgrFilePath(req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId(), req.GetFileName())
-	return handler.DownloadLogFile(hdfsJobMgrFilePath, stream)
+	return handler.DownloadLogFile(stream.Context(), hdfsJobMgrFilePath, stream)
 }
 
 func (s *LogManagerServer) DownloadTaskMgrLogFile(req *logpb.DownloadTaskMgrRequest, stream logpb.LogManager_DownloadTaskMgrLogFileServer) error {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+		requireTaskManagerID(req.GetTaskManagerId()),
+		requireFileName(req.GetFileName()),
+	); err != nil {
+		return err
+	}
+
 	hdfsTaskMgrFilePath := internal.GetHdfsTaskMgrFilePath(req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId(), req.GetTaskManagerId(), req.GetFileName())
-	return handler.DownloadLogFile(hdfsTaskMgrFilePath, stream)
+	return handler.DownloadLogFile(stream.Context(), hdfsTaskMgrFilePath, stream)
+}
+
+func (s *LogManagerServer) DownloadInstanceLogs(req *logpb.DownloadInstanceLogsRequest, stream logpb.LogManager_DownloadInstanceLogsServer) error {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return err
+	}
+
+	return handler.DownloadInstanceLogs(stream.Context(), req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId(), req.GetFormat(), stream)
 }
 
-func (s *LogManagerServer) UploadLogFile(_ context.Context, req *logpb.UploadFileRequest) (*logpb.UploadFileReply, error) {
+func (s *LogManagerServer) UploadLogFile(ctx context.Context, req *logpb.UploadFileRequest) (*logpb.UploadFileReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
 	prePath := filepath.Join("/", req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId())
-	return handler.UploadLogFile(req.GetServerUrl(), prePath)
+	return handler.UploadLogFile(ctx, req.GetServerUrl(), prePath)
 }
 
-func (s *LogManagerServer) GetUploadingTaskStat(_ context.Context, req *logpb.TaskStatRequest) (*logpb.TaskStatReply, error) {
+func (s *LogManagerServer) GetUploadingTaskStat(ctx context.Context, req *logpb.TaskStatRequest) (*logpb.TaskStatReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
 	prePath := filepath.Join("/", req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId())
-	return handler.CheckUploadingTask(req.GetServerUrl(), prePath)
+	return handler.CheckUploadingTask(ctx, req.GetServerUrl(), prePath)
+}
+
+func (s *LogManagerServer) GetInstanceManifest(ctx context.Context, req *logpb.InstanceManifestRequest) (*logpb.InstanceManifestReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.GetInstanceManifest(ctx, req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId())
+}
+
+func (s *LogManagerServer) GetErrorSummary(ctx context.Context, req *logpb.ErrorSummaryRequest) (*logpb.ErrorSummaryReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.GetErrorSummary(ctx, req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId())
+}
+
+func (s *LogManagerServer) CompareErrorSummary(ctx context.Context, req *logpb.CompareErrorSummaryRequest) (*logpb.CompareErrorSummaryReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("base_instance_id", req.GetBaseInstanceId()),
+		requireID("target_instance_id", req.GetTargetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.CompareErrorSummary(ctx, req.GetSpaceId(), req.GetFlowId(), req.GetBaseInstanceId(), req.GetTargetInstanceId())
+}
+
+// read lines of a JobManager log file, or a TaskManager log file if TaskManagerId is set
+func (s *LogManagerServer) ReadLogLines(ctx context.Context, req *logpb.ReadLogLinesRequest) (*logpb.ReadLogLinesReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+		optionalTaskManagerID(req.GetTaskManagerId()),
+		requireFileName(req.GetFileName()),
+	); err != nil {
+		return nil, err
+	}
+
+	filePath := internal.GetHdfsJobMgrFilePath(req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId(), req.GetFileName())
+	if req.GetTaskManagerId() != "" {
+		filePath = internal.GetHdfsTaskMgrFilePath(req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId(), req.GetTaskManagerId(), req.GetFileName())
+	}
+	return handler.ReadLogLines(ctx, filePath, req.GetStartLine(), req.GetStartTime(), req.GetLineCount())
+}
+
+func (s *LogManagerServer) QueryLogIndex(ctx context.Context, req *logpb.QueryLogIndexRequest) (*logpb.QueryLogIndexReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		optionalID("flow_id", req.GetFlowId()),
+		optionalID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
+	scope := &internal.SearchScope{
+		SpaceID:    req.GetSpaceId(),
+		FlowID:     req.GetFlowId(),
+		InstanceID: req.GetInstanceId(),
+		StartTime:  req.GetStartTime(),
+		EndTime:    req.GetEndTime(),
+	}
+	return handler.QueryLogIndex(ctx, scope, req.GetQuery(), req.GetLimit())
+}
+
+// search all instances of /:space_id/:flow_id, or of all flows in /:space_id if FlowId is empty
+func (s *LogManagerServer) SearchLogs(req *logpb.SearchLogsRequest, stream logpb.LogManager_SearchLogsServer) error {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		optionalID("flow_id", req.GetFlowId()),
+	); err != nil {
+		return err
+	}
+
+	return handler.SearchLogs(stream.Context(), req.GetSpaceId(), req.GetFlowId(), req.GetPattern(), req.GetLimit(), stream)
+}
+
+func (s *LogManagerServer) DeleteInstanceLogs(ctx context.Context, req *logpb.DeleteInstanceLogsRequest) (*logpb.DeleteLogsReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+		requireID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.DeleteInstanceLogs(ctx, req.GetSpaceId(), req.GetFlowId(), req.GetInstanceId())
+}
+
+func (s *LogManagerServer) DeleteFlowLogs(ctx context.Context, req *logpb.DeleteFlowLogsRequest) (*logpb.DeleteLogsReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		requireID("flow_id", req.GetFlowId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.DeleteFlowLogs(ctx, req.GetSpaceId(), req.GetFlowId())
+}
+
+func (s *LogManagerServer) DeleteSpaceLogs(ctx context.Context, req *logpb.DeleteSpaceLogsRequest) (*logpb.DeleteLogsReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.DeleteSpaceLogs(ctx, req.GetSpaceId())
+}
+
+func (s *LogManagerServer) GetStorageUsage(ctx context.Context, req *logpb.StorageUsageRequest) (*logpb.StorageUsageReply, error) {
+	if err := validateRequest(
+		requireID("space_id", req.GetSpaceId()),
+		optionalID("flow_id", req.GetFlowId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.GetStorageUsage(ctx, req.GetSpaceId(), req.GetFlowId())
+}
+
+// report the storage usage of a space, or of all spaces if SpaceId is empty
+func (s *LogManagerServer) GetStorageReport(ctx context.Context, req *logpb.StorageReportRequest) (*logpb.StorageReportReply, error) {
+	if err := validateRequest(
+		optionalID("space_id", req.GetSpaceId()),
+	); err != nil {
+		return nil, err
+	}
+
+	return handler.GetStorageReport(ctx, req.GetSpaceId())
+}
+
+// query the audit events of the calls of the service, it may only be called by the identities of all spaces
+func (s *LogManagerServer) QueryAuditEvents(ctx context.Context, req *logpb.QueryAuditEventsRequest) (*logpb.QueryAuditEventsReply, error) {
+	if err := validateRequest(
+		optionalID("space_id", req.GetSpaceId()),
+		optionalID("flow_id", req.GetFlowId()),
+		optionalID("instance_id", req.GetInstanceId()),
+	); err != nil {
+		return nil, err
+	}
+
+	filter := &handler.AuditFilter{
+		Identity:   req.GetIdentity(),
+		Method:     req.GetMethod(),
+		SpaceID:    req.GetSpaceId(),
+		FlowID:     req.GetFlowId(),
+		InstanceID: req.GetInstanceId(),
+		StartTime:  req.GetStartTime(),
+		EndTime:    req.GetEndTime(),
+	}
+	return handler.QueryAuditEvents(ctx, filter, req.GetLimit())
 }
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+
+	"github.com/DataWorkbench/logmanager/config"
+	"github.com/DataWorkbench/logmanager/handler"
+	"github.com/DataWorkbench/logmanager/internal"
+)
+
+// Reconcile rebuilds the metadata catalog from the files archived in HDFS,
+// it fails if the catalog is opened by a running server.
+func Reconcile() (err error) {
+	var cfg *config.Config
+
+	cfg, err = config.Load()
+	if err != nil {
+		return
+	}
+	if !cfg.Catalog.Enabled {
+		return fmt.Errorf("catalog is disabled")
+	}
+
+	lp := glog.NewDefault().WithLevel(glog.Level(cfg.LogLevel))
+	defer func() {
+		_ = lp.Close()
+	}()
+
+	catalog, err := internal.OpenCatalog(cfg.Catalog.Path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = catalog.Close()
+	}()
+
+	handler.Init(
+		handler.WithHdfsConfig(cfg.HdfsServer),
+		handler.WithCatalog(catalog),
+	)
+
+	startTime := time.Now()
+	fileCount, err := handler.ReconcileCatalog(glog.WithContext(context.Background(), lp))
+	if err != nil {
+		return
+	}
+	fmt.Printf("%s catalog <%s> rebuilt with %d files in %s\n",
+		time.Now().Format(time.RFC3339Nano), cfg.Catalog.Path, fileCount, time.Since(startTime))
+	return
+}
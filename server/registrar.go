@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// interceptRegistrar registers services with its interceptors.
+// The grpc.Server is built by grpcwrap, so the interceptors are installed on the handlers of the services,
+// inside the interceptors of the server, which still log and trace the calls they deny.
+// The interceptors of a wrapped registrar run before the ones of the registrar wrapping it.
+type interceptRegistrar struct {
+	grpc.ServiceRegistrar
+	unary  grpc.UnaryServerInterceptor
+	stream grpc.StreamServerInterceptor
+}
+
+func (r *interceptRegistrar) RegisterService(desc *grpc.ServiceDesc, impl interface{}) {
+	wrapped := *desc
+
+	wrapped.Methods = make([]grpc.MethodDesc, len(desc.Methods))
+	for i, m := range desc.Methods {
+		handler := m.Handler
+		m.Handler = func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			return handler(srv, ctx, dec, r.chainUnary(interceptor))
+		}
+		wrapped.Methods[i] = m
+	}
+
+	wrapped.Streams = make([]grpc.StreamDesc, len(desc.Streams))
+	for i, sd := range desc.Streams {
+		handler := sd.Handler
+		info := &grpc.StreamServerInfo{
+			FullMethod:     fmt.Sprintf("/%s/%s", desc.ServiceName, sd.StreamName),
+			IsClientStream: sd.ClientStreams,
+			IsServerStream: sd.ServerStreams,
+		}
+		sd.Handler = func(srv interface{}, stream grpc.ServerStream) error {
+			return r.stream(srv, stream, info, handler)
+		}
+		wrapped.Streams[i] = sd
+	}
+
+	r.ServiceRegistrar.RegisterService(&wrapped, impl)
+}
+
+// chainUnary runs the interceptor of the registrar after the interceptors of the server, if any.
+func (r *interceptRegistrar) chainUnary(outer grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	if outer == nil {
+		return r.unary
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return outer(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return r.unary(ctx, req, info, handler)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/DataWorkbench/glog"
+
+	"github.com/DataWorkbench/logmanager/config"
+	"github.com/DataWorkbench/logmanager/handler"
+	"github.com/DataWorkbench/logmanager/internal"
+)
+
+// newKeyProvider returns the provider of the master keys of the key file, nil if no key file is configured.
+func newKeyProvider(cfg *config.EncryptionConfig) (internal.KeyProvider, error) {
+	if cfg.KeyFile == "" {
+		return nil, nil
+	}
+	return internal.NewLocalKeyProvider(cfg.KeyFile)
+}
+
+// RewrapKeys wraps the data keys of the encrypted files with the current master key of the key file,
+// the previous master keys can be removed from the key file once it's done.
+// Compaction must not run meanwhile, the archives of compacted instances are rewritten.
+func RewrapKeys() (err error) {
+	var cfg *config.Config
+
+	cfg, err = config.Load()
+	if err != nil {
+		return
+	}
+
+	keyProvider, err := newKeyProvider(cfg.Encryption)
+	if err != nil {
+		return
+	}
+	if keyProvider == nil {
+		return fmt.Errorf("no key file is configured")
+	}
+
+	lp := glog.NewDefault().WithLevel(glog.Level(cfg.LogLevel))
+	defer func() {
+		_ = lp.Close()
+	}()
+
+	handler.Init(
+		handler.WithHdfsConfig(cfg.HdfsServer),
+		handler.WithKeyProvider(keyProvider, cfg.Encryption.Enabled),
+	)
+
+	startTime := time.Now()
+	keyCount, err := handler.RewrapFileKeys(glog.WithContext(context.Background(), lp))
+	if err != nil {
+		return
+	}
+	fmt.Printf("%s %d file keys rewrapped with master key <%s> in %s\n",
+		time.Now().Format(time.RFC3339Nano), keyCount, keyProvider.CurrentKeyID(), time.Since(startTime))
+	return
+}
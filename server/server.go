@@ -6,7 +6,9 @@ import (
 	"github.com/DataWorkbench/common/gtrace"
 	"github.com/DataWorkbench/gproto/pkg/logpb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -16,10 +18,10 @@ import (
 	"github.com/DataWorkbench/glog"
 
 	"github.com/DataWorkbench/common/grpcwrap"
-	"github.com/DataWorkbench/common/metrics"
 
 	"github.com/DataWorkbench/logmanager/config"
 	"github.com/DataWorkbench/logmanager/handler"
+	"github.com/DataWorkbench/logmanager/internal"
 )
 
 // Start for start the http server
@@ -40,14 +42,25 @@ func Start() (err error) {
 
 	var (
 		rpcServer    *grpcwrap.Server
-		metricServer *metrics.Server
+		metricServer *http.Server
+		healthCheck  *healthChecker
 		tracer       gtrace.Tracer
 		tracerCloser io.Closer
+		// stops the audit writer once the calls in flight are recorded
+		stopAudit func()
 	)
 
 	defer func() {
+		if healthCheck != nil {
+			healthCheck.shutdown()
+		}
 		rpcServer.GracefulStop()
-		_ = metricServer.Shutdown(ctx)
+		if stopAudit != nil {
+			stopAudit()
+		}
+		if metricServer != nil {
+			_ = metricServer.Shutdown(ctx)
+		}
 		if tracerCloser != nil {
 			_ = tracerCloser.Close()
 		}
@@ -67,15 +80,119 @@ func Start() (err error) {
 		return
 	}
 
+	if err = internal.InitFlinkClient(cfg.FlinkClient); err != nil {
+		return
+	}
+
+	var searchIndex *internal.SearchIndex
+	if cfg.SearchIndex.Enabled {
+		searchIndex, err = internal.NewSearchIndex(cfg.SearchIndex.Dir)
+		if err != nil {
+			return
+		}
+	}
+
+	var catalog *internal.Catalog
+	if cfg.Catalog.Enabled {
+		catalog, err = internal.OpenCatalog(cfg.Catalog.Path)
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = catalog.Close()
+		}()
+	}
+
+	var redactionRules []*internal.RedactionRule
+	if cfg.Redaction.Enabled {
+		redactionRules, err = internal.NewRedactionRules(cfg.Redaction)
+		if err != nil {
+			return
+		}
+	}
+
+	keyProvider, err := newKeyProvider(cfg.Encryption)
+	if err != nil {
+		return
+	}
+
+	var authz *authorizer
+	if cfg.Auth.Enabled {
+		var policy PolicyProvider
+		policy, err = NewStaticPolicy(cfg.Auth.PolicyFile)
+		if err != nil {
+			return
+		}
+		authz = &authorizer{policy: policy}
+	}
+
+	var auditSink internal.AuditSink
+	if cfg.Audit.Enabled {
+		auditSink, err = internal.NewAuditSink(cfg.Audit, cfg.HdfsServer)
+		if err != nil {
+			return
+		}
+	}
+
+	quotaOverrides, err := config.LoadQuotaOverrides(cfg.Quota.OverridesFile)
+	if err != nil {
+		return
+	}
+
 	// Init handler.
 	handler.Init(
-		handler.WithLogger(lp),
 		handler.WithHdfsConfig(cfg.HdfsServer),
+		handler.WithSearchIndex(searchIndex),
+		handler.WithCatalog(catalog),
+		handler.WithRedactionRules(redactionRules),
+		handler.WithKeyProvider(keyProvider, cfg.Encryption.Enabled),
+		handler.WithAuditSink(auditSink),
+		handler.WithQuotaConfig(cfg.Quota, quotaOverrides),
+		handler.WithUsageReportConfig(cfg.UsageReport),
+		handler.WithMetricsConfig(cfg.Metrics),
 	)
 
+	// background workers are stopped before the server exits
+	bgCtx, bgCancel := context.WithCancel(ctx)
+	defer bgCancel()
+
+	healthCheck = newHealthChecker(cfg.Health, lp)
+	go healthCheck.run(bgCtx)
+
+	if cfg.Retention.Enabled {
+		go handler.RunRetentionSweeper(bgCtx, cfg.Retention)
+	}
+	if cfg.Compaction.Enabled {
+		go handler.RunCompactor(bgCtx, cfg.Compaction)
+	}
+	if auditSink != nil {
+		auditCtx, auditCancel := context.WithCancel(ctx)
+		auditDone := make(chan struct{})
+		go func() {
+			handler.RunAuditWriter(auditCtx, cfg.Audit.FlushInterval)
+			_ = auditSink.Close()
+			close(auditDone)
+		}()
+		stopAudit = func() {
+			auditCancel()
+			<-auditDone
+		}
+	}
+
 	// Register rpc server.
 	rpcServer.Register(func(s *grpc.Server) {
-		logpb.RegisterLogManagerServer(s, &LogManagerServer{})
+		// the auditor runs first to record the calls denied by the authorizer
+		var registrar grpc.ServiceRegistrar = s
+		if auditSink != nil {
+			a := &auditor{authorizer: authz}
+			registrar = &interceptRegistrar{ServiceRegistrar: registrar, unary: a.unaryInterceptor, stream: a.streamInterceptor}
+		}
+		if authz != nil {
+			registrar = &interceptRegistrar{ServiceRegistrar: registrar, unary: authz.unaryInterceptor, stream: authz.streamInterceptor}
+		}
+		logpb.RegisterLogManagerServer(registrar, &LogManagerServer{})
+		// probes are neither authorized nor audited
+		grpc_health_v1.RegisterHealthServer(s, healthCheck.server)
 	})
 
 	// handle signal
@@ -91,18 +208,16 @@ func Start() (err error) {
 		blockChan <- struct{}{}
 	}()
 
-	// init prometheus server
-	metricServer, err = metrics.NewServer(ctx, cfg.MetricsServer)
-	if err != nil {
-		return err
+	// init prometheus server, which serves the readiness endpoint too
+	metricServer = newMetricsServer(cfg.MetricsServer, cfg.Health.ReadinessPath, healthCheck)
+	if metricServer != nil {
+		go func() {
+			if err := metricServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				lp.Error().Error("metrics server failed", err).Fire()
+			}
+		}()
 	}
 
-	go func() {
-		if err := metricServer.ListenAndServe(); err != nil {
-			return
-		}
-	}()
-
 	go func() {
 		sig := <-sigChan
 		lp.Info().String("receive system signal", sig.String()).Fire()
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/DataWorkbench/logmanager/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The ids and file names of requests are spliced into HDFS and local paths,
+// so anything that could be read as a separator or a dot segment is rejected.
+var (
+	// space, flow and instance ids, e.g. "wks-0000000000000001"
+	idRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+	// the same names are accepted from the Flink servers logs are collected from
+	taskManagerIDRegexp = internal.TaskManagerIDRegexp
+	fileNameRegexp      = internal.FileNameRegexp
+)
+
+func invalidField(name, value, reason string) error {
+	return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s %q, %s", name, value, reason))
+}
+
+func checkField(name, value string, required bool, pattern *regexp.Regexp) error {
+	if value == "" {
+		if required {
+			return invalidField(name, value, "it's required")
+		}
+		return nil
+	}
+	// names starting with a dot are dot segments or hidden metadata files such as line indexes
+	if strings.HasPrefix(value, ".") {
+		return invalidField(name, value, "it must not start with a dot")
+	}
+	if !pattern.MatchString(value) {
+		return invalidField(name, value, "it contains illegal characters")
+	}
+	return nil
+}
+
+func requireID(name, value string) error {
+	return checkField(name, value, true, idRegexp)
+}
+
+func optionalID(name, value string) error {
+	return checkField(name, value, false, idRegexp)
+}
+
+func requireTaskManagerID(value string) error {
+	return checkField("task_manager_id", value, true, taskManagerIDRegexp)
+}
+
+func optionalTaskManagerID(value string) error {
+	return checkField("task_manager_id", value, false, taskManagerIDRegexp)
+}
+
+func requireFileName(value string) error {
+	return checkField("file_name", value, true, fileNameRegexp)
+}
+
+// validateRequest returns the first error of the field checks.
+func validateRequest(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
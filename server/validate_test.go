@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DataWorkbench/gproto/pkg/logpb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(string) error
+		value string
+		valid bool
+	}{
+		{"id", func(v string) error { return requireID("space_id", v) }, "wks-0000000000000001", true},
+		{"id with underscore", func(v string) error { return requireID("space_id", v) }, "Test_Space_ID", true},
+		{"empty required id", func(v string) error { return requireID("space_id", v) }, "", false},
+		{"empty optional id", func(v string) error { return optionalID("flow_id", v) }, "", true},
+		{"dot id", func(v string) error { return requireID("space_id", v) }, ".", false},
+		{"dot dot id", func(v string) error { return requireID("space_id", v) }, "..", false},
+		{"id with slash", func(v string) error { return requireID("space_id", v) }, "a/b", false},
+		{"id with backslash", func(v string) error { return requireID("space_id", v) }, `a\b`, false},
+		{"id escaping parent", func(v string) error { return requireID("flow_id", v) }, "../other_space", false},
+		{"absolute id", func(v string) error { return requireID("flow_id", v) }, "/other_space", false},
+		{"id with dot", func(v string) error { return requireID("instance_id", v) }, "inst.1", false},
+		{"id with NUL", func(v string) error { return requireID("instance_id", v) }, "inst\x00", false},
+		{"id with space", func(v string) error { return requireID("instance_id", v) }, "inst 1", false},
+		{"url encoded dot dot", func(v string) error { return requireID("instance_id", v) }, "%2e%2e", false},
+		{"id too long", func(v string) error { return requireID("instance_id", v) }, strings.Repeat("a", 129), false},
+
+		{"task manager id", requireTaskManagerID, "10.0.0.1:34567-6f1a2b", true},
+		{"yarn task manager id", requireTaskManagerID, "container_e01_1620000000000_0001_01_000002", true},
+		{"empty optional task manager id", optionalTaskManagerID, "", true},
+		{"dot dot task manager id", requireTaskManagerID, "..", false},
+		{"task manager id escaping parent", requireTaskManagerID, "../../other_space", false},
+		{"task manager id with slash", requireTaskManagerID, "tm/../x", false},
+
+		{"file name", requireFileName, "flink-root-taskexecutor-0-host.log", true},
+		{"rolled file name", requireFileName, "taskmanager.log.1", true},
+		{"empty file name", requireFileName, "", false},
+		{"dot file name", requireFileName, ".", false},
+		{"dot dot file name", requireFileName, "..", false},
+		{"hidden file name", requireFileName, ".taskmanager.log.idx", false},
+		{"file name escaping parent", requireFileName, "../../other_space/flow/inst/logs/jobmanager/jobmanager.log", false},
+		{"file name with slash", requireFileName, "jobmanager/jobmanager.log", false},
+		{"file name with backslash", requireFileName, `..\jobmanager.log`, false},
+		{"file name with newline", requireFileName, "jobmanager.log\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.check(tt.value)
+			if tt.valid {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, codes.InvalidArgument, status.Code(err), "%+v", err)
+		})
+	}
+}
+
+// invalid requests are rejected before reaching the handler, which is not initialized here
+func TestRejectPathEscapes(t *testing.T) {
+	s := &LogManagerServer{}
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"download JobManager file escaping the instance", func() error {
+			return s.DownloadJobMgrLogFile(&logpb.DownloadJobMgrRequest{
+				SpaceId: "space", FlowId: "flow", InstanceId: "inst",
+				FileName: "../../../other_space/flow/inst/logs/jobmanager/jobmanager.log",
+			}, nil)
+		}},
+		{"download TaskManager file from a parent dir", func() error {
+			return s.DownloadTaskMgrLogFile(&logpb.DownloadTaskMgrRequest{
+				SpaceId: "space", FlowId: "flow", InstanceId: "inst",
+				TaskManagerId: "..", FileName: "taskmanager.log",
+			}, nil)
+		}},
+		{"download with empty space id", func() error {
+			return s.DownloadJobMgrLogFile(&logpb.DownloadJobMgrRequest{
+				FlowId: "flow", InstanceId: "inst", FileName: "jobmanager.log",
+			}, nil)
+		}},
+		{"list files of another space", func() error {
+			_, err := s.ListJMHistoryLogFiles(ctx, &logpb.ListHistLogsRequest{
+				SpaceId: "space", FlowId: "../other_space", InstanceId: "inst",
+			})
+			return err
+		}},
+		{"upload into a parent dir", func() error {
+			_, err := s.UploadLogFile(ctx, &logpb.UploadFileRequest{
+				SpaceId: "..", FlowId: "flow", InstanceId: "inst", ServerUrl: "http://127.0.0.1:8081",
+			})
+			return err
+		}},
+		{"read hidden line index", func() error {
+			_, err := s.ReadLogLines(ctx, &logpb.ReadLogLinesRequest{
+				SpaceId: "space", FlowId: "flow", InstanceId: "inst", FileName: ".jobmanager.log.idx",
+			})
+			return err
+		}},
+		{"delete a space through the flow id", func() error {
+			_, err := s.DeleteFlowLogs(ctx, &logpb.DeleteFlowLogsRequest{SpaceId: "space", FlowId: ".."})
+			return err
+		}},
+		{"query index of another space", func() error {
+			_, err := s.QueryLogIndex(ctx, &logpb.QueryLogIndexRequest{SpaceId: "../other_space", Query: "error"})
+			return err
+		}},
+		{"query index of all spaces", func() error {
+			_, err := s.QueryLogIndex(ctx, &logpb.QueryLogIndexRequest{Query: "error"})
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			require.Error(t, err)
+			require.Equal(t, codes.InvalidArgument, status.Code(err), "%+v", err)
+		})
+	}
+}